@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+type accountCalendar struct {
+	accountID string
+	calendar  Calendar
+}
+
+// CompositeCalendar merges the calendars of all accounts of a user. The
+// account the user signed up with comes first and has an empty id.
+type CompositeCalendar struct {
+	accounts []accountCalendar
+}
+
+func NewCompositeCalendar(main Calendar, accounts []LinkedAccount) *CompositeCalendar {
+	composite := &CompositeCalendar{
+		accounts: []accountCalendar{{calendar: main}},
+	}
+	for _, account := range accounts {
+		service, err := newAccountCalendar(account)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		accountID := strconv.FormatUint(uint64(account.ID), 10)
+		composite.accounts = append(composite.accounts, accountCalendar{
+			accountID: accountID,
+			calendar:  withCache(service, account.UserID, accountID),
+		})
+	}
+	return composite
+}
+
+func newAccountCalendar(account LinkedAccount) (Calendar, error) {
+	service, err := newProviderCalendar(account.Provider, User{CalenderToken: account.Token}, account.Token)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect account %s: %w", account.Email, err)
+	}
+	return service, nil
+}
+
+func (c *CompositeCalendar) account(id string) (Calendar, error) {
+	for _, account := range c.accounts {
+		if account.accountID == id {
+			return account.calendar, nil
+		}
+	}
+	return nil, fmt.Errorf("account %s not linked", id)
+}
+
+func (c *CompositeCalendar) CreateEvent(event Event) error {
+	service, err := c.account(event.AccountID)
+	if err != nil {
+		return err
+	}
+	return service.CreateEvent(event)
+}
+
+func (c *CompositeCalendar) CreateEventID(event Event) (string, error) {
+	service, err := c.account(event.AccountID)
+	if err != nil {
+		return "", err
+	}
+	return createEventID(service, event)
+}
+
+func (c *CompositeCalendar) UpdateEvent(event Event) error {
+	service, err := c.account(event.AccountID)
+	if err != nil {
+		return err
+	}
+	return service.UpdateEvent(event)
+}
+
+func (c *CompositeCalendar) RemoveEvent(event Event) error {
+	service, err := c.account(event.AccountID)
+	if err != nil {
+		return err
+	}
+	return service.RemoveEvent(event)
+}
+
+func (c *CompositeCalendar) GetSeries(id string) (*Event, error) {
+	for _, account := range c.accounts {
+		series, ok := account.calendar.(SeriesCalendar)
+		if !ok {
+			continue
+		}
+		if event, err := series.GetSeries(id); err == nil {
+			event.AccountID = account.accountID
+			return event, nil
+		}
+	}
+	return nil, fmt.Errorf("event %s not found", id)
+}
+
+// GetEvents loads all accounts at once. Linked accounts that fail are left
+// out, so that one expired token doesn't hide the whole calendar.
+func (c *CompositeCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	return c.collect(func(service Calendar) ([]*Event, error) {
+		return service.GetEvents(startTime, endTime)
+	})
+}
+
+func (c *CompositeCalendar) SearchEvents(query SearchQuery) ([]*Event, error) {
+	return c.collect(func(service Calendar) ([]*Event, error) {
+		return searchEvents(service, query)
+	})
+}
+
+// collect loads the events of all accounts in parallel. Failing linked
+// accounts are left out.
+func (c *CompositeCalendar) collect(load func(service Calendar) ([]*Event, error)) ([]*Event, error) {
+	results := make([][]*Event, len(c.accounts))
+	errs := make([]error, len(c.accounts))
+
+	var wg sync.WaitGroup
+	for i, account := range c.accounts {
+		wg.Add(1)
+		go func(i int, account accountCalendar) {
+			defer wg.Done()
+			results[i], errs[i] = load(account.calendar)
+		}(i, account)
+	}
+	wg.Wait()
+
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+
+	seen := map[string]bool{}
+	var arr []*Event
+	for i, events := range results {
+		if errs[i] != nil {
+			log.Printf("account %s: %s", c.accounts[i].accountID, errs[i])
+			continue
+		}
+		keys := map[string]bool{}
+		for _, event := range events {
+			event.AccountID = c.accounts[i].accountID
+			// Meetings the user was invited to with several addresses
+			// show up in the calendars of each account
+			key := eventDedupKey(event)
+			if seen[key] {
+				continue
+			}
+			keys[key] = true
+			arr = append(arr, event)
+		}
+		for key := range keys {
+			seen[key] = true
+		}
+	}
+	sortEventsByStart(arr)
+	return arr, nil
+}
+
+func eventDedupKey(event *Event) string {
+	key := strings.ToLower(strings.TrimSpace(event.Title))
+	for _, value := range []string{event.StartTime, event.EndTime} {
+		if t, err := parseEventTime(value); err == nil {
+			key += "|" + strconv.FormatInt(t.Unix(), 10)
+		} else {
+			key += "|" + value
+		}
+	}
+	return key
+}
+
+func (c *CompositeCalendar) ListCalendars() ([]CalendarInfo, error) {
+	var arr []CalendarInfo
+	for _, account := range c.accounts {
+		multi, ok := account.calendar.(MultiCalendar)
+		if !ok {
+			arr = append(arr, CalendarInfo{Name: "Calendar", Primary: true, AccountID: account.accountID})
+			continue
+		}
+		calendars, err := multi.ListCalendars()
+		if err != nil {
+			return nil, err
+		}
+		for _, calendar := range calendars {
+			calendar.AccountID = account.accountID
+			arr = append(arr, calendar)
+		}
+	}
+	return arr, nil
+}
+
+// SelectCalendars selects calendars of the account the user signed up with
+func (c *CompositeCalendar) SelectCalendars(ids []string) {
+	if multi, ok := c.accounts[0].calendar.(MultiCalendar); ok {
+		multi.SelectCalendars(ids)
+	}
+}
+
+// applyCalendarSettings selects the enabled calendars of every account
+func applyCalendarSettings(service Calendar, settings []CalendarSetting) {
+	if composite, ok := service.(*CompositeCalendar); ok {
+		for _, account := range composite.accounts {
+			if multi, ok := account.calendar.(MultiCalendar); ok {
+				multi.SelectCalendars(enabledCalendarIDs(settings, account.accountID))
+			}
+		}
+		return
+	}
+	if multi, ok := service.(MultiCalendar); ok {
+		multi.SelectCalendars(enabledCalendarIDs(settings, ""))
+	}
+}
+
+// startLinking remembers that the OAuth flow started by the login handlers
+// adds an account to the signed in user instead of signing in
+func startLinking(c *gin.Context, session sessions.Session) {
+	if c.Query("link") == "true" {
+		session.Set("link_account", true)
+	} else {
+		session.Delete("link_account")
+	}
+}
+
+// linkingUser returns the user an account is being linked to, or nil when
+// the OAuth flow is a normal sign in
+func linkingUser(c *gin.Context) *User {
+	session := sessions.Default(c)
+	link, _ := session.Get("link_account").(bool)
+	if !link {
+		return nil
+	}
+	session.Delete("link_account")
+	session.Save()
+
+	token, err := c.Cookie("token")
+	if err != nil {
+		return nil
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+func linkAccount(c *gin.Context, user *User, provider, providerID, email string, token *oauth2.Token) error {
+	if user.Provider == provider && user.ProviderID == providerID {
+		return fmt.Errorf("%s is already the main account", email)
+	}
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	account := &LinkedAccount{}
+	db.Where("user_id = ? AND provider = ? AND provider_id = ?", user.ID, provider, providerID).First(account)
+	account.UserID = user.ID
+	account.Provider = provider
+	account.ProviderID = providerID
+	account.Email = email
+	account.Token = tokenJSON
+	if err := db.Save(account).Error; err != nil {
+		return err
+	}
+
+	forgetService(c)
+	c.Redirect(http.StatusTemporaryRedirect, "http://localhost:8080/chat")
+	return nil
+}
+
+// forgetService makes the next request build the calendar of the user anew
+func forgetService(c *gin.Context) {
+	token, _ := c.Cookie("token")
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	delete(calendarCache, token)
+	delete(conversationsCache, token)
+}
+
+func GetAccounts(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var accounts []LinkedAccount
+	if err := db.Where("user_id = ?", user.ID).Find(&accounts).Error; err != nil {
+		return err
+	}
+
+	type accountResponse struct {
+		ID       string `json:"id"`
+		Provider string `json:"provider"`
+		Email    string `json:"email"`
+	}
+	items := []accountResponse{{Provider: user.Provider, Email: user.Email}}
+	for _, account := range accounts {
+		items = append(items, accountResponse{
+			ID:       strconv.FormatUint(uint64(account.ID), 10),
+			Provider: account.Provider,
+			Email:    account.Email,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+	return nil
+}
+
+func RemoveAccount(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		ID string `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	account := LinkedAccount{}
+	if err := db.Where("user_id = ? AND id = ?", user.ID, json.ID).First(&account).Error; err != nil {
+		return fmt.Errorf("account %s not linked", json.ID)
+	}
+	// Stop notifications while the token still works
+	if service, err := newAccountCalendar(account); err != nil {
+		log.Println(err.Error())
+	} else {
+		stopAccountWatches(user.ID, json.ID, service)
+	}
+
+	if err := db.Delete(&account).Error; err != nil {
+		return err
+	}
+	db.Where("user_id = ? AND account_id = ?", user.ID, json.ID).Delete(&CalendarSetting{})
+	db.Where("user_id = ? AND account_id = ?", user.ID, json.ID).Delete(&CachedEvent{})
+	db.Where("user_id = ? AND account_id = ?", user.ID, json.ID).Delete(&SyncState{})
+
+	forgetService(c)
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CategoryOneOnOne = "oneOnOne"
+	CategoryMeeting  = "meeting"
+	CategoryFocus    = "focus"
+	CategoryBuffer   = "buffer"
+	// Events without anyone else invited
+	CategoryOther = "other"
+
+	// Meetings at most this far apart count as back to back
+	backToBackGap = 5 * time.Minute
+	// Attendees and domains reported
+	analyticsTopCount  = 20
+	maxAnalyticsPeriod = 366 * 24 * time.Hour
+)
+
+type NamedHours struct {
+	Name     string  `json:"name"`
+	Hours    float64 `json:"hours"`
+	Meetings int     `json:"meetings"`
+}
+
+type WeekLoad struct {
+	// Monday the week starts on
+	Start        string  `json:"start"`
+	MeetingHours float64 `json:"meetingHours"`
+	Meetings     int     `json:"meetings"`
+	// Meeting hours compared to the week before
+	Change float64 `json:"change"`
+}
+
+// Streak is a run of meetings without a break in between
+type Streak struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Meetings int       `json:"meetings"`
+}
+
+// Analytics is how the user spent the time between Start and End. Meetings
+// are events with other people invited, and focus time and buffers are the
+// blocks created by the rules of the user.
+type Analytics struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Time in meetings, overlapping meetings counting once
+	MeetingHours float64 `json:"meetingHours"`
+	Meetings     int     `json:"meetings"`
+	FocusHours   float64 `json:"focusHours"`
+	AllDayEvents int     `json:"allDayEvents"`
+	// Hours per category, like CategoryOneOnOne
+	Categories map[string]float64 `json:"categories"`
+	Attendees  []NamedHours       `json:"attendees"`
+	Domains    []NamedHours       `json:"domains"`
+	Weeks      []WeekLoad         `json:"weeks"`
+	// Runs of at least two meetings, the longest first
+	BackToBack []Streak `json:"backToBack"`
+}
+
+func round(hours float64) float64 {
+	return math.Round(hours*100) / 100
+}
+
+// eventCategory puts an event into one of the categories. own are the
+// addresses of the user, and blocks the kinds of the rules their blocks were
+// created for by event ID.
+func eventCategory(event *Event, own map[string]bool, blocks map[string]string) string {
+	if kind, ok := blocks[event.ID]; ok {
+		if kind == PolicyBuffer {
+			return CategoryBuffer
+		}
+		return CategoryFocus
+	}
+	others := len(otherAttendees(event, own))
+	switch {
+	case others == 1:
+		return CategoryOneOnOne
+	case others > 1:
+		return CategoryMeeting
+	}
+	return CategoryOther
+}
+
+func otherAttendees(event *Event, own map[string]bool) []Attendee {
+	var arr []Attendee
+	for _, attendee := range event.Attendees {
+		if !own[strings.ToLower(attendee.Email)] {
+			arr = append(arr, attendee)
+		}
+	}
+	return arr
+}
+
+// ownAddresses are the email addresses of all accounts of the user
+func ownAddresses(user *User) map[string]bool {
+	addresses := map[string]bool{strings.ToLower(user.Email): true}
+	var accounts []LinkedAccount
+	db.Where("user_id = ?", user.ID).Find(&accounts)
+	for _, account := range accounts {
+		addresses[strings.ToLower(account.Email)] = true
+	}
+	return addresses
+}
+
+// startOfWeek returns midnight of the Monday of the week t is in
+func startOfWeek(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
+
+// AnalyzeEvents aggregates the events between start and end
+func AnalyzeEvents(events []*Event, start, end time.Time, own map[string]bool, blocks map[string]string, loc *time.Location) *Analytics {
+	analytics := &Analytics{
+		Start:      start.In(loc),
+		End:        end.In(loc),
+		Categories: map[string]float64{},
+		Weeks:      []WeekLoad{},
+		BackToBack: []Streak{},
+	}
+	attendees := map[string]*NamedHours{}
+	domains := map[string]*NamedHours{}
+	weeks := map[string]*WeekLoad{}
+	var meetings []Interval
+
+	for _, event := range events {
+		if event.AllDay {
+			analytics.AllDayEvents++
+			continue
+		}
+		eventStart, err := parseEventTime(event.StartTime)
+		if err != nil {
+			continue
+		}
+		eventEnd, err := parseEventTime(event.EndTime)
+		if err != nil {
+			continue
+		}
+		// Only the part within the range counts
+		eventStart = maxTime(eventStart, start).In(loc)
+		eventEnd = minTime(eventEnd, end).In(loc)
+		if !eventEnd.After(eventStart) {
+			continue
+		}
+		hours := eventEnd.Sub(eventStart).Hours()
+
+		category := eventCategory(event, own, blocks)
+		analytics.Categories[category] += hours
+		if category == CategoryFocus {
+			analytics.FocusHours += hours
+		}
+		if category != CategoryOneOnOne && category != CategoryMeeting {
+			continue
+		}
+
+		analytics.Meetings++
+		meetings = append(meetings, Interval{Start: eventStart, End: eventEnd})
+		week := startOfWeek(eventStart).Format(dateLayout)
+		if weeks[week] == nil {
+			weeks[week] = &WeekLoad{Start: week}
+		}
+		weeks[week].MeetingHours += hours
+		weeks[week].Meetings++
+
+		seenDomains := map[string]bool{}
+		for _, attendee := range otherAttendees(event, own) {
+			email := strings.ToLower(attendee.Email)
+			if attendees[email] == nil {
+				attendees[email] = &NamedHours{Name: email}
+			}
+			attendees[email].Hours += hours
+			attendees[email].Meetings++
+
+			domain := emailDomain(email)
+			if domain == "" || seenDomains[domain] {
+				continue
+			}
+			seenDomains[domain] = true
+			if domains[domain] == nil {
+				domains[domain] = &NamedHours{Name: domain}
+			}
+			domains[domain].Hours += hours
+			domains[domain].Meetings++
+		}
+	}
+
+	for _, interval := range mergeIntervals(append([]Interval(nil), meetings...)) {
+		analytics.MeetingHours += interval.End.Sub(interval.Start).Hours()
+	}
+	analytics.MeetingHours = round(analytics.MeetingHours)
+	analytics.FocusHours = round(analytics.FocusHours)
+	for category, hours := range analytics.Categories {
+		analytics.Categories[category] = round(hours)
+	}
+	analytics.Attendees = topNamedHours(attendees)
+	analytics.Domains = topNamedHours(domains)
+
+	// Every week of the range is listed, also those without meetings
+	var previous *WeekLoad
+	for week := startOfWeek(start.In(loc)); week.Before(end); week = week.AddDate(0, 0, 7) {
+		load := weeks[week.Format(dateLayout)]
+		if load == nil {
+			load = &WeekLoad{Start: week.Format(dateLayout)}
+		}
+		load.MeetingHours = round(load.MeetingHours)
+		if previous != nil {
+			load.Change = round(load.MeetingHours - previous.MeetingHours)
+		}
+		analytics.Weeks = append(analytics.Weeks, *load)
+		previous = load
+	}
+
+	analytics.BackToBack = backToBackStreaks(meetings)
+	return analytics
+}
+
+func topNamedHours(values map[string]*NamedHours) []NamedHours {
+	arr := []NamedHours{}
+	for _, value := range values {
+		value.Hours = round(value.Hours)
+		arr = append(arr, *value)
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		if arr[i].Hours != arr[j].Hours {
+			return arr[i].Hours > arr[j].Hours
+		}
+		return arr[i].Name < arr[j].Name
+	})
+	if len(arr) > analyticsTopCount {
+		arr = arr[:analyticsTopCount]
+	}
+	return arr
+}
+
+// backToBackStreaks finds the runs of meetings starting within
+// backToBackGap of the end of the one before
+func backToBackStreaks(meetings []Interval) []Streak {
+	sort.Slice(meetings, func(i, j int) bool { return meetings[i].Start.Before(meetings[j].Start) })
+	arr := []Streak{}
+	var current *Streak
+	for _, meeting := range meetings {
+		if current != nil && !meeting.Start.After(current.End.Add(backToBackGap)) {
+			current.Meetings++
+			current.End = maxTime(current.End, meeting.End)
+			continue
+		}
+		if current != nil && current.Meetings > 1 {
+			arr = append(arr, *current)
+		}
+		current = &Streak{Start: meeting.Start, End: meeting.End, Meetings: 1}
+	}
+	if current != nil && current.Meetings > 1 {
+		arr = append(arr, *current)
+	}
+	sort.SliceStable(arr, func(i, j int) bool {
+		return arr[i].End.Sub(arr[i].Start) > arr[j].End.Sub(arr[j].Start)
+	})
+	return arr
+}
+
+// analyzeUser reads the events of the range and aggregates them
+func analyzeUser(user *User, events []*Event, start, end time.Time) *Analytics {
+	kinds := map[uint]string{}
+	var policyRules []PolicyRule
+	db.Unscoped().Where("user_id = ?", user.ID).Find(&policyRules)
+	for _, rule := range policyRules {
+		kinds[rule.ID] = rule.Kind
+	}
+	blocks := map[string]string{}
+	for eventID, ruleID := range policyBlockRules(user.ID) {
+		blocks[eventID] = kinds[ruleID]
+	}
+	return AnalyzeEvents(events, start, end, ownAddresses(user), blocks, userLocation(user))
+}
+
+func GetAnalytics(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	v := &ValidationError{}
+	if value := c.Query("start"); value != "" {
+		if start, err = parseEventTime(value); err != nil {
+			v.add("start", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if value := c.Query("end"); value != "" {
+		if end, err = parseEventTime(value); err != nil {
+			v.add("end", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if !end.After(start) || end.Sub(start) > maxAnalyticsPeriod {
+		v.add("end", "must be after start, at most a year later")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	events, err := service.GetEvents(start, end)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, analyzeUser(user, events, start, end))
+	return nil
+}
+
+// runAIAnalytics aggregates the calendars the user shares with the
+// assistant, by default over the last 30 days
+func runAIAnalytics(user *User, service Calendar, request aiToolRequest, settings []CalendarSetting) string {
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	if t, err := parseEventTime(request.Details.StartTime); err == nil {
+		start = t
+	}
+	if t, err := parseEventTime(request.Details.EndTime); err == nil {
+		end = t
+	}
+	if !end.After(start) || end.Sub(start) > maxAnalyticsPeriod {
+		return "Analysis: the range has to be at most a year long."
+	}
+
+	events, err := service.GetEvents(start, end)
+	if err != nil {
+		return "Analysis: reading the calendar failed: " + err.Error()
+	}
+	analytics := analyzeUser(user, filterAIContext(events, settings), start, end)
+	return "Analysis of " + analytics.Start.Format(time.RFC3339) + " - " + analytics.End.Format(time.RFC3339) + ":\n" + analytics.Describe()
+}
+
+// Describe summarizes the analytics for the assistant
+func (a *Analytics) Describe() string {
+	lines := []string{
+		fmt.Sprintf("Meetings: %d, %.2f hours", a.Meetings, a.MeetingHours),
+		fmt.Sprintf("Focus time: %.2f hours", a.FocusHours),
+		fmt.Sprintf("All-day events: %d", a.AllDayEvents),
+	}
+	var categories []string
+	for _, category := range []string{CategoryOneOnOne, CategoryMeeting, CategoryFocus, CategoryBuffer, CategoryOther} {
+		categories = append(categories, fmt.Sprintf("%s %.2f", category, a.Categories[category]))
+	}
+	lines = append(lines, "Hours per category: "+strings.Join(categories, ", "))
+	for _, list := range []struct {
+		name   string
+		values []NamedHours
+	}{{"attendee", a.Attendees}, {"domain", a.Domains}} {
+		var arr []string
+		for _, value := range list.values {
+			arr = append(arr, fmt.Sprintf("%s %.2f hours in %d meetings", value.Name, value.Hours, value.Meetings))
+		}
+		if len(arr) > 0 {
+			lines = append(lines, "Meeting time per "+list.name+": "+strings.Join(arr, ", "))
+		}
+	}
+	var weeks []string
+	for _, week := range a.Weeks {
+		weeks = append(weeks, fmt.Sprintf("week of %s %.2f hours in %d meetings (%+.2f)", week.Start, week.MeetingHours, week.Meetings, week.Change))
+	}
+	lines = append(lines, "Meeting load per week: "+strings.Join(weeks, ", "))
+	lines = append(lines, fmt.Sprintf("Back-to-back runs of meetings: %d", len(a.BackToBack)))
+	if len(a.BackToBack) > 0 {
+		longest := a.BackToBack[0]
+		lines = append(lines, fmt.Sprintf("Longest run: %d meetings from %s to %s", longest.Meetings, longest.Start.Format(time.RFC3339), longest.End.Format(time.RFC3339)))
+	}
+	return strings.Join(lines, "\n")
+}
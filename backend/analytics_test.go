@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventCategory(t *testing.T) {
+	own := map[string]bool{"me@example.com": true}
+	blocks := map[string]string{"focus": PolicyFocus, "buffer": PolicyBuffer}
+	me := Attendee{Email: "Me@Example.com"}
+	ada := Attendee{Email: "ada@acme.com"}
+	bob := Attendee{Email: "bob@acme.com"}
+
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{name: "alone", event: Event{ID: "a"}, want: CategoryOther},
+		{name: "only own addresses", event: Event{ID: "a", Attendees: []Attendee{me}}, want: CategoryOther},
+		{name: "one other", event: Event{ID: "a", Attendees: []Attendee{me, ada}}, want: CategoryOneOnOne},
+		{name: "several others", event: Event{ID: "a", Attendees: []Attendee{me, ada, bob}}, want: CategoryMeeting},
+		{name: "focus block", event: Event{ID: "focus", Attendees: []Attendee{ada}}, want: CategoryFocus},
+		{name: "buffer block", event: Event{ID: "buffer"}, want: CategoryBuffer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventCategory(&tt.event, own, blocks); got != tt.want {
+				t.Errorf("eventCategory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeEvents(t *testing.T) {
+	own := map[string]bool{"me@example.com": true}
+	blocks := map[string]string{"focus": PolicyFocus, "buffer": PolicyBuffer}
+	me := Attendee{Email: "Me@Example.com"}
+	ada := Attendee{Email: "ada@acme.com"}
+	bob := Attendee{Email: "Bob@acme.com"}
+	eve := Attendee{Email: "eve@other.org"}
+	event := func(id string, start, end time.Time, attendees ...Attendee) *Event {
+		return &Event{ID: id, StartTime: start.Format(time.RFC3339), EndTime: end.Format(time.RFC3339), Attendees: attendees}
+	}
+
+	events := []*Event{
+		event("one-on-one", day(8, 9, 0), day(8, 10, 0), me, ada),
+		event("sync", day(8, 10, 0), day(8, 11, 0), me, ada, bob, eve),
+		event("overlap", day(8, 10, 30), day(8, 11, 0), eve),
+		event("review", day(8, 11, 3), day(8, 11, 30), ada, bob),
+		event("lunch", day(8, 12, 0), day(8, 13, 0), me),
+		event("focus", day(8, 13, 0), day(8, 15, 0)),
+		event("buffer", day(8, 15, 0), day(8, 15, 15)),
+		{ID: "holiday", StartTime: "2024-01-09", EndTime: "2024-01-10", AllDay: true},
+		event("call", day(15, 9, 0), day(15, 10, 0), ada),
+		// Only the hour before the end of the range counts
+		event("late", day(21, 23, 0), day(22, 1, 0), bob),
+		event("before", day(7, 10, 0), day(7, 11, 0), ada),
+		{ID: "broken", StartTime: "soon", EndTime: "later", Attendees: []Attendee{ada}},
+	}
+
+	got := AnalyzeEvents(events, day(8, 0, 0), day(22, 0, 0), own, blocks, time.UTC)
+
+	if got.Meetings != 6 {
+		t.Errorf("Meetings = %d, want 6", got.Meetings)
+	}
+	// Overlapping meetings count once: 9:00 to 11:00, 11:03 to 11:30, the call and the late meeting
+	if got.MeetingHours != 4.45 {
+		t.Errorf("MeetingHours = %v, want 4.45", got.MeetingHours)
+	}
+	if got.FocusHours != 2 {
+		t.Errorf("FocusHours = %v, want 2", got.FocusHours)
+	}
+	if got.AllDayEvents != 1 {
+		t.Errorf("AllDayEvents = %d, want 1", got.AllDayEvents)
+	}
+	wantCategories := map[string]float64{
+		CategoryOneOnOne: 3.5,
+		CategoryMeeting:  1.45,
+		CategoryFocus:    2,
+		CategoryBuffer:   0.25,
+		CategoryOther:    1,
+	}
+	if !reflect.DeepEqual(got.Categories, wantCategories) {
+		t.Errorf("Categories = %v, want %v", got.Categories, wantCategories)
+	}
+	wantAttendees := []NamedHours{
+		{Name: "ada@acme.com", Hours: 3.45, Meetings: 4},
+		{Name: "bob@acme.com", Hours: 2.45, Meetings: 3},
+		{Name: "eve@other.org", Hours: 1.5, Meetings: 2},
+	}
+	if !reflect.DeepEqual(got.Attendees, wantAttendees) {
+		t.Errorf("Attendees = %v, want %v", got.Attendees, wantAttendees)
+	}
+	// A domain counts once per meeting
+	wantDomains := []NamedHours{
+		{Name: "acme.com", Hours: 4.45, Meetings: 5},
+		{Name: "other.org", Hours: 1.5, Meetings: 2},
+	}
+	if !reflect.DeepEqual(got.Domains, wantDomains) {
+		t.Errorf("Domains = %v, want %v", got.Domains, wantDomains)
+	}
+	wantWeeks := []WeekLoad{
+		{Start: "2024-01-08", MeetingHours: 2.95, Meetings: 4},
+		{Start: "2024-01-15", MeetingHours: 2, Meetings: 2, Change: -0.95},
+	}
+	if !reflect.DeepEqual(got.Weeks, wantWeeks) {
+		t.Errorf("Weeks = %v, want %v", got.Weeks, wantWeeks)
+	}
+	wantStreaks := []Streak{{Start: day(8, 9, 0), End: day(8, 11, 30), Meetings: 4}}
+	if !reflect.DeepEqual(got.BackToBack, wantStreaks) {
+		t.Errorf("BackToBack = %v, want %v", got.BackToBack, wantStreaks)
+	}
+}
+
+func TestAnalyzeEventsWithoutMeetings(t *testing.T) {
+	got := AnalyzeEvents(nil, day(8, 0, 0), day(22, 0, 0), map[string]bool{}, map[string]string{}, time.UTC)
+	if got.Meetings != 0 || got.MeetingHours != 0 || len(got.Attendees) != 0 || len(got.BackToBack) != 0 {
+		t.Errorf("AnalyzeEvents() = %+v, want no meetings", got)
+	}
+	// Weeks without meetings are still listed
+	if len(got.Weeks) != 2 {
+		t.Errorf("Weeks = %v, want 2 weeks", got.Weeks)
+	}
+}
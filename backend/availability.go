@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// WorkingHours are the times of day, in minutes after midnight, during which
+// meetings can be scheduled
+type WorkingHours struct {
+	Start int            `json:"start"`
+	End   int            `json:"end"`
+	Days  []time.Weekday `json:"days"`
+}
+
+var defaultWorkingHours = WorkingHours{
+	Start: 9 * 60,
+	End:   17 * 60,
+	Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+}
+
+type SlotOptions struct {
+	Duration     time.Duration
+	WindowStart  time.Time
+	WindowEnd    time.Time
+	WorkingHours WorkingHours
+	// Kept free before and after every busy interval
+	Buffer time.Duration
+	// Slots start at multiples of Step after midnight
+	Step     time.Duration
+	Location *time.Location
+	Limit    int
+}
+
+// parseClock reads a time of day like "09:30" as minutes after midnight
+func parseClock(value string) (int, error) {
+	h, m, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	hours, err := strconv.Atoi(h)
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// BusyIntervals merges the times of events into non-overlapping intervals.
+// All-day events block their whole days in loc.
+func BusyIntervals(events []*Event, loc *time.Location) []Interval {
+	var arr []Interval
+	for _, event := range events {
+		start, err := parseEventTime(event.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := parseEventTime(event.EndTime)
+		if err != nil {
+			continue
+		}
+		if event.AllDay {
+			start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+			end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, loc)
+		}
+		if !end.After(start) {
+			continue
+		}
+		arr = append(arr, Interval{Start: start.In(loc), End: end.In(loc)})
+	}
+	return mergeIntervals(arr)
+}
+
+func mergeIntervals(intervals []Interval) []Interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+	var merged []Interval
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && !interval.Start.After(merged[n-1].End) {
+			if interval.End.After(merged[n-1].End) {
+				merged[n-1].End = interval.End
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// FreeIntervals returns the parts of the working hours within the window
+// that don't overlap busy, or the buffer around it
+func FreeIntervals(busy []Interval, opts SlotOptions) []Interval {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var blocked []Interval
+	for _, interval := range busy {
+		blocked = append(blocked, Interval{Start: interval.Start.Add(-opts.Buffer), End: interval.End.Add(opts.Buffer)})
+	}
+	blocked = mergeIntervals(blocked)
+
+	var free []Interval
+	windowStart := opts.WindowStart.In(loc)
+	for day := time.Date(windowStart.Year(), windowStart.Month(), windowStart.Day(), 0, 0, 0, 0, loc); day.Before(opts.WindowEnd); day = day.AddDate(0, 0, 1) {
+		if !containsWeekday(opts.WorkingHours.Days, day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, opts.WorkingHours.Start, 0, 0, loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, opts.WorkingHours.End, 0, 0, loc)
+		if start.Before(opts.WindowStart) {
+			start = opts.WindowStart.In(loc)
+		}
+		if end.After(opts.WindowEnd) {
+			end = opts.WindowEnd.In(loc)
+		}
+
+		for _, b := range blocked {
+			if !start.Before(end) {
+				break
+			}
+			if !b.End.After(start) || !b.Start.Before(end) {
+				continue
+			}
+			if b.Start.After(start) {
+				free = append(free, Interval{Start: start, End: b.Start})
+			}
+			start = b.End
+		}
+		if start.Before(end) {
+			free = append(free, Interval{Start: start, End: end})
+		}
+	}
+	return free
+}
+
+// FindFreeSlots returns candidate meeting times of the requested duration
+func FindFreeSlots(busy []Interval, opts SlotOptions) []Interval {
+	step := opts.Step
+	if step <= 0 {
+		step = 30 * time.Minute
+	}
+
+	var slots []Interval
+	for _, free := range FreeIntervals(busy, opts) {
+		midnight := time.Date(free.Start.Year(), free.Start.Month(), free.Start.Day(), 0, 0, 0, 0, free.Start.Location())
+		offset := free.Start.Sub(midnight)
+		start := midnight.Add((offset + step - 1) / step * step)
+		for ; !start.Add(opts.Duration).After(free.End); start = start.Add(step) {
+			slots = append(slots, Interval{Start: start, End: start.Add(opts.Duration)})
+			if opts.Limit > 0 && len(slots) >= opts.Limit {
+				return slots
+			}
+		}
+	}
+	return slots
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// day is a time in January 2024 in UTC, whose 8th is a Monday
+func day(d, hour, minute int) time.Time {
+	return time.Date(2024, 1, d, hour, minute, 0, 0, time.UTC)
+}
+
+func equalIntervals(a, b []Interval) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Start.Equal(b[i].Start) || !a[i].End.Equal(b[i].End) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFreeIntervals(t *testing.T) {
+	opts := SlotOptions{
+		WindowStart:  day(8, 0, 0),
+		WindowEnd:    day(9, 0, 0),
+		WorkingHours: defaultWorkingHours,
+		Location:     time.UTC,
+	}
+
+	tests := []struct {
+		name   string
+		busy   []Interval
+		modify func(*SlotOptions)
+		want   []Interval
+	}{
+		{
+			name: "free day",
+			want: []Interval{{day(8, 9, 0), day(8, 17, 0)}},
+		},
+		{
+			name: "meeting in the middle",
+			busy: []Interval{{day(8, 11, 0), day(8, 12, 0)}},
+			want: []Interval{{day(8, 9, 0), day(8, 11, 0)}, {day(8, 12, 0), day(8, 17, 0)}},
+		},
+		{
+			name: "overlapping meetings",
+			busy: []Interval{{day(8, 10, 0), day(8, 12, 0)}, {day(8, 11, 0), day(8, 13, 0)}},
+			want: []Interval{{day(8, 9, 0), day(8, 10, 0)}, {day(8, 13, 0), day(8, 17, 0)}},
+		},
+		{
+			name:   "buffer around meetings",
+			busy:   []Interval{{day(8, 11, 0), day(8, 12, 0)}},
+			modify: func(o *SlotOptions) { o.Buffer = 15 * time.Minute },
+			want:   []Interval{{day(8, 9, 0), day(8, 10, 45)}, {day(8, 12, 15), day(8, 17, 0)}},
+		},
+		{
+			name: "meetings outside working hours",
+			busy: []Interval{{day(8, 7, 0), day(8, 9, 30)}, {day(8, 16, 30), day(8, 19, 0)}},
+			want: []Interval{{day(8, 9, 30), day(8, 16, 30)}},
+		},
+		{
+			name: "busy all day",
+			busy: []Interval{{day(8, 0, 0), day(9, 0, 0)}},
+			want: nil,
+		},
+		{
+			name:   "window starts during the day",
+			modify: func(o *SlotOptions) { o.WindowStart = day(8, 14, 20) },
+			want:   []Interval{{day(8, 14, 20), day(8, 17, 0)}},
+		},
+		{
+			name:   "weekend is skipped",
+			modify: func(o *SlotOptions) { o.WindowStart, o.WindowEnd = day(6, 0, 0), day(9, 0, 0) },
+			want:   []Interval{{day(8, 9, 0), day(8, 17, 0)}},
+		},
+		{
+			name: "working hours in the zone of the user",
+			modify: func(o *SlotOptions) {
+				o.Location = time.FixedZone("UTC+2", 2*60*60)
+			},
+			// 9 to 17 at UTC+2 is 7 to 15 UTC, cut by the window on the next day
+			want: []Interval{{day(8, 7, 0), day(8, 15, 0)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts
+			if tt.modify != nil {
+				tt.modify(&o)
+			}
+			got := FreeIntervals(tt.busy, o)
+			if !equalIntervals(got, tt.want) {
+				t.Errorf("FreeIntervals() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindFreeSlots(t *testing.T) {
+	opts := SlotOptions{
+		Duration:     30 * time.Minute,
+		WindowStart:  day(8, 0, 0),
+		WindowEnd:    day(9, 0, 0),
+		WorkingHours: WorkingHours{Start: 9 * 60, End: 11 * 60, Days: defaultWorkingHours.Days},
+		Step:         30 * time.Minute,
+		Location:     time.UTC,
+	}
+
+	tests := []struct {
+		name   string
+		busy   []Interval
+		modify func(*SlotOptions)
+		want   []Interval
+	}{
+		{
+			name: "every step",
+			want: []Interval{
+				{day(8, 9, 0), day(8, 9, 30)},
+				{day(8, 9, 30), day(8, 10, 0)},
+				{day(8, 10, 0), day(8, 10, 30)},
+				{day(8, 10, 30), day(8, 11, 0)},
+			},
+		},
+		{
+			name: "slots start on the step after a meeting",
+			busy: []Interval{{day(8, 9, 0), day(8, 9, 40)}},
+			want: []Interval{{day(8, 10, 0), day(8, 10, 30)}, {day(8, 10, 30), day(8, 11, 0)}},
+		},
+		{
+			name:   "longer than the free time",
+			busy:   []Interval{{day(8, 10, 0), day(8, 10, 30)}},
+			modify: func(o *SlotOptions) { o.Duration = time.Hour },
+			want:   []Interval{{day(8, 9, 0), day(8, 10, 0)}},
+		},
+		{
+			name:   "limit",
+			modify: func(o *SlotOptions) { o.Limit = 2 },
+			want:   []Interval{{day(8, 9, 0), day(8, 9, 30)}, {day(8, 9, 30), day(8, 10, 0)}},
+		},
+		{
+			name:   "shorter step",
+			busy:   []Interval{{day(8, 9, 0), day(8, 10, 15)}},
+			modify: func(o *SlotOptions) { o.Step = 15 * time.Minute; o.Duration = 45 * time.Minute },
+			want:   []Interval{{day(8, 10, 15), day(8, 11, 0)}},
+		},
+		{
+			name: "no room",
+			busy: []Interval{{day(8, 9, 15), day(8, 10, 45)}},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts
+			if tt.modify != nil {
+				tt.modify(&o)
+			}
+			got := FindFreeSlots(tt.busy, o)
+			if !equalIntervals(got, tt.want) {
+				t.Errorf("FindFreeSlots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// Slots of booking pages start at multiples of this after midnight
+	bookingStep = 15 * time.Minute
+	// The most of the calendar shown at once
+	maxBookingRange = 31 * 24 * time.Hour
+	// How long the calendar of a user is kept for their booking pages
+	bookingServiceTTL = 10 * time.Minute
+)
+
+var (
+	bookingSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,63}$`)
+	errSlotTaken       = errors.New("the time is no longer available")
+
+	// Calendars of the users whose booking pages were visited, so that
+	// visitors don't make us sync with the provider on every request
+	bookingServices     = map[uint]bookingService{}
+	bookingServicesLock sync.Mutex
+)
+
+type bookingService struct {
+	service Calendar
+	expires time.Time
+}
+
+// BookingPage lets anyone with the link book a meeting in the free time of
+// the user, like a "30 minute intro call"
+type BookingPage struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	// The page is at /book/<Slug>
+	Slug        string `gorm:"unique_index;not null"`
+	Title       string
+	Description string
+	Location    string
+	Minutes     int
+	// Kept free before and after every event
+	BufferBefore int
+	BufferAfter  int
+	// Bookings of the page a day at most, 0 for no limit
+	DailyLimit int
+	// How long ahead of time meetings have to be booked, and how far ahead
+	// they can be
+	NoticeMinutes int
+	HorizonDays   int
+	OnlineMeeting bool
+	Active        bool
+}
+
+// Booking is a meeting booked through a page
+type Booking struct {
+	gorm.Model
+	// A slot of a page is booked once
+	PageID uint `gorm:"unique_index:idx_booking_page_start;not null"`
+	Name   string
+	Email  string
+	Notes  string
+	Start  time.Time `gorm:"unique_index:idx_booking_page_start"`
+	End    time.Time
+	// UID of the event in the calendar of the user
+	EventID string
+}
+
+func (p *BookingPage) duration() time.Duration {
+	return time.Duration(p.Minutes) * time.Minute
+}
+
+// bookingSlots are the times the page can be booked at between start and
+// end. Events are kept clear of by the buffers, and days with the most
+// bookings of the page are left out.
+func bookingSlots(page *BookingPage, user *User, service Calendar, start, end time.Time) ([]Interval, error) {
+	now := time.Now()
+	start = maxTime(start, now.Add(time.Duration(page.NoticeMinutes)*time.Minute))
+	end = minTime(end, now.AddDate(0, 0, page.HorizonDays))
+	if !end.After(start) {
+		return []Interval{}, nil
+	}
+
+	loc := userLocation(user)
+	preference := getSchedulingPreference(user.ID)
+	before := time.Duration(page.BufferBefore) * time.Minute
+	after := time.Duration(page.BufferAfter) * time.Minute
+	events, err := service.GetEvents(start.Add(-after), end.Add(before))
+	if err != nil {
+		return nil, err
+	}
+	// Bookings whose events aren't in the cache yet are busy too
+	var booked []Booking
+	db.Where("page_id IN (SELECT id FROM booking_pages WHERE user_id = ?) AND start < ? AND \"end\" > ?", user.ID, end.Add(before), start.Add(-after)).Find(&booked)
+	var busy []Interval
+	for _, booking := range booked {
+		busy = append(busy, Interval{Start: booking.Start.Add(-after), End: booking.End.Add(before)})
+	}
+	for _, interval := range BusyIntervals(events, loc) {
+		// A slot needs its buffer before it free of the events ending
+		// before it, and its buffer after it free of the ones after it
+		busy = append(busy, Interval{Start: interval.Start.Add(-after), End: interval.End.Add(before)})
+	}
+	busy = mergeIntervals(append(busy, preference.LunchIntervals(start, end, loc)...))
+
+	full := map[string]bool{}
+	if page.DailyLimit > 0 {
+		var bookings []Booking
+		db.Where("page_id = ? AND start >= ? AND start < ?", page.ID, start.Add(-24*time.Hour), end.Add(24*time.Hour)).Find(&bookings)
+		counts := map[string]int{}
+		for _, booking := range bookings {
+			day := booking.Start.In(loc).Format(dateLayout)
+			counts[day]++
+			if counts[day] >= page.DailyLimit {
+				full[day] = true
+			}
+		}
+	}
+
+	arr := []Interval{}
+	for _, slot := range FindFreeSlots(busy, SlotOptions{
+		Duration:     page.duration(),
+		WindowStart:  start,
+		WindowEnd:    end,
+		WorkingHours: preference.WorkingHours(),
+		Step:         bookingStep,
+		Location:     loc,
+	}) {
+		if !full[slot.Start.Format(dateLayout)] {
+			arr = append(arr, slot)
+		}
+	}
+	return arr, nil
+}
+
+type bookingPageJSON struct {
+	ID            uint   `json:"id"`
+	Slug          string `json:"slug"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	Location      string `json:"location"`
+	Minutes       int    `json:"minutes"`
+	BufferBefore  int    `json:"bufferBefore"`
+	BufferAfter   int    `json:"bufferAfter"`
+	DailyLimit    int    `json:"dailyLimit"`
+	NoticeMinutes int    `json:"noticeMinutes"`
+	HorizonDays   int    `json:"horizonDays"`
+	OnlineMeeting bool   `json:"onlineMeeting"`
+	Active        bool   `json:"active"`
+	Link          string `json:"link"`
+}
+
+func (p *BookingPage) toJSON() bookingPageJSON {
+	return bookingPageJSON{
+		ID:            p.ID,
+		Slug:          p.Slug,
+		Title:         p.Title,
+		Description:   p.Description,
+		Location:      p.Location,
+		Minutes:       p.Minutes,
+		BufferBefore:  p.BufferBefore,
+		BufferAfter:   p.BufferAfter,
+		DailyLimit:    p.DailyLimit,
+		NoticeMinutes: p.NoticeMinutes,
+		HorizonDays:   p.HorizonDays,
+		OnlineMeeting: p.OnlineMeeting,
+		Active:        p.Active,
+		Link:          "/book/" + p.Slug,
+	}
+}
+
+func GetBookingPages(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var pages []BookingPage
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&pages).Error; err != nil {
+		return err
+	}
+	arr := []gin.H{}
+	for i := range pages {
+		var bookings []Booking
+		db.Where("page_id = ? AND start > ?", pages[i].ID, time.Now()).Order("start").Find(&bookings)
+		upcoming := []gin.H{}
+		for _, booking := range bookings {
+			upcoming = append(upcoming, gin.H{
+				"name":      booking.Name,
+				"email":     booking.Email,
+				"startTime": booking.Start.UTC().Format(time.RFC3339),
+				"endTime":   booking.End.UTC().Format(time.RFC3339),
+			})
+		}
+		arr = append(arr, gin.H{"page": pages[i].toJSON(), "bookings": upcoming})
+	}
+	c.JSON(http.StatusOK, gin.H{"pages": arr})
+	return nil
+}
+
+// SaveBookingPage creates a page, or changes the page with the given id
+func SaveBookingPage(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json bookingPageJSON
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	page := &BookingPage{UserID: user.ID}
+	if json.ID != 0 {
+		if err := db.Where("id = ? AND user_id = ?", json.ID, user.ID).First(page).Error; err != nil {
+			return fmt.Errorf("booking page not found")
+		}
+	}
+
+	v := &ValidationError{}
+	slug := strings.ToLower(strings.TrimSpace(json.Slug))
+	if !bookingSlugPattern.MatchString(slug) {
+		v.add("slug", "must be 3 to 64 lowercase letters, digits or hyphens")
+	} else {
+		other := &BookingPage{}
+		if db.Where("slug = ? AND id <> ?", slug, page.ID).First(other).Error == nil {
+			v.add("slug", "is taken")
+		}
+	}
+	title := strings.TrimSpace(json.Title)
+	if title == "" {
+		v.add("title", "is required")
+	}
+	if len(title) > maxTitleLength {
+		v.add("title", "can be at most %d characters", maxTitleLength)
+	}
+	if json.Minutes < 5 || json.Minutes > 8*60 {
+		v.add("minutes", "must be between 5 and 480")
+	}
+	for field, minutes := range map[string]int{"bufferBefore": json.BufferBefore, "bufferAfter": json.BufferAfter} {
+		if minutes < 0 || minutes > 4*60 {
+			v.add(field, "must be between 0 and 240")
+		}
+	}
+	if json.DailyLimit < 0 {
+		v.add("dailyLimit", "can't be negative")
+	}
+	if json.NoticeMinutes < 0 || json.NoticeMinutes > 30*24*60 {
+		v.add("noticeMinutes", "must be between 0 and 30 days")
+	}
+	if json.HorizonDays < 1 || json.HorizonDays > 365 {
+		v.add("horizonDays", "must be between 1 and 365")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	page.Slug = slug
+	page.Title = title
+	page.Description = json.Description
+	page.Location = json.Location
+	page.Minutes = json.Minutes
+	page.BufferBefore = json.BufferBefore
+	page.BufferAfter = json.BufferAfter
+	page.DailyLimit = json.DailyLimit
+	page.NoticeMinutes = json.NoticeMinutes
+	page.HorizonDays = json.HorizonDays
+	page.OnlineMeeting = json.OnlineMeeting
+	page.Active = json.Active
+	if err := db.Save(page).Error; err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "saved", "page": page.toJSON()})
+	return nil
+}
+
+func RemoveBookingPage(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	var json struct {
+		ID uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	// Bookings stay, their events are in the calendar
+	result := db.Where("id = ? AND user_id = ?", json.ID, user.ID).Delete(&BookingPage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("booking page not found")
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	return nil
+}
+
+// loadBookingPage finds an active page with its owner and their calendar
+func loadBookingPage(slug string) (*BookingPage, *User, Calendar, error) {
+	page := &BookingPage{}
+	if err := db.Where("slug = ? AND active = ?", slug, true).First(page).Error; err != nil {
+		return nil, nil, nil, fmt.Errorf("booking page not found")
+	}
+	user := &User{}
+	if err := db.First(user, page.UserID).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	service := bookingCalendar(user)
+	if service == nil {
+		return nil, nil, nil, errNoCalendar
+	}
+	return page, user, service, nil
+}
+
+// bookingCalendar is the calendar of the user for their booking pages,
+// built again after a while to see changes of their settings
+func bookingCalendar(user *User) Calendar {
+	bookingServicesLock.Lock()
+	defer bookingServicesLock.Unlock()
+	if cached, ok := bookingServices[user.ID]; ok && time.Now().Before(cached.expires) {
+		return cached.service
+	}
+	service := newUserService(user)
+	if service != nil {
+		bookingServices[user.ID] = bookingService{service: service, expires: time.Now().Add(bookingServiceTTL)}
+	}
+	return service
+}
+
+// GetPublicBookingPage shows the page and its free slots between start and
+// end, by default the next week
+func GetPublicBookingPage(c *gin.Context) error {
+	page, user, service, err := loadBookingPage(c.Param("slug"))
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	end := start.AddDate(0, 0, 7)
+	v := &ValidationError{}
+	if value := c.Query("start"); value != "" {
+		if start, err = parseEventTime(value); err != nil {
+			v.add("start", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if value := c.Query("end"); value != "" {
+		if end, err = parseEventTime(value); err != nil {
+			v.add("end", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if !end.After(start) || end.Sub(start) > maxBookingRange {
+		v.add("end", "must be after start, at most 31 days later")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	slots, err := bookingSlots(page, user, service, start, end)
+	if err != nil {
+		return err
+	}
+	arr := []gin.H{}
+	for _, slot := range slots {
+		arr = append(arr, gin.H{
+			"startTime": slot.Start.UTC().Format(time.RFC3339),
+			"endTime":   slot.End.UTC().Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"title":       page.Title,
+		"description": page.Description,
+		"location":    page.Location,
+		"minutes":     page.Minutes,
+		"organizer":   user.Email,
+		"slots":       arr,
+	})
+	return nil
+}
+
+// BookSlot books a free slot of the page. The event is created in the
+// calendar of the user with the guest invited, and the guest gets a
+// confirmation with the event attached.
+func BookSlot(c *gin.Context) error {
+	page, user, service, err := loadBookingPage(c.Param("slug"))
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		Notes     string `json:"notes"`
+		StartTime string `json:"startTime"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	v := &ValidationError{}
+	name := strings.TrimSpace(json.Name)
+	if name == "" || len(name) > 200 {
+		v.add("name", "is required")
+	}
+	if hasControlChars(name) {
+		v.add("name", "can't contain line breaks or control characters")
+	}
+	address, err := mail.ParseAddress(json.Email)
+	if err != nil {
+		v.add("email", "is not an email address")
+	}
+	if len(json.Notes) > 2000 {
+		v.add("notes", "can be at most 2000 characters")
+	}
+	start, startOK := validateEventTime(v, "startTime", json.StartTime, true)
+	if err := v.err(); err != nil {
+		return err
+	}
+	if !startOK {
+		return errSlotTaken
+	}
+
+	// Bookings of the user are made one at a time, holding a lock on their
+	// row, so that the slot is still free when the event is created
+	tx := db.Begin()
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&User{}, user.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	end := start.Add(page.duration())
+	slots, err := bookingSlots(page, user, service, start, end)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(slots) == 0 || !slots[0].Start.Equal(start) {
+		tx.Rollback()
+		return errSlotTaken
+	}
+
+	uid, err := newEventUID()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	loc := userLocation(user)
+	description := page.Description
+	if json.Notes != "" {
+		description = strings.TrimSpace(description + "\n\nNotes from " + name + ":\n" + json.Notes)
+	}
+	event := Event{
+		ID:            uid,
+		Title:         page.Title + " with " + name,
+		StartTime:     start.UTC().Format(time.RFC3339),
+		EndTime:       end.UTC().Format(time.RFC3339),
+		TimeZone:      loc.String(),
+		Location:      page.Location,
+		Description:   description,
+		OnlineMeeting: page.OnlineMeeting,
+		Attendees:     []Attendee{{Email: address.Address, Name: name, Status: StatusNeedsAction}},
+	}
+	booking := &Booking{
+		PageID:  page.ID,
+		Name:    name,
+		Email:   address.Address,
+		Notes:   json.Notes,
+		Start:   start,
+		End:     end,
+		EventID: uid,
+	}
+	if err := tx.Create(booking).Error; err != nil {
+		tx.Rollback()
+		return errSlotTaken
+	}
+	if err := service.CreateEvent(event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		if err := service.RemoveEvent(event); err != nil {
+			log.Println(err.Error())
+		}
+		return err
+	}
+	sendBookingEmails(page, user, booking, event)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "booked",
+		"startTime": event.StartTime,
+		"endTime":   event.EndTime,
+	})
+	return nil
+}
+
+// sendBookingEmails confirms the booking to the guest, with an .ics file
+// for their calendar, and tells the user about it
+func sendBookingEmails(page *BookingPage, user *User, booking *Booking, event Event) {
+	notifier := emailNotifier()
+	if notifier == nil {
+		return
+	}
+	ics, err := EventsToICS([]*Event{&event})
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	loc := userLocation(user)
+	when := booking.Start.In(loc).Format("Monday, January 2, 2006 15:04") + " (" + loc.String() + ")"
+	body := fmt.Sprintf("Hi %s,\n\nyour %s with %s is booked for %s.\n", booking.Name, page.Title, user.Email, when)
+	if page.Location != "" {
+		body += "\nLocation: " + page.Location + "\n"
+	}
+	body += "\nThe attached file adds the meeting to your calendar.\n"
+	err = notifier.Send(booking.Email, "Booked: "+page.Title, body, EmailAttachment{
+		Name:        "invite.ics",
+		ContentType: "text/calendar; charset=utf-8",
+		Data:        []byte(ics),
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	body = fmt.Sprintf("%s <%s> booked %s for %s.\n", booking.Name, booking.Email, page.Title, when)
+	if booking.Notes != "" {
+		body += "\nNotes:\n" + booking.Notes + "\n"
+	}
+	if err := notifier.Send(user.Email, "New booking: "+page.Title, body); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func BookingPagePage(c *gin.Context) {
+	c.HTML(http.StatusOK, "booking.html", gin.H{"slug": c.Param("slug")})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type CalDAVCalendar struct {
+	client      *http.Client
+	calendarURL string
+	username    string
+	password    string
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ETag         string `xml:"DAV: getetag"`
+		CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	} `xml:"DAV: prop"`
+}
+
+// CalDAVCredentials are what a CalDAVCalendar signs in with
+type CalDAVCredentials struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// credentialsKey is the AES-256 key passwords are encrypted with, nil when
+// CREDENTIALS_KEY isn't set
+var credentialsKey []byte
+
+var (
+	errNoCredentialsKey = errors.New("connecting CalDAV calendars needs CREDENTIALS_KEY to be set")
+	errOtherProvider    = errors.New("the calendar of the account is already provided by another service")
+)
+
+func credentialsCipher() (cipher.AEAD, error) {
+	if credentialsKey == nil {
+		return nil, errNoCredentialsKey
+	}
+	block, err := aes.NewCipher(credentialsKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret seals the secret with AES-GCM, the nonce going first
+func encryptSecret(secret string) (string, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	gcm, err := credentialsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: CalDAV,
+		NewCalendar: func(user User, token *oauth2.Token) (Calendar, error) {
+			password, err := decryptSecret(user.CalDAVPassword)
+			if err != nil {
+				return nil, err
+			}
+			return NewCalDAVCalendar(CalDAVCredentials{
+				URL:      user.CalDAVURL,
+				Username: user.CalDAVUsername,
+				Password: password,
+			}), nil
+		},
+	})
+}
+
+func NewCalDAVCalendar(credentials CalDAVCredentials) *CalDAVCalendar {
+	calendarURL := credentials.URL
+	if !strings.HasSuffix(calendarURL, "/") {
+		calendarURL += "/"
+	}
+
+	return &CalDAVCalendar{
+		client:      newPublicClient(30 * time.Second),
+		calendarURL: calendarURL,
+		username:    credentials.Username,
+		password:    credentials.Password,
+	}
+}
+
+// saveCalDAVCredentials makes the CalDAV calendar the calendar of the user
+func saveCalDAVCredentials(user *User, credentials CalDAVCredentials) error {
+	password, err := encryptSecret(credentials.Password)
+	if err != nil {
+		return err
+	}
+	user.CalDAVURL = credentials.URL
+	user.CalDAVUsername = credentials.Username
+	user.CalDAVPassword = password
+	user.Provider = CalDAV
+	return db.Save(user).Error
+}
+
+func (c *CalDAVCalendar) do(method, target string, body []byte, headers map[string]string) (*http.Response, error) {
+	// The address comes from the user, and hrefs from their server
+	if err := validatePublicURL(target); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return c.client.Do(req)
+}
+
+func (c *CalDAVCalendar) report(query string) (*davMultistatus, error) {
+	resp, err := c.do("REPORT", c.calendarURL, []byte(query), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("caldav report failed: %s", resp.Status)
+	}
+
+	ms := &davMultistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// resolveHref turns an href from a multistatus response into an absolute URL
+func (c *CalDAVCalendar) resolveHref(href string) (string, error) {
+	base, err := url.Parse(c.calendarURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// findEventHref looks up the resource holding the event with the given UID,
+// since resources created by other clients are not necessarily named <uid>.ics
+func (c *CalDAVCalendar) findEventHref(uid string) (string, error) {
+	var uidBuf bytes.Buffer
+	xml.EscapeText(&uidBuf, []byte(uid))
+
+	query := `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:prop-filter name="UID">
+          <C:text-match collation="i;octet">` + uidBuf.String() + `</C:text-match>
+        </C:prop-filter>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+	ms, err := c.report(query)
+	if err != nil {
+		return "", err
+	}
+	if len(ms.Responses) == 0 {
+		return "", fmt.Errorf("event %s not found", uid)
+	}
+	return c.resolveHref(ms.Responses[0].Href)
+}
+
+func newEventUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *CalDAVCalendar) CreateEvent(event Event) error {
+	if event.ID == "" {
+		uid, err := newEventUID()
+		if err != nil {
+			return err
+		}
+		event.ID = uid
+	}
+
+	data, err := EventsToICS([]*Event{&event})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(http.MethodPut, c.calendarURL+url.PathEscape(event.ID)+".ics", []byte(data), map[string]string{
+		"Content-Type":  "text/calendar; charset=utf-8",
+		"If-None-Match": "*",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("caldav create failed: %s %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (c *CalDAVCalendar) get(href string) (string, string, error) {
+	resp, err := c.do(http.MethodGet, href, nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("caldav get failed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return string(data), resp.Header.Get("ETag"), nil
+}
+
+func (c *CalDAVCalendar) GetSeries(id string) (*Event, error) {
+	href, err := c.findEventHref(id)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := c.get(href)
+	if err != nil {
+		return nil, err
+	}
+	events, err := ParseICS(data, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.RecurringEventID == "" {
+			return event, nil
+		}
+	}
+	return nil, fmt.Errorf("event %s not found", id)
+}
+
+// put replaces the resource at href, failing if it changed since it was read
+func (c *CalDAVCalendar) put(href, data, etag string) error {
+	headers := map[string]string{"Content-Type": "text/calendar; charset=utf-8"}
+	if etag != "" {
+		headers["If-Match"] = etag
+	}
+	resp, err := c.do(http.MethodPut, href, []byte(data), headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("caldav update failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *CalDAVCalendar) removeOccurrence(href string, originalStart string) error {
+	data, etag, err := c.get(href)
+	if err != nil {
+		return err
+	}
+	updated, err := ExcludeICSOccurrence(data, originalStart)
+	if err != nil {
+		return err
+	}
+	return c.put(href, updated, etag)
+}
+
+func (c *CalDAVCalendar) UpdateEvent(event Event) error {
+	uid := event.ID
+	originalStart := ""
+	if event.RecurringEventID != "" {
+		uid = event.RecurringEventID
+		if event.Scope != ScopeSeries {
+			originalStart = event.OriginalStartTime
+		}
+	}
+
+	href, err := c.findEventHref(uid)
+	if err != nil {
+		return err
+	}
+	data, etag, err := c.get(href)
+	if err != nil {
+		return err
+	}
+
+	events, err := ParseICS(data, time.UTC)
+	if err != nil {
+		return err
+	}
+	for _, master := range events {
+		if master.RecurringEventID != "" {
+			continue
+		}
+		if event.TimeZone == "" {
+			event.TimeZone = master.TimeZone
+		}
+		if event.RecurringEventID != "" && event.Scope == ScopeSeries {
+			if event.StartTime, event.EndTime, err = shiftSeries(master, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	updated, err := UpdateICSEvent(data, event, originalStart)
+	if err != nil {
+		return err
+	}
+	return c.put(href, updated, etag)
+}
+
+func (c *CalDAVCalendar) RemoveEvent(event Event) error {
+	uid := event.ID
+	if event.RecurringEventID != "" {
+		uid = event.RecurringEventID
+	}
+	href, err := c.findEventHref(uid)
+	if err != nil {
+		return err
+	}
+
+	if event.RecurringEventID != "" && event.Scope != ScopeSeries {
+		return c.removeOccurrence(href, event.OriginalStartTime)
+	}
+
+	resp, err := c.do(http.MethodDelete, href, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("caldav delete failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *CalDAVCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	query := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data>
+      <C:expand start="%[1]s" end="%[2]s"/>
+    </C:calendar-data>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%[1]s" end="%[2]s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`,
+		startTime.UTC().Format(icsTimeLayout),
+		endTime.UTC().Format(icsTimeLayout),
+	)
+
+	ms, err := c.report(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var arr []*Event
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.CalendarData == "" {
+				continue
+			}
+			events, err := ParseICS(ps.Prop.CalendarData, time.UTC)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Href, err)
+			}
+			for _, event := range events {
+				if len(event.Recurrence) == 0 {
+					arr = append(arr, event)
+					continue
+				}
+				// The server ignored <expand>, so expand the series ourselves
+				instances, err := ExpandRecurrence(event, startTime, endTime)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, instances...)
+			}
+		}
+	}
+	return arr, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCalDAVServer keeps the resources of one calendar in memory. It ignores
+// time ranges and <expand>, like some servers do.
+type fakeCalDAVServer struct {
+	mu        sync.Mutex
+	resources map[string]string
+	etags     map[string]int
+}
+
+var uidTextMatch = regexp.MustCompile(`<C:text-match[^>]*>([^<]*)</C:text-match>`)
+
+func newFakeCalDAVServer(t *testing.T) (*fakeCalDAVServer, *httptest.Server) {
+	fake := &fakeCalDAVServer{resources: map[string]string{}, etags: map[string]int{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	previous := allowPrivateURLs
+	allowPrivateURLs = true
+	t.Cleanup(func() { allowPrivateURLs = previous })
+	return fake, server
+}
+
+func (f *fakeCalDAVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if username, password, _ := r.BasicAuth(); username != "ada" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, exists := f.resources[r.URL.Path]
+	etag := fmt.Sprintf(`"%d"`, f.etags[r.URL.Path])
+	switch r.Method {
+	case http.MethodPut:
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.resources[r.URL.Path] = string(body)
+		f.etags[r.URL.Path]++
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, data)
+	case http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.resources, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	case "REPORT":
+		body, _ := io.ReadAll(r.Body)
+		uid := ""
+		if match := uidTextMatch.FindSubmatch(body); match != nil {
+			uid = string(match[1])
+		}
+		var hrefs []string
+		for href, data := range f.resources {
+			if uid == "" || strings.Contains(data, "UID:"+uid+"\r\n") {
+				hrefs = append(hrefs, href)
+			}
+		}
+		sort.Strings(hrefs)
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">`)
+		for _, href := range hrefs {
+			io.WriteString(w, "<D:response><D:href>"+href+"</D:href><D:propstat><D:prop><D:getetag>1</D:getetag>")
+			if uid == "" {
+				io.WriteString(w, "<C:calendar-data>")
+				xml.EscapeText(w, []byte(f.resources[href]))
+				io.WriteString(w, "</C:calendar-data>")
+			}
+			io.WriteString(w, "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+		}
+		io.WriteString(w, "</D:multistatus>")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func eventTitles(t *testing.T, calendar Calendar) []string {
+	t.Helper()
+	events, err := calendar.GetEvents(day(1, 0, 0), day(31, 0, 0))
+	if err != nil {
+		t.Fatalf("GetEvents(): %v", err)
+	}
+	var titles []string
+	for _, event := range events {
+		titles = append(titles, event.StartTime+" "+event.Title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+func TestCalDAVCalendar(t *testing.T) {
+	fake, server := newFakeCalDAVServer(t)
+	calendar := NewCalDAVCalendar(CalDAVCredentials{URL: server.URL + "/calendars/ada", Username: "ada", Password: "secret"})
+
+	review := Event{ID: "review", Title: "Review", StartTime: "2024-01-08T10:00:00Z", EndTime: "2024-01-08T11:00:00Z"}
+	if err := calendar.CreateEvent(review); err != nil {
+		t.Fatalf("CreateEvent(): %v", err)
+	}
+	if _, ok := fake.resources["/calendars/ada/review.ics"]; !ok {
+		t.Fatalf("resources = %v, want /calendars/ada/review.ics", fake.resources)
+	}
+	if err := calendar.CreateEvent(review); err == nil {
+		t.Error("creating the event twice succeeded, want an error")
+	}
+
+	standup := Event{
+		ID: "standup", Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+		Recurrence: []string{"RRULE:FREQ=DAILY;COUNT=3"},
+	}
+	if err := calendar.CreateEvent(standup); err != nil {
+		t.Fatalf("CreateEvent(): %v", err)
+	}
+	// Created by another client under a name of its own
+	fake.resources["/calendars/ada/from-phone.ics"] = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\n" +
+		"UID:lunch\r\nSUMMARY:Lunch\r\nDTSTART:20240108T120000Z\r\nDTEND:20240108T130000Z\r\n" +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	want := []string{
+		"2024-01-08T09:00:00Z Standup",
+		"2024-01-08T10:00:00Z Review",
+		"2024-01-08T12:00:00Z Lunch",
+		"2024-01-09T09:00:00Z Standup",
+		"2024-01-10T09:00:00Z Standup",
+	}
+	if got := eventTitles(t, calendar); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+
+	if err := calendar.UpdateEvent(Event{ID: "lunch", Title: "Team lunch"}); err != nil {
+		t.Fatalf("UpdateEvent(): %v", err)
+	}
+	if !strings.Contains(fake.resources["/calendars/ada/from-phone.ics"], "SUMMARY:Team lunch") {
+		t.Errorf("resource of another client wasn't updated: %q", fake.resources["/calendars/ada/from-phone.ics"])
+	}
+
+	occurrence := Event{
+		ID: recurrenceInstanceID("standup", day(9, 9, 0)), RecurringEventID: "standup",
+		OriginalStartTime: "2024-01-09T09:00:00Z", Scope: ScopeThis,
+	}
+	if err := calendar.RemoveEvent(occurrence); err != nil {
+		t.Fatalf("RemoveEvent() of an occurrence: %v", err)
+	}
+	if err := calendar.RemoveEvent(review); err != nil {
+		t.Fatalf("RemoveEvent(): %v", err)
+	}
+
+	want = []string{
+		"2024-01-08T09:00:00Z Standup",
+		"2024-01-08T12:00:00Z Team lunch",
+		"2024-01-10T09:00:00Z Standup",
+	}
+	if got := eventTitles(t, calendar); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	if err := calendar.RemoveEvent(Event{ID: "missing"}); err == nil {
+		t.Error("removing a missing event succeeded, want an error")
+	}
+}
+
+func TestCalDAVCalendarErrors(t *testing.T) {
+	_, server := newFakeCalDAVServer(t)
+	start, end := day(1, 0, 0), day(31, 0, 0)
+
+	wrongPassword := NewCalDAVCalendar(CalDAVCredentials{URL: server.URL, Username: "ada", Password: "guess"})
+	if _, err := wrongPassword.GetEvents(start, end); err == nil {
+		t.Error("GetEvents() with a wrong password succeeded, want an error")
+	}
+
+	allowPrivateURLs = false
+	calendar := NewCalDAVCalendar(CalDAVCredentials{URL: server.URL, Username: "ada", Password: "secret"})
+	if _, err := calendar.GetEvents(start, end); err == nil {
+		t.Errorf("GetEvents() from %s succeeded, want local addresses refused", server.URL)
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	previous := credentialsKey
+	t.Cleanup(func() { credentialsKey = previous })
+
+	credentialsKey = nil
+	if _, err := encryptSecret("secret"); !errors.Is(err, errNoCredentialsKey) {
+		t.Errorf("encryptSecret() without a key = %v, want %v", err, errNoCredentialsKey)
+	}
+
+	credentialsKey = make([]byte, 32)
+	encrypted, err := encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "secret") {
+		t.Errorf("encryptSecret() = %q, contains the secret", encrypted)
+	}
+	if again, _ := encryptSecret("secret"); again == encrypted {
+		t.Error("encrypting twice gave the same result")
+	}
+	if got, err := decryptSecret(encrypted); err != nil || got != "secret" {
+		t.Errorf("decryptSecret() = %q, %v, want %q", got, err, "secret")
+	}
+
+	for _, invalid := range []string{"", "not base64!", encrypted[:len(encrypted)-4] + "AAAA"} {
+		if _, err := decryptSecret(invalid); err == nil {
+			t.Errorf("decryptSecret(%q) succeeded, want an error", invalid)
+		}
+	}
+	credentialsKey = []byte("another key of thirty-two bytes!")
+	if _, err := decryptSecret(encrypted); err == nil {
+		t.Error("decrypting with another key succeeded, want an error")
+	}
+}
+
+func TestCalDAVProviderSignsInWithTheUser(t *testing.T) {
+	_, server := newFakeCalDAVServer(t)
+	previous := credentialsKey
+	credentialsKey = make([]byte, 32)
+	t.Cleanup(func() { credentialsKey = previous })
+
+	password, err := encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{Provider: CalDAV, CalDAVURL: server.URL, CalDAVUsername: "ada", CalDAVPassword: password}
+	service, err := newProviderCalendar(CalDAV, user, user.CalenderToken)
+	if err != nil {
+		t.Fatalf("newProviderCalendar(): %v", err)
+	}
+	if _, err := service.GetEvents(day(1, 0, 0), day(31, 0, 0)); err != nil {
+		t.Errorf("GetEvents(): %v", err)
+	}
+
+	user.CalDAVPassword = "secret"
+	if _, err := newProviderCalendar(CalDAV, user, user.CalenderToken); err == nil {
+		t.Error("newProviderCalendar() with a password that isn't encrypted succeeded, want an error")
+	}
+}
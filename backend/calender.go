@@ -1,16 +1,196 @@
 package main
 
-import "time"
+import (
+    "sort"
+    "time"
+)
 
 type Event struct {
     Title string `json:"title"`
     StartTime string `json:"startTime"`
     EndTime string `json:"endTime"`
     ID string `json:"id"`
+    // All-day events use dates (YYYY-MM-DD) as times, with an exclusive end date
+    AllDay bool `json:"allDay,omitempty"`
+    // RRULE, EXDATE and RDATE lines as they appear in iCalendar
+    Recurrence []string `json:"recurrence,omitempty"`
+    // IANA name of the zone the event was created in
+    TimeZone string `json:"timeZone,omitempty"`
+    // Set on occurrences of a recurring event
+    RecurringEventID string `json:"recurringEventId,omitempty"`
+    OriginalStartTime string `json:"originalStartTime,omitempty"`
+    // ScopeThis or ScopeSeries when changing an occurrence
+    Scope string `json:"scope,omitempty"`
+    Location string `json:"location,omitempty"`
+    Description string `json:"description,omitempty"`
+    Attendees []Attendee `json:"attendees,omitempty"`
+    // Link for joining the online meeting of the event
+    MeetingURL string `json:"meetingUrl,omitempty"`
+    // Asks the calendar to set up an online meeting, e.g. Google Meet or Teams
+    OnlineMeeting bool `json:"onlineMeeting,omitempty"`
+    // Calendar of the account the event is in, empty for the default one
+    CalendarID string `json:"calendarId,omitempty"`
+    // Linked account the event is in, empty for the account the user signed up with
+    AccountID string `json:"accountId,omitempty"`
+}
+
+const (
+    StatusNeedsAction string = "needsAction"
+    StatusAccepted string = "accepted"
+    StatusDeclined string = "declined"
+    StatusTentative string = "tentative"
+)
+
+type Attendee struct {
+    Email string `json:"email"`
+    Name string `json:"name,omitempty"`
+    // One of the Status constants
+    Status string `json:"status,omitempty"`
 }
 
 type Calendar interface {
     CreateEvent(Event) error
     RemoveEvent(Event) error
+    // UpdateEvent changes the event with the given ID, leaving empty fields as they are
+    UpdateEvent(Event) error
     GetEvents(startTime, endTime time.Time) ([]*Event, error)
 }
+
+// SeriesCalendar is implemented by calendars that can look up the master
+// event of a recurring series from the RecurringEventID of an occurrence
+type SeriesCalendar interface {
+    GetSeries(id string) (*Event, error)
+}
+
+const dateLayout = "2006-01-02"
+
+func isDateOnly(value string) bool {
+    return len(value) == len(dateLayout)
+}
+
+// parseEventTime reads the start or end of an event, which is a date for
+// all-day events and RFC 3339 otherwise. Dates are midnight UTC.
+func parseEventTime(value string) (time.Time, error) {
+    if isDateOnly(value) {
+        return time.Parse(dateLayout, value)
+    }
+    return time.Parse(time.RFC3339, value)
+}
+
+func formatEventTime(t time.Time, allDay bool) string {
+    if allDay {
+        return t.Format(dateLayout)
+    }
+    return t.Format(time.RFC3339)
+}
+
+// normalizeAllDay makes the times of all-day events dates and gives them at
+// least one day, so that every calendar gets them in the same form
+func (e *Event) normalizeAllDay() error {
+    if isDateOnly(e.StartTime) {
+        e.AllDay = true
+    }
+    if !e.AllDay {
+        return nil
+    }
+    for _, value := range []*string{&e.StartTime, &e.EndTime} {
+        if *value == "" || isDateOnly(*value) {
+            continue
+        }
+        t, err := time.Parse(time.RFC3339, *value)
+        if err != nil {
+            return err
+        }
+        *value = t.Format(dateLayout)
+    }
+    if e.StartTime != "" && e.EndTime <= e.StartTime {
+        start, err := parseEventTime(e.StartTime)
+        if err != nil {
+            return err
+        }
+        e.EndTime = start.AddDate(0, 0, 1).Format(dateLayout)
+    }
+    return nil
+}
+
+type CalendarInfo struct {
+    ID string `json:"id"`
+    Name string `json:"name"`
+    Primary bool `json:"primary"`
+    ReadOnly bool `json:"readOnly"`
+    Color string `json:"color,omitempty"`
+    AccountID string `json:"accountId,omitempty"`
+}
+
+// MultiCalendar is implemented by accounts with several calendars, like the
+// work, family and shared calendars of a Google account
+type MultiCalendar interface {
+    ListCalendars() ([]CalendarInfo, error)
+    // SelectCalendars sets the calendars GetEvents reads, the default
+    // calendar being used when ids is empty
+    SelectCalendars(ids []string)
+}
+
+// SyncCalendar is implemented by providers that can list the changes to
+// their events since an earlier sync
+type SyncCalendar interface {
+    // SyncEvents returns the changes since the sync that returned token.
+    // Without a token, or when it expired, all events between start and end
+    // are returned.
+    SyncEvents(token string, start, end time.Time) (*SyncResult, error)
+}
+
+// WatchCalendar is implemented by providers that can post to us when events
+// of a calendar change
+type WatchCalendar interface {
+    // Watch asks for changes of channel.CalendarID to be posted to address,
+    // and fills in the id and expiration of the channel
+    Watch(channel *WatchChannel, address string) error
+    StopWatch(channel *WatchChannel) error
+}
+
+// SearchQuery selects events by their text and attendees within a range.
+// Empty fields match every event.
+type SearchQuery struct {
+    Text string
+    Attendee string
+    Start time.Time
+    End time.Time
+    Limit int
+}
+
+// SearchCalendar is implemented by providers that can search their events on
+// the server, which is faster than reading every event of a long range
+type SearchCalendar interface {
+    SearchEvents(query SearchQuery) ([]*Event, error)
+}
+
+// IDCalendar is implemented by calendars that give created events an ID of
+// their own instead of the one they are created with
+type IDCalendar interface {
+    CreateEventID(Event) (string, error)
+}
+
+// createEventID creates the event and returns the ID it can be found by
+// again
+func createEventID(service Calendar, event Event) (string, error) {
+    if event.ID == "" {
+        uid, err := newEventUID()
+        if err != nil {
+            return "", err
+        }
+        event.ID = uid
+    }
+    if ids, ok := service.(IDCalendar); ok {
+        return ids.CreateEventID(event)
+    }
+    return event.ID, service.CreateEvent(event)
+}
+
+func sortEventsByStart(events []*Event) {
+    sort.SliceStable(events, func(i, j int) bool {
+        a, _ := parseEventTime(events[i].StartTime)
+        b, _ := parseEventTime(events[j].StartTime)
+        return a.Before(b)
+    })
+}
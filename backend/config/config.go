@@ -14,6 +14,8 @@ type Config struct {
     DBHost string
     DBPort string
     JWTSecret string
+    // Encrypts the passwords of connected CalDAV calendars
+    CredentialsKey string
     GoogleClientID string
     GoogleClientSecret string
 
@@ -31,6 +33,24 @@ type Config struct {
     OpenAISecret string
     GeminiAISecret string
 
+    CalendarMode string
+    // Lets users connect calendars on private addresses, like a local
+    // Radicale during development
+    AllowPrivateURLs bool
+    // Public address of the backend that calendar providers post changes to
+    WebhookURL string
+
+    SMTPHost string
+    SMTPPort string
+    SMTPUsername string
+    SMTPPassword string
+    SMTPFrom string
+
+    // Key pair for Web Push, base64url encoded
+    VAPIDPublicKey string
+    VAPIDPrivateKey string
+    VAPIDSubject string
+
 }
 
 
@@ -47,6 +67,7 @@ func LoadConfig() Config {
         DBHost:         os.Getenv("DB_HOST"),
         DBPort:         os.Getenv("DB_PORT"),
         JWTSecret:      os.Getenv("JWT_SECRET"),
+        CredentialsKey: os.Getenv("CREDENTIALS_KEY"),
         GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
         GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
         MicrosoftClientID:     os.Getenv("MICROSOFT_CLIENT_ID"),
@@ -60,5 +81,16 @@ func LoadConfig() Config {
         PayPalWebhookID: os.Getenv("PAYPAL_WEBHOOK_ID"),
         OpenAISecret: os.Getenv("OPENAI_SECRET_KEY"),
         GeminiAISecret: os.Getenv("GEMINI_SECRET_KEY"),
+        CalendarMode: os.Getenv("CALENDAR_MODE"),
+        AllowPrivateURLs: os.Getenv("ALLOW_PRIVATE_URLS") == "true",
+        WebhookURL: os.Getenv("WEBHOOK_URL"),
+        SMTPHost: os.Getenv("SMTP_HOST"),
+        SMTPPort: os.Getenv("SMTP_PORT"),
+        SMTPUsername: os.Getenv("SMTP_USERNAME"),
+        SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+        SMTPFrom: os.Getenv("SMTP_FROM"),
+        VAPIDPublicKey: os.Getenv("VAPID_PUBLIC_KEY"),
+        VAPIDPrivateKey: os.Getenv("VAPID_PRIVATE_KEY"),
+        VAPIDSubject: os.Getenv("VAPID_SUBJECT"),
     }
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -18,7 +19,9 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	"google.golang.org/api/tasks/v1"
 
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
@@ -27,71 +30,445 @@ import (
 )
 
 type GoogleCalendar struct {
-	service *calendar.Service
+	service     *calendar.Service
+	calendarIDs []string
 }
 
-func NewGoogleCalendar(config *oauth2.Config, user User) *GoogleCalendar {
-	var token oauth2.Token
-
-	if err := json.Unmarshal(user.CalenderToken, &token); err != nil {
-		log.Fatal(err)
-	}
+func init() {
+	RegisterProvider(&Provider{
+		Name:     Google,
+		Path:     "google",
+		Init:     InitGoogle,
+		Login:    GoogleLogin,
+		Callback: GoogleCallback,
+		NewCalendar: func(user User, token *oauth2.Token) (Calendar, error) {
+			return NewGoogleCalendar(googleOAuthConf, token)
+		},
+		NewEmailClient: func(token *oauth2.Token) EmailClient {
+			return NewGoogleMail(token)
+		},
+		NewTaskList: func(token *oauth2.Token) (TaskList, error) {
+			return NewGoogleTaskList(token)
+		},
+		Webhook: GoogleWebhook,
+	})
+}
 
-	client := config.Client(context.Background(), &token)
+func NewGoogleCalendar(config *oauth2.Config, token *oauth2.Token) (*GoogleCalendar, error) {
+	client := config.Client(context.Background(), token)
 
 	srv, err := calendar.NewService(context.Background(), option.WithHTTPClient(client))
 
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return &GoogleCalendar{
 		service: srv,
-	}
+	}, nil
 }
 
 func (c *GoogleCalendar) CreateEvent(event Event) error {
+	_, err := c.CreateEventID(event)
+	return err
+}
+
+// CreateEventID creates the event and returns its ID, which Google picks
+// for UIDs that don't fit its format
+func (c *GoogleCalendar) CreateEventID(event Event) (string, error) {
 	googleEvent := &calendar.Event{}
-	googleEvent.Id = event.ID
+	if isGoogleEventID(event.ID) {
+		googleEvent.Id = event.ID
+	} else {
+		// UIDs from other calendars don't fit Google's id format
+		googleEvent.ICalUID = event.ID
+	}
 	googleEvent.Summary = event.Title
-	googleEvent.Start = &calendar.EventDateTime{DateTime: event.StartTime}
-	googleEvent.End = &calendar.EventDateTime{DateTime: event.EndTime}
+	googleEvent.Start = toGoogleDateTime(event.StartTime, event)
+	googleEvent.End = toGoogleDateTime(event.EndTime, event)
+	googleEvent.Recurrence = event.Recurrence
+	if len(event.Recurrence) > 0 && event.TimeZone == "" && !event.AllDay {
+		// Google needs a zone to expand recurring events
+		googleEvent.Start.TimeZone = "UTC"
+		googleEvent.End.TimeZone = "UTC"
+	}
+	googleEvent.Location = event.Location
+	googleEvent.Description = event.Description
+	googleEvent.Attendees = toGoogleAttendees(event.Attendees)
+	if event.OnlineMeeting {
+		conference, err := newGoogleMeet()
+		if err != nil {
+			return "", err
+		}
+		googleEvent.ConferenceData = conference
+	}
 
-	_, err := c.service.Events.Insert("primary", googleEvent).Do()
-	return err
+	created, err := c.service.Events.
+		Insert(googleCalendarID(event.CalendarID), googleEvent).
+		ConferenceDataVersion(1).
+		SendUpdates("all").
+		Do()
+	if err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func newGoogleMeet() (*calendar.ConferenceData, error) {
+	requestID, err := newEventUID()
+	if err != nil {
+		return nil, err
+	}
+	return &calendar.ConferenceData{
+		CreateRequest: &calendar.CreateConferenceRequest{
+			RequestId:             requestID,
+			ConferenceSolutionKey: &calendar.ConferenceSolutionKey{Type: "hangoutsMeet"},
+		},
+	}, nil
+}
+
+func toGoogleAttendees(attendees []Attendee) []*calendar.EventAttendee {
+	var arr []*calendar.EventAttendee
+	for _, attendee := range attendees {
+		arr = append(arr, &calendar.EventAttendee{
+			Email:          attendee.Email,
+			DisplayName:    attendee.Name,
+			ResponseStatus: attendee.Status,
+		})
+	}
+	return arr
+}
+
+func googleMeetingURL(event *calendar.Event) string {
+	if event.HangoutLink != "" {
+		return event.HangoutLink
+	}
+	if event.ConferenceData != nil {
+		for _, entry := range event.ConferenceData.EntryPoints {
+			if entry.EntryPointType == "video" {
+				return entry.Uri
+			}
+		}
+	}
+	return ""
+}
+
+// toGoogleDateTime sets Date for all-day events and DateTime otherwise,
+// clearing the other one in case the event changes between the two
+func toGoogleDateTime(value string, event Event) *calendar.EventDateTime {
+	if event.AllDay {
+		return &calendar.EventDateTime{Date: value, NullFields: []string{"DateTime", "TimeZone"}}
+	}
+	return &calendar.EventDateTime{DateTime: value, TimeZone: event.TimeZone, NullFields: []string{"Date"}}
+}
+
+func fromGoogleDateTime(t *calendar.EventDateTime) string {
+	if t == nil {
+		return ""
+	}
+	if t.Date != "" {
+		return t.Date
+	}
+	return t.DateTime
+}
+
+func googleToEvent(event *calendar.Event) *Event {
+	e := &Event{
+		ID:                event.Id,
+		Title:             event.Summary,
+		StartTime:         fromGoogleDateTime(event.Start),
+		EndTime:           fromGoogleDateTime(event.End),
+		AllDay:            event.Start != nil && event.Start.Date != "",
+		Recurrence:        event.Recurrence,
+		RecurringEventID:  event.RecurringEventId,
+		OriginalStartTime: fromGoogleDateTime(event.OriginalStartTime),
+		Location:          event.Location,
+		Description:       event.Description,
+		MeetingURL:        googleMeetingURL(event),
+	}
+	if event.Start != nil {
+		e.TimeZone = event.Start.TimeZone
+	}
+	for _, attendee := range event.Attendees {
+		e.Attendees = append(e.Attendees, Attendee{
+			Email:  attendee.Email,
+			Name:   attendee.DisplayName,
+			Status: attendee.ResponseStatus,
+		})
+	}
+	return e
+}
+
+// isGoogleEventID reports whether id only uses the base32hex characters
+// Google accepts for client supplied event ids
+func isGoogleEventID(id string) bool {
+	if len(id) < 5 || len(id) > 1024 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'v') && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *GoogleCalendar) RemoveEvent(event Event) error {
-	return c.service.Events.Delete("primary", event.ID).Do()
+	id := event.ID
+	if event.Scope == ScopeSeries && event.RecurringEventID != "" {
+		id = event.RecurringEventID
+	}
+	// Deleting the id of an occurrence cancels just that occurrence
+	return c.service.Events.Delete(googleCalendarID(event.CalendarID), id).Do()
 }
 
-func (c *GoogleCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
-	events, err := c.
-		service.
-		Events.
-		List("primary").
-		TimeMin(startTime.Format(time.RFC3339)).
-		TimeMax(endTime.Format(time.RFC3339)).
-		SingleEvents(true). // This expands recurring events into instances
-		OrderBy("startTime").
+func (c *GoogleCalendar) UpdateEvent(event Event) error {
+	id := event.ID
+	if event.Scope == ScopeSeries && event.RecurringEventID != "" {
+		id = event.RecurringEventID
+		master, err := c.getSeries(googleCalendarID(event.CalendarID), id)
+		if err != nil {
+			return err
+		}
+		if event.StartTime, event.EndTime, err = shiftSeries(master, event); err != nil {
+			return err
+		}
+	}
+
+	patch := &calendar.Event{
+		Summary:     event.Title,
+		Recurrence:  event.Recurrence,
+		Location:    event.Location,
+		Description: event.Description,
+	}
+	if event.Attendees != nil {
+		patch.Attendees = toGoogleAttendees(event.Attendees)
+		// An empty list removes every attendee
+		patch.ForceSendFields = []string{"Attendees"}
+	}
+	if event.OnlineMeeting {
+		conference, err := newGoogleMeet()
+		if err != nil {
+			return err
+		}
+		patch.ConferenceData = conference
+	}
+	if event.StartTime != "" {
+		patch.Start = toGoogleDateTime(event.StartTime, event)
+	}
+	if event.EndTime != "" {
+		patch.End = toGoogleDateTime(event.EndTime, event)
+	}
+
+	_, err := c.service.Events.
+		Patch(googleCalendarID(event.CalendarID), id, patch).
+		ConferenceDataVersion(1).
+		SendUpdates("all").
 		Do()
+	return err
+}
+
+func googleCalendarID(id string) string {
+	if id == "" {
+		return "primary"
+	}
+	return id
+}
 
+func (c *GoogleCalendar) ListCalendars() ([]CalendarInfo, error) {
+	list, err := c.service.CalendarList.List().Do()
 	if err != nil {
 		return nil, err
 	}
+	var arr []CalendarInfo
+	for _, item := range list.Items {
+		name := item.Summary
+		if item.SummaryOverride != "" {
+			name = item.SummaryOverride
+		}
+		arr = append(arr, CalendarInfo{
+			ID:       item.Id,
+			Name:     name,
+			Primary:  item.Primary,
+			ReadOnly: item.AccessRole == "reader" || item.AccessRole == "freeBusyReader",
+			Color:    item.BackgroundColor,
+		})
+	}
+	return arr, nil
+}
+
+func (c *GoogleCalendar) SelectCalendars(ids []string) {
+	c.calendarIDs = ids
+}
+
+func (c *GoogleCalendar) selectedCalendars() []string {
+	if len(c.calendarIDs) == 0 {
+		return []string{"primary"}
+	}
+	return c.calendarIDs
+}
 
-	eventArr := make([]*Event, len(events.Items))
+func (c *GoogleCalendar) getSeries(calendarID, id string) (*Event, error) {
+	event, err := c.service.Events.Get(calendarID, id).Do()
+	if err != nil {
+		return nil, err
+	}
+	e := googleToEvent(event)
+	e.CalendarID = calendarID
+	return e, nil
+}
 
-	for i, event := range events.Items {
-		eventArr[i] = &Event{
-			ID:        event.Id,
-			Title:     event.Summary,
-			StartTime: event.Start.DateTime,
-			EndTime:   event.End.DateTime,
+func (c *GoogleCalendar) GetSeries(id string) (*Event, error) {
+	var err error
+	for _, calendarID := range c.selectedCalendars() {
+		var event *Event
+		if event, err = c.getSeries(calendarID, id); err == nil {
+			return event, nil
 		}
 	}
+	return nil, err
+}
 
-	return eventArr, err
+func (c *GoogleCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	var eventArr []*Event
+	for _, calendarID := range c.selectedCalendars() {
+		err := c.
+			service.
+			Events.
+			List(calendarID).
+			TimeMin(startTime.Format(time.RFC3339)).
+			TimeMax(endTime.Format(time.RFC3339)).
+			SingleEvents(true). // This expands recurring events into instances
+			OrderBy("startTime").
+			MaxResults(2500).
+			Pages(context.Background(), appendGoogleEvents(calendarID, &eventArr))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortEventsByStart(eventArr)
+	return eventArr, nil
+}
+
+// appendGoogleEvents adds the events of each page to arr
+func appendGoogleEvents(calendarID string, arr *[]*Event) func(events *calendar.Events) error {
+	return func(events *calendar.Events) error {
+		for _, event := range events.Items {
+			e := googleToEvent(event)
+			e.CalendarID = calendarID
+			if e.TimeZone == "" {
+				// Single events only carry an offset, so use the calendar's zone
+				e.TimeZone = events.TimeZone
+			}
+			*arr = append(*arr, e)
+		}
+		return nil
+	}
+}
+
+// SearchEvents uses the free text search of Google, which looks at titles,
+// descriptions, locations and attendees
+func (c *GoogleCalendar) SearchEvents(query SearchQuery) ([]*Event, error) {
+	var arr []*Event
+	for _, calendarID := range c.selectedCalendars() {
+		call := c.service.Events.
+			List(calendarID).
+			Q(query.searchTerm()).
+			SingleEvents(true).
+			OrderBy("startTime").
+			MaxResults(2500)
+		if !query.Start.IsZero() {
+			call = call.TimeMin(query.Start.Format(time.RFC3339))
+		}
+		if !query.End.IsZero() {
+			call = call.TimeMax(query.End.Format(time.RFC3339))
+		}
+		if err := call.Pages(context.Background(), appendGoogleEvents(calendarID, &arr)); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+func (c *GoogleCalendar) SyncEvents(token string, start, end time.Time) (*SyncResult, error) {
+	tokens := decodeSyncTokens(token, c.selectedCalendars())
+	result := &SyncResult{Full: tokens == nil}
+	next := map[string]string{}
+	for _, calendarID := range c.selectedCalendars() {
+		pageToken := ""
+		for {
+			// Sync tokens can't be combined with a time range, later syncs
+			// only return what changed
+			call := c.service.Events.List(calendarID).SingleEvents(true)
+			if result.Full {
+				call = call.TimeMin(start.Format(time.RFC3339)).TimeMax(end.Format(time.RFC3339))
+			} else {
+				call = call.SyncToken(tokens[calendarID])
+			}
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			events, err := call.Do()
+			var apiErr *googleapi.Error
+			if !result.Full && errors.As(err, &apiErr) && apiErr.Code == http.StatusGone {
+				// The token expired, so start over
+				return c.SyncEvents("", start, end)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			for _, event := range events.Items {
+				if event.Status == "cancelled" {
+					result.Removed = append(result.Removed, event.Id)
+					continue
+				}
+				e := googleToEvent(event)
+				e.CalendarID = calendarID
+				if e.TimeZone == "" {
+					e.TimeZone = events.TimeZone
+				}
+				result.Changed = append(result.Changed, e)
+			}
+
+			if events.NextPageToken == "" {
+				next[calendarID] = events.NextSyncToken
+				break
+			}
+			pageToken = events.NextPageToken
+		}
+	}
+	result.Token = encodeSyncTokens(next)
+	return result, nil
+}
+
+func (c *GoogleCalendar) Watch(channel *WatchChannel, address string) error {
+	id, err := newEventUID()
+	if err != nil {
+		return err
+	}
+	created, err := c.service.Events.Watch(googleCalendarID(channel.CalendarID), &calendar.Channel{
+		Id:      id,
+		Type:    "web_hook",
+		Address: address,
+		Token:   channel.Secret,
+	}).Do()
+	if err != nil {
+		return err
+	}
+	channel.ChannelID = created.Id
+	channel.ResourceID = created.ResourceId
+	channel.Expiration = time.UnixMilli(created.Expiration)
+	return nil
+}
+
+func (c *GoogleCalendar) StopWatch(channel *WatchChannel) error {
+	return c.service.Channels.Stop(&calendar.Channel{
+		Id:         channel.ChannelID,
+		ResourceId: channel.ResourceID,
+	}).Do()
 }
 
 func InitGoogle(config config.Config) {
@@ -103,6 +480,7 @@ func InitGoogle(config config.Config) {
 			"https://www.googleapis.com/auth/userinfo.email",
 			calendar.CalendarScope,
 			gmail.GmailReadonlyScope,
+			tasks.TasksScope,
 		},
 		Endpoint: google.Endpoint,
 	}
@@ -119,6 +497,7 @@ func GoogleLogin(c *gin.Context) error {
 		Value:     state,
 		ExpiresAt: time.Now().Add(15 * time.Minute),
 	})
+	startLinking(c, session)
 	if err := session.Save(); err != nil {
 		return err
 	}
@@ -173,6 +552,10 @@ func GoogleCallback(c *gin.Context) error {
 		return fmt.Errorf("Failed to parse user info")
 	}
 
+	if linkUser := linkingUser(c); linkUser != nil {
+		return linkAccount(c, linkUser, Google, userInfo.ID, userInfo.Email, token)
+	}
+
 	// Check if user exists
 	user, err := GetUser(userInfo.Email)
 	if err != nil {
@@ -191,8 +574,6 @@ func GoogleCallback(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	service := NewGoogleCalendar(googleOAuthConf, *user)
-	calendarCache[jwtToken] = service
 
 	// Redirect to frontend with token
 	c.SetCookie("token", jwtToken, int(time.Now().Add(time.Hour*24*7).Unix()), "/", "", true, false)
@@ -307,3 +688,126 @@ func extractBody(part *gmail.MessagePart, mimeType string) (string, error) {
 	}
 	return "", nil
 }
+
+type GoogleTaskList struct {
+	service *tasks.Service
+}
+
+func NewGoogleTaskList(token *oauth2.Token) (*GoogleTaskList, error) {
+	service, err := tasks.NewService(
+		context.Background(),
+		option.WithTokenSource(googleOAuthConf.TokenSource(context.Background(), token)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleTaskList{
+		service: service,
+	}, nil
+}
+
+func googleTaskListID(id string) string {
+	if id == "" {
+		return "@default"
+	}
+	return id
+}
+
+// googleTaskError tells apart tokens granted before the tasks scopes
+func googleTaskError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+		for _, item := range apiErr.Errors {
+			if item.Reason == "insufficientPermissions" {
+				return fmt.Errorf("%w: %v", errMissingTaskScope, err)
+			}
+		}
+	}
+	return err
+}
+
+func (l *GoogleTaskList) GetTasks(includeCompleted bool) ([]*Task, error) {
+	var lists []*tasks.TaskList
+	err := l.service.Tasklists.List().Pages(context.Background(), func(page *tasks.TaskLists) error {
+		lists = append(lists, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, googleTaskError(err)
+	}
+	var arr []*Task
+	for _, list := range lists {
+		// Completed tasks are hidden once cleared in Google Tasks
+		err := l.service.Tasks.List(list.Id).
+			ShowCompleted(includeCompleted).
+			ShowHidden(includeCompleted).
+			Pages(context.Background(), func(page *tasks.Tasks) error {
+				for _, task := range page.Items {
+					t := googleToTask(task)
+					t.ListID = list.Id
+					arr = append(arr, t)
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, googleTaskError(err)
+		}
+	}
+	return arr, nil
+}
+
+func googleToTask(task *tasks.Task) *Task {
+	t := &Task{
+		ID:     task.Id,
+		Title:  task.Title,
+		Notes:  task.Notes,
+		Status: TaskOpen,
+	}
+	if task.Status == "completed" {
+		t.Status = TaskCompleted
+	}
+	if due, err := time.Parse(time.RFC3339, task.Due); err == nil {
+		// Google keeps only the date of due times
+		t.Due = due.UTC().Format(dateLayout)
+	}
+	return t
+}
+
+// toGoogleTask sets the fields of task that are given on googleTask
+func toGoogleTask(googleTask *tasks.Task, task Task) {
+	googleTask.Title = task.Title
+	googleTask.Notes = task.Notes
+	if task.Due != "" {
+		googleTask.Due = task.Due + "T00:00:00Z"
+	}
+	switch task.Status {
+	case TaskOpen:
+		googleTask.Status = "needsAction"
+		googleTask.NullFields = append(googleTask.NullFields, "Completed")
+	case TaskCompleted:
+		googleTask.Status = "completed"
+	}
+}
+
+func (l *GoogleTaskList) CreateTask(task Task) (*Task, error) {
+	googleTask := &tasks.Task{}
+	toGoogleTask(googleTask, task)
+	created, err := l.service.Tasks.Insert(googleTaskListID(task.ListID), googleTask).Do()
+	if err != nil {
+		return nil, googleTaskError(err)
+	}
+	t := googleToTask(created)
+	t.ListID = task.ListID
+	return t, nil
+}
+
+func (l *GoogleTaskList) UpdateTask(task Task) error {
+	googleTask := &tasks.Task{}
+	toGoogleTask(googleTask, task)
+	_, err := l.service.Tasks.Patch(googleTaskListID(task.ListID), task.ID, googleTask).Do()
+	return googleTaskError(err)
+}
+
+func (l *GoogleTaskList) RemoveTask(task Task) error {
+	return googleTaskError(l.service.Tasks.Delete(googleTaskListID(task.ListID), task.ID).Do())
+}
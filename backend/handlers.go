@@ -1,11 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc"
@@ -32,18 +35,66 @@ var (
 	microsoftOAuthConf *oauth2.Config
 	microsoftProvider  *oidc.Provider
 
-	calendarCache map[string]Calendar
+	calendarCache     map[string]Calendar
+	localCalendarOnly bool
 
 	geminiClient       *genai.Client
 	conversationsCache map[string]*genai.ChatSession
+
+	// Guards calendarCache and conversationsCache, which requests and
+	// webhooks use at the same time
+	cacheLock sync.RWMutex
 )
 
+var errNoCalendar = errors.New("no calendar connected")
+
+func cachedService(token string) (Calendar, bool) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	service, ok := calendarCache[token]
+	return service, ok
+}
+
+func storeService(token string, service Calendar) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	calendarCache[token] = service
+}
+
+func cachedSession(token string) *genai.ChatSession {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	return conversationsCache[token]
+}
+
+func storeSession(token string, session *genai.ChatSession) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	conversationsCache[token] = session
+}
+
+// forgetSession makes the assistant start over with the current calendar
+func forgetSession(token string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	delete(conversationsCache, token)
+}
+
 type HTTPHandlerFunction func(c *gin.Context) error
 
 func HandleError(handler HTTPHandlerFunction) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if err := handler(c); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			var validation *ValidationError
+			var conflict *ConflictError
+			switch {
+			case errors.As(err, &validation):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": validation.Fields})
+			case errors.As(err, &conflict):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "conflicts": conflict.Conflicts})
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			}
 			log.Println(err.Error())
 		}
 	}
@@ -58,7 +109,7 @@ func InitDB(config config.Config) {
 	if err != nil {
 		log.Fatalln("failed to connect to databse")
 	}
-	db.AutoMigrate(&User{})
+	db.AutoMigrate(&User{}, &LocalEvent{}, &CalendarSetting{}, &LinkedAccount{}, &CachedEvent{}, &SyncState{}, &WatchChannel{}, &ReminderPreference{}, &SentReminder{}, &PushSubscription{}, &PolicyRule{}, &PolicyBlock{}, &SchedulingPreference{}, &LocalTask{}, &TaskBlock{}, &Poll{}, &PollSlot{}, &PollVote{}, &BookingPage{}, &Booking{})
 	calendarCache = make(map[string]Calendar)
 	conversationsCache = make(map[string]*genai.ChatSession)
 }
@@ -108,7 +159,7 @@ func Register(c *gin.Context) error {
 		return err
 	}
 
-	user := User{Email: json.Email, Password: hashedPassword}
+	user := User{Email: json.Email, Password: hashedPassword, Provider: Local}
 	if err := db.Create(&user).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User already exists"})
 		return err
@@ -196,29 +247,118 @@ func Payment(c *gin.Context) error {
 func FetchCalenderData(c *gin.Context) error {
 	token, _ := c.Cookie("token")
 	service := getServiceFromToken(token)
-	events, _ := service.GetEvents(time.Now(), time.Now().Add(time.Hour*24*7))
+	if service == nil {
+		return errNoCalendar
+	}
+	events, err := service.GetEvents(time.Now(), time.Now().Add(time.Hour*24*7))
+	if err != nil {
+		return err
+	}
 	c.JSON(http.StatusOK, gin.H{"items": events})
 	return nil
 }
 
+// eventWrite is the body of requests creating or changing an event
+type eventWrite struct {
+	Event
+	// Writes the event even when it overlaps others
+	AllowOverlap bool `json:"allowOverlap"`
+}
+
 func CreateEvent(c *gin.Context) error {
 	token, _ := c.Cookie("token")
 
 	service := getServiceFromToken(token)
-	event := Event{}
-	if err := c.ShouldBindBodyWithJSON(&event); err != nil {
+	if service == nil {
+		return errNoCalendar
+	}
+	body := eventWrite{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		return err
+	}
+	event := body.Event
+	if err := validateEvent(&event, true); err != nil {
+		return err
+	}
+	if err := event.normalizeAllDay(); err != nil {
+		return err
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	if err := event.normalizeTimeZone(user.TimeZone); err != nil {
 		return err
 	}
 
-	service.CreateEvent(event)
+	conflicts, err := findConflicts(service, event, userLocation(user))
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 && !body.AllowOverlap {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	if err := service.CreateEvent(event); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "created", "warnings": conflictMessages(conflicts)})
 	return nil
+}
+
+func UpdateEvent(c *gin.Context) error {
+	token, _ := c.Cookie("token")
 
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+
+	body := eventWrite{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		return err
+	}
+	event := body.Event
+	if event.ID == "" {
+		return &ValidationError{Fields: []FieldError{{Field: "id", Message: "is required"}}}
+	}
+	if err := validateEvent(&event, false); err != nil {
+		return err
+	}
+	if err := event.normalizeAllDay(); err != nil {
+		return err
+	}
+	// Events keep their zone unless a new one is given
+	if err := event.normalizeTimeZone(""); err != nil {
+		return err
+	}
+
+	var conflicts []Conflict
+	if event.StartTime != "" {
+		user, err := getUserFromToken(token)
+		if err != nil {
+			return err
+		}
+		if conflicts, err = findConflicts(service, event, userLocation(user)); err != nil {
+			return err
+		}
+		if len(conflicts) > 0 && !body.AllowOverlap {
+			return &ConflictError{Conflicts: conflicts}
+		}
+	}
+	if err := service.UpdateEvent(event); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated", "warnings": conflictMessages(conflicts)})
+	return nil
 }
 
 func RemoveEvent(c *gin.Context) error {
 	token, _ := c.Cookie("token")
 
 	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
 
 	event := Event{}
 
@@ -230,22 +370,421 @@ func RemoveEvent(c *gin.Context) error {
 
 }
 
+func ExportCalendar(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+
+	startTime := time.Now().AddDate(0, -1, 0)
+	endTime := time.Now().AddDate(1, 0, 0)
+	if start := c.Query("start"); start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return err
+		}
+		startTime = t
+	}
+	if end := c.Query("end"); end != "" {
+		t, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return err
+		}
+		endTime = t
+	}
+
+	events, err := service.GetEvents(startTime, endTime)
+	if err != nil {
+		return err
+	}
+	if series, ok := service.(SeriesCalendar); ok {
+		events = collapseSeries(series, events)
+	}
+
+	data, err := EventsToICS(events)
+	if err != nil {
+		return err
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="calendar.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(data))
+	return nil
+}
+
+// collapseSeries replaces the occurrences of recurring events with their
+// master event, keeping only occurrences that were moved
+func collapseSeries(service SeriesCalendar, events []*Event) []*Event {
+	seen := map[string]bool{}
+	var arr []*Event
+	for _, event := range events {
+		if event.RecurringEventID == "" {
+			arr = append(arr, event)
+			continue
+		}
+		if !seen[event.RecurringEventID] {
+			seen[event.RecurringEventID] = true
+			master, err := service.GetSeries(event.RecurringEventID)
+			if err != nil {
+				log.Println(err.Error())
+				arr = append(arr, event)
+				continue
+			}
+			arr = append(arr, master)
+		}
+		start, _ := parseEventTime(event.StartTime)
+		original, _ := parseEventTime(event.OriginalStartTime)
+		if !start.Equal(original) {
+			arr = append(arr, event)
+		}
+	}
+	return arr
+}
+
+// splitOccurrences separates the modified occurrences of imported series
+// from the events to create. Occurrences whose series isn't in the file
+// become standalone events with the UID of their series.
+func splitOccurrences(events []*Event) (creates, occurrences []*Event) {
+	masters := map[string]bool{}
+	for _, event := range events {
+		if event.RecurringEventID == "" {
+			masters[event.ID] = true
+		}
+	}
+
+	for _, event := range events {
+		switch {
+		case event.RecurringEventID == "":
+			creates = append(creates, event)
+		case masters[event.RecurringEventID]:
+			occurrences = append(occurrences, event)
+		default:
+			event.ID = event.RecurringEventID
+			event.RecurringEventID = ""
+			event.OriginalStartTime = ""
+			creates = append(creates, event)
+		}
+	}
+	return creates, occurrences
+}
+
+// importOccurrence changes the occurrence of the series created as seriesID,
+// so that calendars keep it as an exception with the UID of the series
+func importOccurrence(service Calendar, seriesID string, occurrence *Event) error {
+	original, err := parseEventTime(occurrence.OriginalStartTime)
+	if err != nil {
+		return err
+	}
+	events, err := service.GetEvents(original.AddDate(0, 0, -1), original.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.RecurringEventID != seriesID {
+			continue
+		}
+		if start, err := parseEventTime(event.OriginalStartTime); err != nil || !start.Equal(original) {
+			continue
+		}
+		changes := *occurrence
+		changes.ID = event.ID
+		changes.RecurringEventID = seriesID
+		changes.OriginalStartTime = event.OriginalStartTime
+		changes.Scope = ScopeThis
+		changes.CalendarID = event.CalendarID
+		changes.AccountID = event.AccountID
+		return service.UpdateEvent(changes)
+	}
+	return fmt.Errorf("occurrence %s of the series not found", occurrence.OriginalStartTime)
+}
+
+func ImportCalendar(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	// Leave room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxICSSize+1<<20)
+	file, err := c.FormFile("file")
+	if err != nil {
+		return err
+	}
+	v := &ValidationError{}
+	if file.Size > maxICSSize {
+		v.add("file", "is larger than %d MB", maxICSSize>>20)
+		return v.err()
+	}
+	f, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxICSSize))
+	if err != nil {
+		return err
+	}
+
+	// Floating times are where the user is
+	events, err := ParseICS(string(data), userLocation(user))
+	if err != nil {
+		return err
+	}
+
+	creates, occurrences := splitOccurrences(events)
+
+	imported := 0
+	failed := []string{}
+	created := map[string]string{}
+	for _, event := range creates {
+		id, err := createEventID(service, *event)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", event.Title, err.Error()))
+			continue
+		}
+		created[event.ID] = id
+		imported++
+	}
+	for _, event := range occurrences {
+		seriesID, ok := created[event.RecurringEventID]
+		if !ok {
+			failed = append(failed, fmt.Sprintf("%s: the series wasn't imported", event.Title))
+			continue
+		}
+		if err := importOccurrence(service, seriesID, event); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", event.Title, err.Error()))
+			continue
+		}
+		imported++
+	}
+	forgetSession(token)
+
+	c.JSON(http.StatusOK, gin.H{"imported": imported, "errors": failed})
+	return nil
+}
+
+func Availability(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	// Query parameters override the preferences of the user
+	preference := getSchedulingPreference(user.ID)
+	opts := SlotOptions{
+		Duration:     preference.DefaultDuration(),
+		WindowStart:  time.Now(),
+		WindowEnd:    time.Now().AddDate(0, 0, 7),
+		WorkingHours: preference.WorkingHours(),
+		Step:         30 * time.Minute,
+		Location:     userLocation(user),
+		Limit:        20,
+	}
+	durations := map[string]*time.Duration{
+		"duration": &opts.Duration,
+		"buffer":   &opts.Buffer,
+		"step":     &opts.Step,
+	}
+	for name, value := range durations {
+		if q := c.Query(name); q != "" {
+			d, err := time.ParseDuration(q)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid %s %q", name, q)
+			}
+			*value = d
+		}
+	}
+	if opts.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	// Every step of the window is tried
+	if opts.Step < 5*time.Minute {
+		return fmt.Errorf("step must be at least 5m")
+	}
+	if start := c.Query("start"); start != "" {
+		if opts.WindowStart, err = time.Parse(time.RFC3339, start); err != nil {
+			return err
+		}
+	}
+	if end := c.Query("end"); end != "" {
+		if opts.WindowEnd, err = time.Parse(time.RFC3339, end); err != nil {
+			return err
+		}
+	}
+	if !opts.WindowEnd.After(opts.WindowStart) || opts.WindowEnd.Sub(opts.WindowStart) > 62*24*time.Hour {
+		return fmt.Errorf("the window must be between 0 and 62 days long")
+	}
+	if workStart := c.Query("workStart"); workStart != "" {
+		if opts.WorkingHours.Start, err = parseClock(workStart); err != nil {
+			return err
+		}
+	}
+	if workEnd := c.Query("workEnd"); workEnd != "" {
+		if opts.WorkingHours.End, err = parseClock(workEnd); err != nil {
+			return err
+		}
+	}
+	if days := c.Query("days"); days != "" {
+		// Weekdays as numbers, Sunday being 0
+		opts.WorkingHours.Days = nil
+		for _, day := range strings.Split(days, ",") {
+			d, err := strconv.Atoi(day)
+			if err != nil || d < 0 || d > 6 {
+				return fmt.Errorf("invalid weekday %q", day)
+			}
+			opts.WorkingHours.Days = append(opts.WorkingHours.Days, time.Weekday(d))
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 1 || opts.Limit > 100 {
+			return fmt.Errorf("limit must be between 1 and 100")
+		}
+	}
+
+	events, err := service.GetEvents(opts.WindowStart, opts.WindowEnd)
+	if err != nil {
+		return err
+	}
+	busy := BusyIntervals(events, opts.Location)
+	lunch := preference.LunchIntervals(opts.WindowStart, opts.WindowEnd, opts.Location)
+
+	c.JSON(http.StatusOK, gin.H{
+		"timeZone": opts.Location.String(),
+		"busy":     busy,
+		"slots":    FindFreeSlots(mergeIntervals(append(lunch, busy...)), opts),
+	})
+	return nil
+}
+
+func ConnectCalDAV(c *gin.Context) error {
+	token, err := c.Cookie("token")
+	if err != nil {
+		return err
+	}
+
+	claims, err := ValidateToken(token)
+	if err != nil {
+		return err
+	}
+
+	user, err := GetUser(claims.Email)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		URL      string `json:"url" binding:"required,url"`
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	if err := validatePublicURL(json.URL); err != nil {
+		return err
+	}
+	if credentialsKey == nil {
+		return errNoCredentialsKey
+	}
+	// Google and Microsoft accounts keep the calendar they signed up with
+	if _, ok := providers[user.Provider]; ok && user.Provider != CalDAV {
+		return errOtherProvider
+	}
+
+	credentials := CalDAVCredentials{
+		URL:      json.URL,
+		Username: json.Username,
+		Password: json.Password,
+	}
+
+	// Make sure the credentials work before storing them
+	service := NewCalDAVCalendar(credentials)
+	if _, err := service.GetEvents(time.Now(), time.Now().Add(time.Hour*24)); err != nil {
+		return err
+	}
+
+	if err := saveCalDAVCredentials(user, credentials); err != nil {
+		return err
+	}
+
+	forgetService(c)
+
+	c.JSON(http.StatusOK, gin.H{"status": "connected"})
+	return nil
+}
+
 func AIChat(c *gin.Context) error {
 	token, err := c.Cookie("token")
 	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	loc := userLocation(user)
 
-	session, ok := conversationsCache[token]
+	session := cachedSession(token)
 
-	if !ok || session == nil {
+	if session == nil {
 		events, _ := service.GetEvents(time.Now(), time.Now().Add(time.Hour*24*7))
+		events = filterAIContext(events, getCalendarSettings(user.ID))
 		eventStr := ""
 		for _, event := range events {
-			eventStr += fmt.Sprint(event.Title, " start: ", event.StartTime, "end: ", event.EndTime, ",")
+			eventStr += fmt.Sprint(event.Title, " start: ", formatInLocation(event.StartTime, loc), "end: ", formatInLocation(event.EndTime, loc))
+			if event.AllDay {
+				eventStr += " (all day)"
+			}
+			if event.RecurringEventID != "" {
+				eventStr += " (repeating)"
+			}
+			if event.Location != "" {
+				eventStr += " location: " + event.Location
+			}
+			if len(event.Attendees) > 0 {
+				var attendees []string
+				for _, attendee := range event.Attendees {
+					attendees = append(attendees, attendee.Email+" ("+attendee.Status+")")
+				}
+				eventStr += " attendees: " + strings.Join(attendees, " ")
+			}
+			if event.MeetingURL != "" {
+				eventStr += " (online meeting)"
+			}
+			eventStr += ","
+		}
+		preference := getSchedulingPreference(user.ID)
+		busy := BusyIntervals(events, loc)
+		busy = mergeIntervals(append(busy, preference.LunchIntervals(time.Now(), time.Now().Add(time.Hour*24*7), loc)...))
+		free := FreeIntervals(busy, SlotOptions{
+			WindowStart:  time.Now(),
+			WindowEnd:    time.Now().Add(time.Hour * 24 * 7),
+			WorkingHours: preference.WorkingHours(),
+			Location:     loc,
+		})
+		eventStr += "\nFree time during working hours: "
+		for _, interval := range free {
+			eventStr += interval.Start.Format(time.RFC3339) + " - " + interval.End.Format(time.RFC3339) + ","
 		}
 		plan := GetUserPlan(token)
 		log.Println(plan)
-		session = StartChatSession(geminiClient, eventStr, plan)
-		conversationsCache[token] = session
+		session = StartChatSession(geminiClient, eventStr, preference.Describe(), describeTasks(user), plan, loc)
+		storeSession(token, session)
 	}
 
 	var message struct {
@@ -256,17 +795,216 @@ func AIChat(c *gin.Context) error {
 		return err
 	}
 
-	response, err := SendGeminiMessage(session, message.Content)
+	response, err := SendGeminiMessage(session, message.Content, loc)
 
 	if err != nil {
 		return err
 	}
+	for i := 0; i < maxAIToolCalls; i++ {
+		results, ok := runAITool(user, service, response, loc)
+		if !ok {
+			break
+		}
+		if response, err = SendGeminiMessage(session, results, loc); err != nil {
+			return err
+		}
+	}
 
+	response = checkAIResponse(user, service, response, loc)
 	log.Println(response)
 	c.JSON(http.StatusOK, response)
 	return nil
 }
 
+// filterAIContext keeps the events of calendars the user wants the assistant
+// to know about. Of accounts without settings only the default calendar is
+// loaded anyway.
+func filterAIContext(events []*Event, settings []CalendarSetting) []*Event {
+	if len(settings) == 0 {
+		return events
+	}
+	configured := map[string]bool{}
+	ids := map[string]bool{}
+	for _, setting := range settings {
+		configured[setting.AccountID] = true
+		if setting.AIContext {
+			ids[setting.AccountID+"/"+setting.CalendarID] = true
+		}
+	}
+	var arr []*Event
+	for _, event := range events {
+		if !configured[event.AccountID] || ids[event.AccountID+"/"+event.CalendarID] {
+			arr = append(arr, event)
+		}
+	}
+	return arr
+}
+
+func GetCalendars(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	type calendarResponse struct {
+		CalendarInfo
+		Enabled   bool `json:"enabled"`
+		AIContext bool `json:"aiContext"`
+	}
+
+	multi, ok := service.(MultiCalendar)
+	if !ok {
+		// Local and CalDAV accounts have a single calendar
+		c.JSON(http.StatusOK, gin.H{"items": []calendarResponse{{
+			CalendarInfo: CalendarInfo{Name: "Calendar", Primary: true},
+			Enabled:      true,
+			AIContext:    true,
+		}}})
+		return nil
+	}
+
+	calendars, err := multi.ListCalendars()
+	if err != nil {
+		return err
+	}
+	configured := map[string]bool{}
+	settings := map[string]CalendarSetting{}
+	for _, setting := range getCalendarSettings(user.ID) {
+		configured[setting.AccountID] = true
+		settings[setting.AccountID+"/"+setting.CalendarID] = setting
+	}
+
+	items := []calendarResponse{}
+	for _, calendar := range calendars {
+		item := calendarResponse{CalendarInfo: calendar}
+		if setting, ok := settings[calendar.AccountID+"/"+calendar.ID]; ok {
+			item.Enabled = setting.Enabled
+			item.AIContext = setting.AIContext
+		} else if !configured[calendar.AccountID] {
+			item.Enabled = calendar.Primary
+			item.AIContext = calendar.Primary
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+	return nil
+}
+
+func SetCalendars(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	if _, ok := service.(MultiCalendar); !ok {
+		return fmt.Errorf("calendar does not support multiple calendars")
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Calendars []struct {
+			// Empty for accounts with a single calendar
+			ID        string `json:"id"`
+			AccountID string `json:"accountId"`
+			Enabled   bool   `json:"enabled"`
+			AIContext bool   `json:"aiContext"`
+		} `json:"calendars" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	var settings []CalendarSetting
+	tx := db.Begin()
+	if err := tx.Where("user_id = ?", user.ID).Delete(&CalendarSetting{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, calendar := range json.Calendars {
+		setting := CalendarSetting{
+			UserID:     user.ID,
+			AccountID:  calendar.AccountID,
+			CalendarID: calendar.ID,
+			Enabled:    calendar.Enabled,
+			AIContext:  calendar.AIContext,
+		}
+		if err := tx.Create(&setting).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		settings = append(settings, setting)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	applyCalendarSettings(service, settings)
+	// The assistant was given events of the old selection
+	forgetSession(token)
+
+	c.JSON(http.StatusOK, gin.H{"status": "saved"})
+	return nil
+}
+
+// formatInLocation shows an event time in the user's zone, so that all
+// times given to the assistant share one offset
+func formatInLocation(value string, loc *time.Location) string {
+	if isDateOnly(value) {
+		return value
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+func GetTimeZone(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"timeZone": user.TimeZone})
+	return nil
+}
+
+func SetTimeZone(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		TimeZone string `json:"timeZone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	loc, err := LoadTimeZone(json.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %s", json.TimeZone)
+	}
+
+	if err := db.Model(user).Update("time_zone", loc.String()).Error; err != nil {
+		return err
+	}
+	// The assistant was told the old zone
+	forgetSession(token)
+
+	c.JSON(http.StatusOK, gin.H{"timeZone": loc.String()})
+	return nil
+}
+
 func GetEmail(c *gin.Context) error {
 
 	token, _ := c.Cookie("token")
@@ -278,9 +1016,10 @@ func GetEmail(c *gin.Context) error {
 		return err
 	}
 
-	oauthToken := &oauth2.Token{}
-	json.Unmarshal(user.CalenderToken, oauthToken)
-	service := NewGoogleMail(oauthToken)
+	service, err := newProviderEmailClient(user)
+	if err != nil {
+		return err
+	}
 	emails := service.GetEmails(time.Now().AddDate(0, 0, -2), time.Now(), user.ProviderID)
 	c.JSON(http.StatusOK, gin.H{"items": emails})
 	return nil
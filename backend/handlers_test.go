@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestSetTimeZoneForgetsTheSession(t *testing.T) {
+	useFakeDatabase(t, map[string][]map[string]driver.Value{
+		"users": {{"id": int64(1), "email": "ada@example.com", "time_zone": "UTC"}},
+	})
+	previousKey := jwtKey
+	jwtKey = []byte("test key")
+	t.Cleanup(func() { jwtKey = previousKey })
+	previousSessions := conversationsCache
+	conversationsCache = map[string]*genai.ChatSession{}
+	t.Cleanup(func() { conversationsCache = previousSessions })
+
+	token, err := GenerateJWT("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeSession(token, &genai.ChatSession{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/timezone", HandleError(SetTimeZone))
+	req := httptest.NewRequest(http.MethodPost, "/timezone", strings.NewReader(`{"timeZone":"Europe/Berlin"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetTimeZone() didn't return")
+	}
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if session := cachedSession(token); session != nil {
+		t.Error("the assistant still has the session from before the change")
+	}
+	// The caches are usable again afterwards
+	storeSession(token, &genai.ChatSession{})
+	if cachedSession(token) == nil {
+		t.Error("storing a session after the change failed")
+	}
+}
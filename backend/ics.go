@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	icsTimeLayout      = "20060102T150405Z"
+	icsLocalTimeLayout = "20060102T150405"
+	// Largest calendar file that can be imported
+	maxICSSize = 10 << 20
+)
+
+func escapeICSText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\r", `\n`, "\n", `\n`)
+	return stripICSControls(r.Replace(s))
+}
+
+// stripICSControls drops the control characters, which would end the
+// content line a value is written to
+func stripICSControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// quoteICSParam quotes a parameter value, which can't hold quotes itself
+func quoteICSParam(s string) string {
+	return `"` + strings.ReplaceAll(stripICSControls(s), `"`, "'") + `"`
+}
+
+func unescapeICSText(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	return r.Replace(s)
+}
+
+// foldICSLine splits content lines longer than 75 octets as required by RFC 5545.
+func foldICSLine(line string) string {
+	if len(line) <= 75 {
+		return line + "\r\n"
+	}
+	var b strings.Builder
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && !utf8Start(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
+
+func utf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// writeICSTime writes a DTSTART/DTEND style property, keeping the event's
+// zone as TZID when there is one so that recurrences expand correctly
+func writeICSTime(b *strings.Builder, name, value string, loc *time.Location) error {
+	t, err := parseEventTime(value)
+	if err != nil {
+		return err
+	}
+	if isDateOnly(value) {
+		b.WriteString(name + ";VALUE=DATE:" + t.Format("20060102") + "\r\n")
+		return nil
+	}
+	if loc == nil {
+		b.WriteString(name + ":" + t.UTC().Format(icsTimeLayout) + "\r\n")
+		return nil
+	}
+	b.WriteString(name + ";TZID=" + loc.String() + ":" + t.In(loc).Format(icsLocalTimeLayout) + "\r\n")
+	return nil
+}
+
+func eventLocation(event Event) *time.Location {
+	if event.TimeZone == "" {
+		return nil
+	}
+	loc, err := LoadTimeZone(event.TimeZone)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+func writeICSEvent(b *strings.Builder, event Event) error {
+	loc := eventLocation(event)
+
+	b.WriteString("BEGIN:VEVENT\r\n")
+	if event.RecurringEventID != "" && event.OriginalStartTime != "" {
+		b.WriteString(foldICSLine("UID:" + event.RecurringEventID))
+		if err := writeICSTime(b, "RECURRENCE-ID", event.OriginalStartTime, loc); err != nil {
+			return err
+		}
+	} else {
+		b.WriteString(foldICSLine("UID:" + event.ID))
+	}
+	b.WriteString("DTSTAMP:" + time.Now().UTC().Format(icsTimeLayout) + "\r\n")
+	if err := writeICSTime(b, "DTSTART", event.StartTime, loc); err != nil {
+		return err
+	}
+	if err := writeICSTime(b, "DTEND", event.EndTime, loc); err != nil {
+		return err
+	}
+	b.WriteString(foldICSLine("SUMMARY:" + escapeICSText(event.Title)))
+	for _, line := range icsDetailLines(event) {
+		b.WriteString(foldICSLine(line))
+	}
+	for _, rule := range event.Recurrence {
+		b.WriteString(foldICSLine(rule))
+	}
+	b.WriteString("END:VEVENT\r\n")
+	return nil
+}
+
+var icsPartStats = map[string]string{
+	StatusNeedsAction: "NEEDS-ACTION",
+	StatusAccepted:    "ACCEPTED",
+	StatusDeclined:    "DECLINED",
+	StatusTentative:   "TENTATIVE",
+}
+
+// icsDetailLines returns the LOCATION, DESCRIPTION, CONFERENCE and ATTENDEE
+// lines for the fields of event that are set
+func icsDetailLines(event Event) []string {
+	var lines []string
+	if event.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICSText(event.Location))
+	}
+	if event.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeICSText(event.Description))
+	}
+	if event.MeetingURL != "" {
+		lines = append(lines, "CONFERENCE;VALUE=URI;FEATURE=VIDEO:"+stripICSControls(event.MeetingURL))
+	}
+	for _, attendee := range event.Attendees {
+		line := "ATTENDEE"
+		if attendee.Name != "" {
+			line += ";CN=" + quoteICSParam(attendee.Name)
+		}
+		if partStat, ok := icsPartStats[attendee.Status]; ok {
+			line += ";PARTSTAT=" + partStat
+		}
+		lines = append(lines, line+":mailto:"+stripICSControls(attendee.Email))
+	}
+	return lines
+}
+
+func parseICSAttendee(prop icsProperty) Attendee {
+	attendee := Attendee{
+		Email:  prop.Value,
+		Name:   prop.Params["CN"],
+		Status: StatusNeedsAction,
+	}
+	if len(attendee.Email) > 7 && strings.EqualFold(attendee.Email[:7], "mailto:") {
+		attendee.Email = attendee.Email[7:]
+	}
+	for status, partStat := range icsPartStats {
+		if strings.EqualFold(prop.Params["PARTSTAT"], partStat) {
+			attendee.Status = status
+		}
+	}
+	return attendee
+}
+
+// writeVTimezone describes loc between the given years. Go does not expose
+// the rules of a zone, so every transition is written as its own observance.
+func writeVTimezone(b *strings.Builder, loc *time.Location, fromYear, toYear int) {
+	b.WriteString("BEGIN:VTIMEZONE\r\n")
+	b.WriteString("TZID:" + loc.String() + "\r\n")
+
+	writeObservance := func(at time.Time, offsetFrom int) {
+		kind := "STANDARD"
+		if at.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		name, offsetTo := at.Zone()
+		b.WriteString("BEGIN:" + kind + "\r\n")
+		b.WriteString("DTSTART:" + at.In(time.FixedZone("", offsetFrom)).Format(icsLocalTimeLayout) + "\r\n")
+		b.WriteString("TZOFFSETFROM:" + formatICSOffset(offsetFrom) + "\r\n")
+		b.WriteString("TZOFFSETTO:" + formatICSOffset(offsetTo) + "\r\n")
+		b.WriteString("TZNAME:" + name + "\r\n")
+		b.WriteString("END:" + kind + "\r\n")
+	}
+
+	current := time.Date(fromYear, 1, 1, 0, 0, 0, 0, loc)
+	_, offset := current.Zone()
+	writeObservance(current, offset)
+
+	last := time.Date(toYear+1, 1, 1, 0, 0, 0, 0, loc)
+	for t := current.Add(time.Hour); t.Before(last); t = t.Add(time.Hour) {
+		_, next := t.Zone()
+		if next == offset {
+			continue
+		}
+		// Transitions don't always happen on the hour
+		at := t.Add(-time.Hour)
+		for {
+			if _, o := at.Zone(); o != offset {
+				break
+			}
+			at = at.Add(time.Minute)
+		}
+		writeObservance(at, offset)
+		offset = next
+	}
+
+	b.WriteString("END:VTIMEZONE\r\n")
+}
+
+func formatICSOffset(seconds int) string {
+	sign := '+'
+	if seconds < 0 {
+		sign = '-'
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%c%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+func EventsToICS(events []*Event) (string, error) {
+	type yearRange struct {
+		loc      *time.Location
+		from, to int
+	}
+	zones := map[string]*yearRange{}
+	var zoneOrder []string
+	for _, event := range events {
+		loc := eventLocation(*event)
+		if loc == nil || event.AllDay {
+			continue
+		}
+		start, err := parseEventTime(event.StartTime)
+		if err != nil {
+			return "", err
+		}
+		year := start.In(loc).Year()
+		lastYear := year
+		if len(event.Recurrence) > 0 {
+			// Cover a reasonable part of the series as well
+			lastYear += 10
+		}
+		z, ok := zones[loc.String()]
+		if !ok {
+			zones[loc.String()] = &yearRange{loc: loc, from: year, to: lastYear}
+			zoneOrder = append(zoneOrder, loc.String())
+			continue
+		}
+		z.from = min(z.from, year)
+		z.to = max(z.to, lastYear)
+	}
+
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\n")
+	b.WriteString("VERSION:2.0\r\n")
+	b.WriteString("PRODID:-//PersonalAssistantAI//Calendar//EN\r\n")
+	for _, name := range zoneOrder {
+		z := zones[name]
+		writeVTimezone(&b, z.loc, z.from, z.to)
+	}
+	for _, event := range events {
+		if err := writeICSEvent(&b, *event); err != nil {
+			return "", err
+		}
+	}
+	b.WriteString("END:VCALENDAR\r\n")
+	return b.String(), nil
+}
+
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// unfoldICS joins continuation lines and returns the logical content lines.
+func unfoldICS(data string) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseICSProperty(line string) icsProperty {
+	prop := icsProperty{Params: map[string]string{}}
+	nameEnd := strings.IndexAny(line, ";:")
+	if nameEnd < 0 {
+		prop.Name = strings.ToUpper(line)
+		return prop
+	}
+	prop.Name = strings.ToUpper(line[:nameEnd])
+	rest := line[nameEnd:]
+	inQuotes := false
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ':':
+			if !inQuotes {
+				for _, param := range strings.Split(rest[:i], ";")[1:] {
+					if k, v, ok := strings.Cut(param, "="); ok {
+						prop.Params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+					}
+				}
+				prop.Value = rest[i+1:]
+				return prop
+			}
+		}
+	}
+	return prop
+}
+
+// parseICSTime returns the time as RFC 3339, or as a date for date values,
+// and the IANA zone it was given in, if any
+// parseICSTime reads a DTSTART style property. Floating times, and those of
+// zones that aren't known, are read in loc.
+func parseICSTime(prop icsProperty, loc *time.Location) (string, string, error) {
+	value := prop.Value
+	if prop.Params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return "", "", err
+		}
+		return t.Format(dateLayout), "", nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsTimeLayout, value)
+		if err != nil {
+			return "", "", err
+		}
+		return t.Format(time.RFC3339), "", nil
+	}
+
+	zone := ""
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		// Outlook exports use Windows zone names
+		if l, err := LoadTimeZone(tzid); err == nil {
+			loc = l
+		}
+		zone = loc.String()
+	}
+	t, err := time.ParseInLocation(icsLocalTimeLayout, value, loc)
+	if err != nil {
+		return "", "", err
+	}
+	return t.Format(time.RFC3339), zone, nil
+}
+
+// icsDuration is a DURATION value, whose days and weeks are nominal: they
+// keep the time of day when the clocks change
+type icsDuration struct {
+	days int
+	time time.Duration
+}
+
+func parseICSDuration(value string) (icsDuration, error) {
+	var d icsDuration
+	s := value
+	sign := 1
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || len(s) == 1 {
+		return d, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			if inTime || len(s) == 1 {
+				return d, fmt.Errorf("invalid duration %q", value)
+			}
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) || i > 6 {
+			return d, fmt.Errorf("invalid duration %q", value)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		unit := s[i]
+		switch {
+		case unit == 'W' && !inTime:
+			d.days += 7 * n
+		case unit == 'D' && !inTime:
+			d.days += n
+		case unit == 'H' && inTime:
+			d.time += time.Duration(n) * time.Hour
+		case unit == 'M' && inTime:
+			d.time += time.Duration(n) * time.Minute
+		case unit == 'S' && inTime:
+			d.time += time.Duration(n) * time.Second
+		default:
+			return d, fmt.Errorf("invalid duration %q", value)
+		}
+		s = s[i+1:]
+	}
+	d.days *= sign
+	d.time *= time.Duration(sign)
+	return d, nil
+}
+
+// addICSDuration returns the end of an event lasting d from start, adding
+// days in the zone of the event
+func addICSDuration(event *Event, d icsDuration) (string, error) {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return "", err
+	}
+	if event.AllDay {
+		// Dates only move by whole days
+		return start.AddDate(0, 0, d.days).Format(dateLayout), nil
+	}
+	if loc := eventLocation(*event); loc != nil {
+		start = start.In(loc)
+	}
+	return start.AddDate(0, 0, d.days).Add(d.time).Format(time.RFC3339), nil
+}
+
+// ParseICS reads the events of a calendar file. Times without a known zone
+// are read in loc.
+func ParseICS(data string, loc *time.Location) ([]*Event, error) {
+	var events []*Event
+	var current *Event
+	var duration *icsDuration
+	depth := 0
+
+	for _, line := range unfoldICS(data) {
+		prop := parseICSProperty(line)
+		switch prop.Name {
+		case "BEGIN":
+			if current != nil {
+				depth++
+			} else if strings.EqualFold(prop.Value, "VEVENT") {
+				current = &Event{}
+			}
+			continue
+		case "END":
+			if current == nil {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if current.EndTime == "" && duration != nil {
+				end, err := addICSDuration(current, *duration)
+				if err != nil {
+					return nil, err
+				}
+				current.EndTime = end
+			}
+			if current.EndTime == "" {
+				current.EndTime = current.StartTime
+				if current.AllDay {
+					// A date without DTEND lasts for that day
+					start, _ := parseEventTime(current.StartTime)
+					current.EndTime = start.AddDate(0, 0, 1).Format(dateLayout)
+				}
+			}
+			if current.OriginalStartTime != "" {
+				// A modified or expanded occurrence of a recurring event
+				original, _ := parseEventTime(current.OriginalStartTime)
+				current.RecurringEventID = current.ID
+				current.ID = recurrenceInstanceID(current.ID, original)
+			}
+			events = append(events, current)
+			current = nil
+			duration = nil
+			continue
+		}
+
+		// Properties of nested components such as VALARM are ignored
+		if current == nil || depth > 0 {
+			continue
+		}
+
+		switch prop.Name {
+		case "UID":
+			current.ID = prop.Value
+		case "SUMMARY":
+			current.Title = unescapeICSText(prop.Value)
+		case "LOCATION":
+			current.Location = unescapeICSText(prop.Value)
+		case "DESCRIPTION":
+			current.Description = unescapeICSText(prop.Value)
+		case "ATTENDEE":
+			current.Attendees = append(current.Attendees, parseICSAttendee(prop))
+		case "CONFERENCE", "X-GOOGLE-CONFERENCE", "X-MICROSOFT-SKYPETEAMSMEETINGURL":
+			if current.MeetingURL == "" {
+				current.MeetingURL = prop.Value
+			}
+		case "DTSTART":
+			t, zone, err := parseICSTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DTSTART %q: %w", prop.Value, err)
+			}
+			current.StartTime = t
+			current.TimeZone = zone
+			current.AllDay = isDateOnly(t)
+		case "DTEND":
+			t, _, err := parseICSTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DTEND %q: %w", prop.Value, err)
+			}
+			current.EndTime = t
+		case "DURATION":
+			d, err := parseICSDuration(prop.Value)
+			if err != nil {
+				return nil, err
+			}
+			duration = &d
+		case "RECURRENCE-ID":
+			t, _, err := parseICSTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RECURRENCE-ID %q: %w", prop.Value, err)
+			}
+			current.OriginalStartTime = t
+		case "RRULE", "EXDATE", "RDATE":
+			current.Recurrence = append(current.Recurrence, line)
+		}
+	}
+
+	if current != nil {
+		return nil, fmt.Errorf("unterminated VEVENT")
+	}
+	return events, nil
+}
+
+// rewriteICSEvents passes every VEVENT of data, as unfolded lines from
+// BEGIN to END, to fn and writes whatever blocks fn returns in its place
+func rewriteICSEvents(data string, fn func(block []string) ([][]string, error)) (string, error) {
+	var out strings.Builder
+	var block []string
+	inEvent := false
+
+	for _, line := range unfoldICS(data) {
+		prop := parseICSProperty(line)
+		if !inEvent {
+			if prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") {
+				inEvent = true
+				block = []string{line}
+				continue
+			}
+			out.WriteString(foldICSLine(line))
+			continue
+		}
+
+		block = append(block, line)
+		if prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT") {
+			inEvent = false
+			blocks, err := fn(block)
+			if err != nil {
+				return "", err
+			}
+			for _, b := range blocks {
+				for _, l := range b {
+					out.WriteString(foldICSLine(l))
+				}
+			}
+		}
+	}
+	return out.String(), nil
+}
+
+// icsRecurrenceID returns the RECURRENCE-ID of a VEVENT block, or the zero
+// time for the master event of a series
+func icsRecurrenceID(block []string) (time.Time, error) {
+	for _, line := range block {
+		prop := parseICSProperty(line)
+		if prop.Name != "RECURRENCE-ID" {
+			continue
+		}
+		t, _, err := parseICSTime(prop, time.UTC)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return parseEventTime(t)
+	}
+	return time.Time{}, nil
+}
+
+// ExcludeICSOccurrence adds an EXDATE for the occurrence starting at
+// originalStart to the recurring event in data and drops any modified
+// version of that occurrence.
+func ExcludeICSOccurrence(data, originalStart string) (string, error) {
+	original, err := parseEventTime(originalStart)
+	if err != nil {
+		return "", err
+	}
+	exdate, err := exceptionDateLine(originalStart)
+	if err != nil {
+		return "", err
+	}
+
+	return rewriteICSEvents(data, func(block []string) ([][]string, error) {
+		recurrenceID, err := icsRecurrenceID(block)
+		if err != nil {
+			return nil, err
+		}
+		if recurrenceID.IsZero() {
+			block = append(block[:len(block)-1:len(block)-1], exdate, block[len(block)-1])
+			return [][]string{block}, nil
+		}
+		if recurrenceID.Equal(original) {
+			return nil, nil
+		}
+		return [][]string{block}, nil
+	})
+}
+
+// applyICSChanges replaces the properties of a VEVENT block that are set in
+// changes and keeps everything else, like attendees or alarms, untouched
+func applyICSChanges(block []string, changes Event) ([]string, error) {
+	replaced := map[string]bool{}
+	var props []string
+	add := func(name, line string) {
+		replaced[name] = true
+		props = append(props, line)
+	}
+
+	loc := eventLocation(changes)
+	if changes.Title != "" {
+		add("SUMMARY", "SUMMARY:"+escapeICSText(changes.Title))
+	}
+	if changes.StartTime != "" {
+		var b strings.Builder
+		if err := writeICSTime(&b, "DTSTART", changes.StartTime, loc); err != nil {
+			return nil, err
+		}
+		add("DTSTART", strings.TrimSuffix(b.String(), "\r\n"))
+	}
+	if changes.EndTime != "" {
+		var b strings.Builder
+		if err := writeICSTime(&b, "DTEND", changes.EndTime, loc); err != nil {
+			return nil, err
+		}
+		add("DTEND", strings.TrimSuffix(b.String(), "\r\n"))
+		replaced["DURATION"] = true
+	}
+	for _, line := range icsDetailLines(changes) {
+		add(parseICSProperty(line).Name, line)
+	}
+	if changes.Attendees != nil {
+		// An empty list removes every attendee
+		replaced["ATTENDEE"] = true
+	}
+	if changes.Recurrence != nil {
+		replaced["RRULE"] = true
+		replaced["EXDATE"] = true
+		replaced["RDATE"] = true
+		props = append(props, changes.Recurrence...)
+	}
+
+	result := []string{block[0]}
+	depth := 0
+	for _, line := range block[1 : len(block)-1] {
+		prop := parseICSProperty(line)
+		switch prop.Name {
+		case "BEGIN":
+			depth++
+		case "END":
+			depth--
+		}
+		if depth == 0 && replaced[prop.Name] {
+			continue
+		}
+		result = append(result, line)
+	}
+	result = append(result, props...)
+	return append(result, block[len(block)-1]), nil
+}
+
+// UpdateICSEvent applies changes to the event in data. With an
+// originalStart only that occurrence of a series is changed, adding an
+// overriding VEVENT when the occurrence wasn't modified before.
+func UpdateICSEvent(data string, changes Event, originalStart string) (string, error) {
+	var original time.Time
+	if originalStart != "" {
+		t, err := parseEventTime(originalStart)
+		if err != nil {
+			return "", err
+		}
+		original = t
+	}
+
+	found := false
+	var master []string
+	updated, err := rewriteICSEvents(data, func(block []string) ([][]string, error) {
+		recurrenceID, err := icsRecurrenceID(block)
+		if err != nil {
+			return nil, err
+		}
+		if recurrenceID.IsZero() {
+			master = block
+		}
+		if !recurrenceID.Equal(original) {
+			return [][]string{block}, nil
+		}
+		found = true
+		block, err = applyICSChanges(block, changes)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{block}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return updated, nil
+	}
+	if original.IsZero() || master == nil {
+		return "", fmt.Errorf("event not found")
+	}
+
+	if changes.StartTime == "" || changes.EndTime == "" {
+		// Keep the occurrence's own times when only other fields change
+		masterEvents, err := ParseICS("BEGIN:VCALENDAR\r\n" + strings.Join(master, "\r\n") + "\r\nEND:VCALENDAR\r\n", time.UTC)
+		if err != nil || len(masterEvents) != 1 {
+			return "", fmt.Errorf("invalid recurring event")
+		}
+		start, _ := parseEventTime(masterEvents[0].StartTime)
+		end, _ := parseEventTime(masterEvents[0].EndTime)
+		if changes.StartTime == "" {
+			changes.StartTime = originalStart
+		}
+		if changes.EndTime == "" {
+			newStart, _ := parseEventTime(changes.StartTime)
+			changes.EndTime = formatEventTime(newStart.Add(end.Sub(start)), isDateOnly(changes.StartTime))
+		}
+	}
+
+	// Derive the override from the master, without its recurrence
+	override := []string{master[0]}
+	var b strings.Builder
+	writeICSTime(&b, "RECURRENCE-ID", originalStart, eventLocation(changes))
+	override = append(override, strings.TrimSuffix(b.String(), "\r\n"))
+	for _, line := range master[1 : len(master)-1] {
+		switch parseICSProperty(line).Name {
+		case "RRULE", "EXDATE", "RDATE":
+			continue
+		}
+		override = append(override, line)
+	}
+	override = append(override, master[len(master)-1])
+	override, err = applyICSChanges(override, changes)
+	if err != nil {
+		return "", err
+	}
+
+	var overrideText strings.Builder
+	for _, l := range override {
+		overrideText.WriteString(foldICSLine(l))
+	}
+	end := strings.LastIndex(updated, "END:VCALENDAR")
+	if end < 0 {
+		return "", fmt.Errorf("invalid calendar data")
+	}
+	return updated[:end] + overrideText.String() + updated[end:], nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseICSDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    icsDuration
+		wantErr bool
+	}{
+		{value: "PT1H30M", want: icsDuration{time: 90 * time.Minute}},
+		{value: "PT45S", want: icsDuration{time: 45 * time.Second}},
+		{value: "P1D", want: icsDuration{days: 1}},
+		{value: "P2W", want: icsDuration{days: 14}},
+		{value: "P1DT12H", want: icsDuration{days: 1, time: 12 * time.Hour}},
+		{value: "+PT15M", want: icsDuration{time: 15 * time.Minute}},
+		{value: "-P1DT1H", want: icsDuration{days: -1, time: -time.Hour}},
+		{value: "", wantErr: true},
+		{value: "P", wantErr: true},
+		{value: "PT", wantErr: true},
+		{value: "1H", wantErr: true},
+		{value: "P1H", wantErr: true},
+		{value: "PT1D", wantErr: true},
+		{value: "PT1H2", wantErr: true},
+		{value: "PTT1H", wantErr: true},
+		{value: "P9999999D", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseICSDuration(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseICSDuration(%q) = %+v, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseICSDuration(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICSEventDuration(t *testing.T) {
+	ics := func(lines string) string {
+		return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:a\r\nSUMMARY:Event\r\n" + lines + "END:VEVENT\r\nEND:VCALENDAR\r\n"
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantEnd string
+	}{
+		{
+			name:    "duration",
+			data:    ics("DTSTART:20240108T090000Z\r\nDURATION:PT1H30M\r\n"),
+			wantEnd: "2024-01-08T10:30:00Z",
+		},
+		{
+			name:    "duration before the start",
+			data:    ics("DURATION:PT30M\r\nDTSTART:20240108T090000Z\r\n"),
+			wantEnd: "2024-01-08T09:30:00Z",
+		},
+		{
+			name:    "days keep the time across the clock change",
+			data:    ics("DTSTART;TZID=Europe/Berlin:20240330T090000\r\nDURATION:P1D\r\n"),
+			wantEnd: "2024-03-31T09:00:00+02:00",
+		},
+		{
+			name:    "all-day",
+			data:    ics("DTSTART;VALUE=DATE:20240108\r\nDURATION:P2D\r\n"),
+			wantEnd: "2024-01-10",
+		},
+		{
+			name:    "end wins over duration",
+			data:    ics("DTSTART:20240108T090000Z\r\nDTEND:20240108T093000Z\r\nDURATION:PT2H\r\n"),
+			wantEnd: "2024-01-08T09:30:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := ParseICS(tt.data, time.UTC)
+			if err != nil {
+				t.Fatalf("ParseICS(): %v", err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("ParseICS() = %d events, want 1", len(events))
+			}
+			if events[0].EndTime != tt.wantEnd {
+				t.Errorf("EndTime = %q, want %q", events[0].EndTime, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestEventsToICSEscapesValues(t *testing.T) {
+	event := &Event{
+		ID:          "a",
+		Title:       "Call\r\nBEGIN:VEVENT",
+		StartTime:   "2024-01-08T09:00:00Z",
+		EndTime:     "2024-01-08T10:00:00Z",
+		Location:    "Room 1; floor 2\rEND:VEVENT",
+		Description: "Agenda:\n1, 2\\3",
+		Attendees: []Attendee{
+			{Email: "ada@example.com", Name: "Ada \"the\" Guest\r\nATTENDEE:mailto:eve@example.com"},
+		},
+	}
+	data, err := EventsToICS([]*Event{event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Line breaks in values mustn't start lines of their own
+	properties := map[string]int{}
+	for _, line := range unfoldICS(data) {
+		properties[line]++
+		properties[parseICSProperty(line).Name]++
+	}
+	if properties["BEGIN:VEVENT"] != 1 || properties["END:VEVENT"] != 1 || properties["ATTENDEE"] != 1 {
+		t.Errorf("injected lines in %q", data)
+	}
+
+	events, err := ParseICS(data, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("ParseICS() = %d events, want 1", len(events))
+	}
+	got := events[0]
+	if got.Title != "Call\nBEGIN:VEVENT" {
+		t.Errorf("Title = %q", got.Title)
+	}
+	if got.Location != "Room 1; floor 2\nEND:VEVENT" {
+		t.Errorf("Location = %q", got.Location)
+	}
+	if got.Description != event.Description {
+		t.Errorf("Description = %q, want %q", got.Description, event.Description)
+	}
+	if len(got.Attendees) != 1 || got.Attendees[0].Email != "ada@example.com" {
+		t.Errorf("Attendees = %+v, want only ada@example.com", got.Attendees)
+	}
+}
+
+func TestParseICSZones(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		dtstart   string
+		wantStart string
+		wantZone  string
+	}{
+		{name: "UTC", dtstart: "DTSTART:20240108T090000Z", wantStart: "2024-01-08T09:00:00Z"},
+		{name: "known zone", dtstart: "DTSTART;TZID=America/New_York:20240108T090000", wantStart: "2024-01-08T09:00:00-05:00", wantZone: "America/New_York"},
+		{name: "Windows zone", dtstart: "DTSTART;TZID=W. Europe Standard Time:20240108T090000", wantStart: "2024-01-08T09:00:00+01:00", wantZone: "Europe/Berlin"},
+		{name: "unknown zone", dtstart: "DTSTART;TZID=Mars/Olympus_Mons:20240708T090000", wantStart: "2024-07-08T09:00:00+02:00", wantZone: "Europe/Berlin"},
+		{name: "floating", dtstart: "DTSTART:20240108T090000", wantStart: "2024-01-08T09:00:00+01:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\n" + tt.dtstart + "\r\nDURATION:PT1H\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+			events, err := ParseICS(data, berlin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("ParseICS() = %d events, want 1", len(events))
+			}
+			if events[0].StartTime != tt.wantStart || events[0].TimeZone != tt.wantZone {
+				t.Errorf("start = %q in %q, want %q in %q", events[0].StartTime, events[0].TimeZone, tt.wantStart, tt.wantZone)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -48,7 +50,7 @@ func GetGeminiClient(config config.Config) *genai.Client {
 	return client
 }
 
-func StartChatSession(client *genai.Client, startPrompt string, plan string) *genai.ChatSession {
+func StartChatSession(client *genai.Client, startPrompt string, preferences string, tasks string, plan string, loc *time.Location) *genai.ChatSession {
 	var model *genai.GenerativeModel
 	if plan == Premium {
 		model = client.GenerativeModel("gemini-1.5-pro")
@@ -61,8 +63,9 @@ func StartChatSession(client *genai.Client, startPrompt string, plan string) *ge
 
 	model.SetTemperature(0.7)
 
-	year, month, day := time.Now().Date()
+	year, month, day := time.Now().In(loc).Date()
 	now := fmt.Sprintf("%02d.%02d.%d", day, month, year)
+	_, offset := time.Now().In(loc).Zone()
 	model.ResponseMIMEType = "application/json"
 
 	model.SystemInstruction = &genai.Content{
@@ -71,36 +74,64 @@ func StartChatSession(client *genai.Client, startPrompt string, plan string) *ge
 				`You are a professional calendar management assistant with direct access to modify the calendar. Your responses should always be in valid JSON format.
 
 Current date: ` + now + `
+User time zone: ` + loc.String() + ` (UTC` + formatICSOffset(offset) + `)
+Scheduling preferences of the user:
+` + preferences + `
 Current calendar events: ` + startPrompt + `
+Open tasks of the user: ` + tasks + `
 
 Guidelines for interactions:
 1. Always respond with a JSON object containing:
    {
      "understood": boolean,     // Whether you understood the request
-     "action": string,         // The action being taken (e.g. "add_event", "remove_event", "reschedule", "info")
+     "action": string,         // The action being taken (e.g. "add_event", "remove_event", "reschedule", "update_event", "search_events", "analyze_time", "add_task", "complete_task", "plan_tasks", "info")
      "details": {              // Details of the action
        "title": string,        // Event title if applicable
        "startTime": string,    // Start time if applicable
        "endTime": string,      // End time if applicable
+       "allDay": boolean,      // For all-day or multi-day events without times - startTime and endTime are dates (YYYY-MM-DD), endTime is the day after the last day
        "originalStart": string, // For reschedule - original start time
        "originalEnd": string,   // For reschedule - original end time
        "newStart": string,     // For reschedule - new start time
-       "newEnd": string        // For reschedule - new end time
+       "newEnd": string,       // For reschedule - new end time
+       "recurrence": [string], // For repeating events - iCalendar rules, e.g. ["RRULE:FREQ=WEEKLY;BYDAY=TU"]
+       "scope": string,        // For occurrences of repeating events - "this" or "series"
+       "location": string,     // Where the event takes place
+       "description": string,  // Notes or agenda
+       "attendees": [{"email": string, "name": string}], // Everyone invited, including people already invited
+       "onlineMeeting": boolean, // Whether to set up a video call link
+       "query": string,        // For search_events - words to look for in titles, descriptions and locations
+       "attendee": string,     // For search_events - name or email address of someone invited
+       "taskId": string,       // For complete_task - id of the open task
+       "listId": string,       // For complete_task - listId of the open task, if it has one
+       "due": string,          // For add_task - date (YYYY-MM-DD) the task is due, if any
+       "notes": string,        // For add_task - notes on the task
+       "tasks": [{"taskId": string, "listId": string, "title": string, "minutes": number, "due": string, "priority": string}] // For plan_tasks - tasks to block time for, with the minutes of work left, due date (YYYY-MM-DD) and priority ("high", "normal" or "low")
      },
      "message": string,        // Human readable explanation
      "suggestions": [string],  // Array of suggestions/optimizations
-     "conflicts": [string]     // Array of potential conflicts
+     "conflicts": [string]     // Array of potential conflicts, checked against the calendar before the user sees them
    }
 
 2. For calendar modifications:
    - Add event: Set action="add_event" and include title, startTime, endTime
    - Remove event: Set action="remove_event" and include title, startTime, endTime
    - Reschedule: Set action="reschedule" and include all time fields
+   - Change location, description, attendees or add a video call: Set action="update_event" and include title, originalStart and the changed fields. Ask for email addresses of people you don't know
+   - All-day events (holidays, out of office, trips): set allDay=true and use dates. Events marked "(all day)" block the whole day
+   - Repeating events: include the recurrence rules, and ask whether a change applies to one occurrence or the whole series
+   - Questions about events that aren't listed above, like when the user last met someone: Set action="search_events" with query and/or attendee, and startTime and endTime to limit the search. The results are sent to you, and you then answer with action="info"
+   - To-dos without a fixed time, like "remember to send the report by Friday": Set action="add_task" with title and, if given, due and notes
+   - Tasks the user has done: Set action="complete_task" with the title, taskId and listId of the open task
+   - Blocking time to work on tasks: Set action="plan_tasks" with the tasks. Estimate the minutes of work when the user doesn't say, and use the taskId and listId of open tasks. The server places the tasks into free working time, and the user approves the blocks
+   - Questions about how the user spends their time, like hours in meetings or 1:1s last month: Set action="analyze_time" with startTime and endTime. The numbers are sent to you, and you then answer with action="info"
 
-3. All times should be in ISO 8601 format
+3. All times should be in ISO 8601 format with the offset of the user's time zone
 
 4. Always validate:
-   - No scheduling conflicts
+   - No scheduling conflicts - suggest times from the free time listed above, which is computed from the calendar
+   - Meetings only during working hours, outside the lunch break and not on days without meetings, unless the user asks for it
+   - Meetings last one of the preferred lengths unless the user asks for another
    - Valid date/time formats
    - Timezone considerations
    - Calendar consistency
@@ -145,9 +176,9 @@ func UpdateSchedule(session *genai.ChatSession, event *calendar.Event, action st
 	})
 }
 
-func SendGeminiMessage(chatSession *genai.ChatSession, message string) (string, error) {
+func SendGeminiMessage(chatSession *genai.ChatSession, message string, loc *time.Location) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	message = time.Now().Format(time.RFC3339) + " : " + message
+	message = time.Now().In(loc).Format(time.RFC3339) + " : " + message
 	defer cancel()
 
 	resp, err := chatSession.SendMessage(ctx, genai.Text(message))
@@ -176,3 +207,132 @@ func formatDateTime(datetime string) string {
 	}
 	return t.Format("Mon, Jan 2 at 3:04 PM")
 }
+
+// checkAIResponse replaces the conflicts the model listed for a new or
+// moved event with the ones found in the calendar. Events that wouldn't pass
+// validation get their problems listed in errors.
+func checkAIResponse(user *User, service Calendar, response string, loc *time.Location) string {
+	var reply map[string]any
+	if err := json.Unmarshal([]byte(response), &reply); err != nil {
+		return response
+	}
+	action, _ := reply["action"].(string)
+	if action == "add_task" || action == "complete_task" {
+		return checkAITask(reply, response)
+	}
+	if action == "plan_tasks" {
+		return checkAIPlan(user, service, reply, response)
+	}
+	if action != "add_event" && action != "reschedule" {
+		return response
+	}
+	data, err := json.Marshal(reply["details"])
+	if err != nil {
+		return response
+	}
+	var details struct {
+		Title         string   `json:"title"`
+		StartTime     string   `json:"startTime"`
+		EndTime       string   `json:"endTime"`
+		AllDay        bool     `json:"allDay"`
+		Recurrence    []string `json:"recurrence"`
+		Scope         string   `json:"scope"`
+		OriginalStart string   `json:"originalStart"`
+		NewStart      string   `json:"newStart"`
+		NewEnd        string   `json:"newEnd"`
+	}
+	if err := json.Unmarshal(data, &details); err != nil {
+		return response
+	}
+
+	event := Event{
+		Title:      details.Title,
+		StartTime:  details.StartTime,
+		EndTime:    details.EndTime,
+		AllDay:     details.AllDay,
+		Recurrence: details.Recurrence,
+		Scope:      details.Scope,
+	}
+	if action == "reschedule" {
+		event.StartTime = details.NewStart
+		event.EndTime = details.NewEnd
+		event.Recurrence = nil
+		// The event keeps its place until it is moved
+		if original := findEventAt(service, details.Title, details.OriginalStart); original != nil {
+			event.ID = original.ID
+			event.AccountID = original.AccountID
+			event.RecurringEventID = original.RecurringEventID
+		}
+	}
+
+	conflicts := []string{}
+	if err := validateEvent(&event, true); err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			reply["errors"] = validation.Fields
+		}
+	} else if err := event.normalizeAllDay(); err == nil {
+		found, err := findConflicts(service, event, loc)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		conflicts = conflictMessages(found)
+	}
+	reply["conflicts"] = conflicts
+
+	checked, err := json.Marshal(reply)
+	if err != nil {
+		return response
+	}
+	return string(checked)
+}
+
+// findEventAt returns the event with the title starting at start
+func findEventAt(service Calendar, title, start string) *Event {
+	t, err := parseEventTime(start)
+	if err != nil {
+		return nil
+	}
+	events, err := service.GetEvents(t.Add(-time.Minute), t.Add(time.Minute))
+	if err != nil {
+		return nil
+	}
+	for _, event := range events {
+		eventStart, err := parseEventTime(event.StartTime)
+		if err == nil && event.Title == title && eventStart.Equal(t) {
+			return event
+		}
+	}
+	return nil
+}
+
+// Searches and analyses the assistant can run before it has to answer
+const maxAIToolCalls = 2
+
+// aiToolRequest is a reply of the assistant asking for data it wasn't given
+type aiToolRequest struct {
+	Action  string `json:"action"`
+	Details struct {
+		Query     string `json:"query"`
+		Attendee  string `json:"attendee"`
+		StartTime string `json:"startTime"`
+		EndTime   string `json:"endTime"`
+	} `json:"details"`
+}
+
+// runAITool runs what the assistant asked for. It returns the message with
+// the results, or false when the reply is an answer.
+func runAITool(user *User, service Calendar, response string, loc *time.Location) (string, bool) {
+	var request aiToolRequest
+	if err := json.Unmarshal([]byte(response), &request); err != nil {
+		return "", false
+	}
+	settings := getCalendarSettings(user.ID)
+	switch request.Action {
+	case "search_events":
+		return runAISearch(service, request, settings, loc), true
+	case "analyze_time":
+		return runAIAnalytics(user, service, request, settings), true
+	}
+	return "", false
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type LocalEvent struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null"`
+	UID       string `gorm:"index;not null"`
+	Title     string
+	StartTime time.Time `gorm:"index"`
+	EndTime   time.Time `gorm:"index"`
+	TimeZone  string
+	AllDay    bool
+	// Recurrence lines joined by newlines
+	Recurrence  string
+	Location    string
+	Description string
+	MeetingURL  string
+	Attendees   json.RawMessage `gorm:"type:jsonb"`
+}
+
+func (e *LocalEvent) toEvent() *Event {
+	start, end := e.StartTime, e.EndTime
+	if e.AllDay {
+		// Dates are stored as midnight UTC
+		start, end = start.UTC(), end.UTC()
+	}
+	event := &Event{
+		ID:          e.UID,
+		Title:       e.Title,
+		StartTime:   formatEventTime(start, e.AllDay),
+		EndTime:     formatEventTime(end, e.AllDay),
+		TimeZone:    e.TimeZone,
+		AllDay:      e.AllDay,
+		Location:    e.Location,
+		Description: e.Description,
+		MeetingURL:  e.MeetingURL,
+	}
+	if e.Recurrence != "" {
+		event.Recurrence = strings.Split(e.Recurrence, "\n")
+	}
+	if len(e.Attendees) > 0 {
+		json.Unmarshal(e.Attendees, &event.Attendees)
+	}
+	return event
+}
+
+// LocalCalendar stores events in our own database. It is used for users
+// that have not connected an external calendar.
+type LocalCalendar struct {
+	userID uint
+}
+
+func NewLocalCalendar(user User) *LocalCalendar {
+	return &LocalCalendar{
+		userID: user.ID,
+	}
+}
+
+func (c *LocalCalendar) CreateEvent(event Event) error {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return err
+	}
+	end, err := parseEventTime(event.EndTime)
+	if err != nil {
+		return err
+	}
+
+	if event.ID == "" {
+		if event.ID, err = newEventUID(); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	db.Model(&LocalEvent{}).Where("user_id = ? AND uid = ?", c.userID, event.ID).Count(&count)
+	if count > 0 {
+		return fmt.Errorf("event %s already exists", event.ID)
+	}
+
+	attendees, err := json.Marshal(event.Attendees)
+	if err != nil {
+		return err
+	}
+
+	return db.Create(&LocalEvent{
+		UserID:      c.userID,
+		UID:         event.ID,
+		Title:       event.Title,
+		StartTime:   start,
+		EndTime:     end,
+		TimeZone:    event.TimeZone,
+		AllDay:      event.AllDay,
+		Recurrence:  strings.Join(event.Recurrence, "\n"),
+		Location:    event.Location,
+		Description: event.Description,
+		MeetingURL:  event.MeetingURL,
+		Attendees:   attendees,
+	}).Error
+}
+
+func (c *LocalCalendar) findEvent(uid string) (*LocalEvent, error) {
+	localEvent := &LocalEvent{}
+	if err := db.Where("user_id = ? AND uid = ?", c.userID, uid).First(localEvent).Error; err != nil {
+		return nil, fmt.Errorf("event %s not found", uid)
+	}
+	return localEvent, nil
+}
+
+func (c *LocalCalendar) RemoveEvent(event Event) error {
+	id := event.ID
+	if event.RecurringEventID != "" {
+		id = event.RecurringEventID
+		if event.Scope != ScopeSeries {
+			master, err := c.findEvent(id)
+			if err != nil {
+				return err
+			}
+			recurrence, err := AddExceptionDate(master.toEvent().Recurrence, event.OriginalStartTime)
+			if err != nil {
+				return err
+			}
+			return db.Model(master).Update("recurrence", strings.Join(recurrence, "\n")).Error
+		}
+	}
+
+	result := db.Where("user_id = ? AND uid = ?", c.userID, id).Delete(&LocalEvent{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("event %s not found", id)
+	}
+	return nil
+}
+
+func (c *LocalCalendar) UpdateEvent(event Event) error {
+	if event.RecurringEventID != "" && event.Scope != ScopeSeries {
+		// Changing a single occurrence detaches it from its series
+		master, err := c.findEvent(event.RecurringEventID)
+		if err != nil {
+			return err
+		}
+		recurrence, err := AddExceptionDate(master.toEvent().Recurrence, event.OriginalStartTime)
+		if err != nil {
+			return err
+		}
+
+		original, err := parseEventTime(event.OriginalStartTime)
+		if err != nil {
+			return err
+		}
+		occurrence := master.toEvent()
+		occurrence.ID = ""
+		occurrence.Recurrence = nil
+		occurrence.StartTime = formatEventTime(original, master.AllDay)
+		occurrence.EndTime = formatEventTime(original.Add(master.EndTime.Sub(master.StartTime)), master.AllDay)
+		if event.Title != "" {
+			occurrence.Title = event.Title
+		}
+		if event.StartTime != "" {
+			occurrence.StartTime = event.StartTime
+			occurrence.AllDay = event.AllDay
+		}
+		if event.EndTime != "" {
+			occurrence.EndTime = event.EndTime
+		}
+		if event.Location != "" {
+			occurrence.Location = event.Location
+		}
+		if event.Description != "" {
+			occurrence.Description = event.Description
+		}
+		if event.Attendees != nil {
+			occurrence.Attendees = event.Attendees
+		}
+		if err := c.CreateEvent(*occurrence); err != nil {
+			return err
+		}
+		return db.Model(master).Update("recurrence", strings.Join(recurrence, "\n")).Error
+	}
+
+	id := event.ID
+	if event.RecurringEventID != "" {
+		id = event.RecurringEventID
+	}
+	localEvent, err := c.findEvent(id)
+	if err != nil {
+		return err
+	}
+	if event.RecurringEventID != "" {
+		if event.StartTime, event.EndTime, err = shiftSeries(localEvent.toEvent(), event); err != nil {
+			return err
+		}
+	}
+
+	updates := map[string]interface{}{}
+	if event.Title != "" {
+		updates["title"] = event.Title
+	}
+	if event.StartTime != "" {
+		start, err := parseEventTime(event.StartTime)
+		if err != nil {
+			return err
+		}
+		updates["start_time"] = start
+		updates["all_day"] = event.AllDay
+	}
+	if event.EndTime != "" {
+		end, err := parseEventTime(event.EndTime)
+		if err != nil {
+			return err
+		}
+		updates["end_time"] = end
+	}
+	if event.TimeZone != "" {
+		updates["time_zone"] = event.TimeZone
+	}
+	if event.Recurrence != nil {
+		updates["recurrence"] = strings.Join(event.Recurrence, "\n")
+	}
+	if event.Location != "" {
+		updates["location"] = event.Location
+	}
+	if event.Description != "" {
+		updates["description"] = event.Description
+	}
+	if event.Attendees != nil {
+		attendees, err := json.Marshal(event.Attendees)
+		if err != nil {
+			return err
+		}
+		updates["attendees"] = attendees
+	}
+	return db.Model(localEvent).Updates(updates).Error
+}
+
+func (c *LocalCalendar) GetSeries(id string) (*Event, error) {
+	localEvent, err := c.findEvent(id)
+	if err != nil {
+		return nil, err
+	}
+	return localEvent.toEvent(), nil
+}
+
+func (c *LocalCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	var localEvents []LocalEvent
+	// Recurring events can have occurrences long after the first one ended
+	err := db.
+		Where("user_id = ? AND start_time < ? AND (end_time > ? OR recurrence <> '')", c.userID, endTime, startTime).
+		Order("start_time").
+		Find(&localEvents).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	for i := range localEvents {
+		instances, err := ExpandRecurrence(localEvents[i].toEvent(), startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, instances...)
+	}
+	sortEventsByStart(events)
+	return events, nil
+}
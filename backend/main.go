@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/gob"
 	"net/http"
 
@@ -13,12 +14,25 @@ import (
 func main() {
 	cfg := config.LoadConfig()
 	jwtKey = []byte(cfg.JWTSecret)
+	if cfg.CredentialsKey != "" {
+		key := sha256.Sum256([]byte(cfg.CredentialsKey))
+		credentialsKey = key[:]
+	}
+	localCalendarOnly = cfg.CalendarMode == "local"
+	allowPrivateURLs = cfg.AllowPrivateURLs
 
 	InitDB(cfg)
-	InitGoogle(cfg)
+	InitProviders(cfg)
 	InitPayPal(cfg)
-	InitMicrosoft(cfg)
 	geminiClient = GetGeminiClient(cfg)
+	InitNotifiers(cfg)
+	StartReminderJob()
+	StartPolicyJob()
+	StartPlannerJob()
+	StartPollJob()
+	if cfg.WebhookURL != "" && !localCalendarOnly {
+		StartWatchJob(cfg.WebhookURL)
+	}
 
 	r := gin.Default()
 	store := cookie.NewStore([]byte(cfg.JWTSecret))
@@ -35,8 +49,42 @@ func main() {
 		api.GET("/payment", HandleError(Payment))
 		api.POST("/paypal", HandleError(CreateSubscriptionHandler))
 		api.POST("/calendar-create", HandleError(CreateEvent))
+		api.GET("/calendar-search", HandleError(SearchCalendarEvents))
+		api.GET("/analytics", HandleError(GetAnalytics))
 		api.POST("/calendar-remove", HandleError(RemoveEvent))
+		api.POST("/calendar-update", HandleError(UpdateEvent))
 		api.GET("/calendar-load", HandleError(FetchCalenderData))
+		api.GET("/tasks", HandleError(GetTasks))
+		api.POST("/task-create", HandleError(CreateTask))
+		api.POST("/task-update", HandleError(UpdateTask))
+		api.POST("/task-remove", HandleError(RemoveTask))
+		api.POST("/plan-tasks", HandleError(PlanTasks))
+		api.POST("/plan-apply", HandleError(ApplyPlan))
+		api.GET("/polls", HandleError(GetPolls))
+		api.POST("/poll-create", HandleError(CreatePoll))
+		api.POST("/poll-schedule", HandleError(SchedulePoll))
+		api.POST("/poll-remove", HandleError(RemovePoll))
+		api.GET("/booking-pages", HandleError(GetBookingPages))
+		api.POST("/booking-page-save", HandleError(SaveBookingPage))
+		api.POST("/booking-page-remove", HandleError(RemoveBookingPage))
+		api.POST("/caldav-connect", HandleError(ConnectCalDAV))
+		api.GET("/calendar-export", HandleError(ExportCalendar))
+		api.GET("/availability", HandleError(Availability))
+		api.POST("/calendar-import", HandleError(ImportCalendar))
+		api.GET("/calendars", HandleError(GetCalendars))
+		api.POST("/calendars", HandleError(SetCalendars))
+		api.GET("/accounts", HandleError(GetAccounts))
+		api.POST("/account-remove", HandleError(RemoveAccount))
+		api.GET("/reminders", HandleError(GetReminders))
+		api.POST("/reminders", HandleError(SetReminders))
+		api.GET("/push-key", HandleError(GetPushKey))
+		api.POST("/push-subscribe", HandleError(SubscribePush))
+		api.GET("/timezone", HandleError(GetTimeZone))
+		api.POST("/timezone", HandleError(SetTimeZone))
+		api.GET("/preferences", HandleError(GetPreferences))
+		api.POST("/preferences", HandleError(SetPreferences))
+		api.GET("/policies", HandleError(GetPolicies))
+		api.POST("/policies", HandleError(SetPolicies))
 		api.POST("/ai-chat", HandleError(AIChat))
 		api.GET("/paypal-check", HandleError(PayPalReturnURL))
 		api.GET("/email", HandleError(GetEmail))
@@ -47,12 +95,20 @@ func main() {
 		api.GET("/subscription-status", HandleError(GetSubscriptionDetails))
 	}
 
-	// OAuth routes
-	r.GET("/auth/google/login", HandleError(GoogleLogin))
-	r.GET("/auth/google/callback", HandleError(GoogleCallback))
+	// Pages and routes for people without an account, found by the token
+	// or slug in their link
+	public := r.Group("/public")
+	{
+		public.GET("/polls/:token", HandleError(GetPublicPoll))
+		public.POST("/polls/:token/vote", HandleError(VotePoll))
+		public.GET("/booking/:slug", HandleError(GetPublicBookingPage))
+		public.POST("/booking/:slug", HandleError(BookSlot))
+	}
+	r.GET("/poll/:token", PollPage)
+	r.GET("/book/:slug", BookingPagePage)
 
-	r.GET("/auth/microsoft/login", HandleError(MicrosoftLogin))
-	r.GET("/auth/microsoft/callback", HandleError(MicrosoftCallback))
+	// OAuth routes and webhooks of the registered providers
+	RegisterProviderRoutes(r)
 
 	// Serve frontend pages
 	r.GET("/", func(c *gin.Context) {
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/Arch-4ng3l/StartupFramework/backend/config"
@@ -14,14 +17,18 @@ import (
 	"github.com/coreos/go-oidc"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/microsoft/kiota-abstractions-go/serialization"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	"github.com/microsoftgraph/msgraph-sdk-go/models/odataerrors"
+	"github.com/microsoftgraph/msgraph-sdk-go/users"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/microsoft"
 )
 
 type MicrosoftCalendar struct {
-	client *msgraphsdk.GraphServiceClient
+	client      *msgraphsdk.GraphServiceClient
+	calendarIDs []string
 }
 
 type TokenCredential struct {
@@ -39,66 +46,630 @@ func (token *TokenCredential) GetToken(ctx context.Context, options policy.Token
 	return azcore.AccessToken{}, fmt.Errorf("token not valid")
 }
 
-func (c *MicrosoftCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
-	events, err := c.client.
+func (c *MicrosoftCalendar) ListCalendars() ([]CalendarInfo, error) {
+	calendars, err := c.client.
 		Me().
-		Calendar().
-		Events().
+		Calendars().
 		Get(context.Background(), nil)
 	if err != nil {
 		return nil, err
 	}
-	layout := "2006-01-02T15:04:05.0000000"
+	var arr []CalendarInfo
+	for _, calendar := range calendars.GetValue() {
+		info := CalendarInfo{ID: *calendar.GetId()}
+		if calendar.GetName() != nil {
+			info.Name = *calendar.GetName()
+		}
+		if calendar.GetIsDefaultCalendar() != nil {
+			info.Primary = *calendar.GetIsDefaultCalendar()
+		}
+		if calendar.GetCanEdit() != nil {
+			info.ReadOnly = !*calendar.GetCanEdit()
+		}
+		if calendar.GetHexColor() != nil {
+			info.Color = *calendar.GetHexColor()
+		}
+		arr = append(arr, info)
+	}
+	return arr, nil
+}
+
+func (c *MicrosoftCalendar) SelectCalendars(ids []string) {
+	c.calendarIDs = ids
+}
+
+func (c *MicrosoftCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	calendarIDs := c.calendarIDs
+	if len(calendarIDs) == 0 {
+		calendarIDs = []string{""}
+	}
+
+	// calendarView returns the occurrences of recurring events and
+	// multi-day events overlapping either end of the range
+	start := startTime.UTC().Format(time.RFC3339)
+	end := endTime.UTC().Format(time.RFC3339)
+
 	var arr []*Event
-	for _, event := range events.GetValue() {
-		t, _ := time.Parse(layout, *event.GetStart().GetDateTime())
-		t2, _ := time.Parse(layout, *event.GetEnd().GetDateTime())
-		if t.UTC().Unix() < startTime.UTC().Unix() || t2.UTC().Unix() > endTime.UTC().Unix() {
-			continue
+	for _, calendarID := range calendarIDs {
+		var page models.EventCollectionResponseable
+		var err error
+		if calendarID == "" {
+			page, err = c.client.Me().CalendarView().Get(context.Background(), &users.ItemCalendarViewRequestBuilderGetRequestConfiguration{
+				QueryParameters: &users.ItemCalendarViewRequestBuilderGetQueryParameters{
+					StartDateTime: &start,
+					EndDateTime:   &end,
+				},
+			})
+		} else {
+			page, err = c.client.Me().Calendars().ByCalendarId(calendarID).CalendarView().Get(context.Background(), &users.ItemCalendarsItemCalendarViewRequestBuilderGetRequestConfiguration{
+				QueryParameters: &users.ItemCalendarsItemCalendarViewRequestBuilderGetQueryParameters{
+					StartDateTime: &start,
+					EndDateTime:   &end,
+				},
+			})
 		}
 
-		arr = append(arr, &Event{
-			ID:        *event.GetId(),
-			Title:     *event.GetSubject(),
-			StartTime: *event.GetStart().GetDateTime(),
-			EndTime:   *event.GetEnd().GetDateTime(),
-		})
+		for {
+			if err != nil {
+				return nil, err
+			}
+			for _, event := range page.GetValue() {
+				e := microsoftToEvent(event)
+				e.CalendarID = calendarID
+				arr = append(arr, e)
+			}
+			if page.GetOdataNextLink() == nil {
+				break
+			}
+			page, err = c.client.
+				Me().
+				CalendarView().
+				WithUrl(*page.GetOdataNextLink()).
+				Get(context.Background(), nil)
+		}
 	}
+	sortEventsByStart(arr)
 	return arr, nil
 
 }
+
+// instances returns the occurrences of a series within the range, as Graph
+// has them with their exceptions
+func (c *MicrosoftCalendar) instances(seriesID string, startTime, endTime time.Time) ([]*Event, error) {
+	start := startTime.UTC().Format(time.RFC3339)
+	end := endTime.UTC().Format(time.RFC3339)
+	page, err := c.client.Me().Events().ByEventId(seriesID).Instances().Get(context.Background(), &users.ItemEventsItemInstancesRequestBuilderGetRequestConfiguration{
+		QueryParameters: &users.ItemEventsItemInstancesRequestBuilderGetQueryParameters{
+			StartDateTime: &start,
+			EndDateTime:   &end,
+		},
+	})
+
+	var arr []*Event
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range page.GetValue() {
+			arr = append(arr, microsoftToEvent(event))
+		}
+		if page.GetOdataNextLink() == nil {
+			break
+		}
+		page, err = c.client.
+			Me().
+			Events().
+			ByEventId(seriesID).
+			Instances().
+			WithUrl(*page.GetOdataNextLink()).
+			Get(context.Background(), nil)
+	}
+	return arr, nil
+}
+
+// SearchEvents uses $search, which returns series instead of their
+// occurrences, so the occurrences of matched series are asked for separately
+func (c *MicrosoftCalendar) SearchEvents(query SearchQuery) ([]*Event, error) {
+	calendarIDs := c.calendarIDs
+	if len(calendarIDs) == 0 {
+		calendarIDs = []string{""}
+	}
+	search := `"` + strings.ReplaceAll(query.searchTerm(), `"`, "") + `"`
+	top := int32(100)
+
+	var arr []*Event
+	for _, calendarID := range calendarIDs {
+		var page models.EventCollectionResponseable
+		var err error
+		if calendarID == "" {
+			page, err = c.client.Me().Events().Get(context.Background(), &users.ItemEventsRequestBuilderGetRequestConfiguration{
+				QueryParameters: &users.ItemEventsRequestBuilderGetQueryParameters{
+					Search: &search,
+					Top:    &top,
+				},
+			})
+		} else {
+			page, err = c.client.Me().Calendars().ByCalendarId(calendarID).Events().Get(context.Background(), &users.ItemCalendarsItemEventsRequestBuilderGetRequestConfiguration{
+				QueryParameters: &users.ItemCalendarsItemEventsRequestBuilderGetQueryParameters{
+					Search: &search,
+					Top:    &top,
+				},
+			})
+		}
+
+		for {
+			if err != nil {
+				return nil, err
+			}
+			for _, event := range page.GetValue() {
+				e := microsoftToEvent(event)
+				e.CalendarID = calendarID
+				if len(e.Recurrence) == 0 {
+					arr = append(arr, e)
+					continue
+				}
+				occurrences, err := c.instances(e.ID, query.Start, query.End)
+				if err != nil {
+					log.Println(err.Error())
+					continue
+				}
+				for _, occurrence := range occurrences {
+					occurrence.CalendarID = calendarID
+				}
+				arr = append(arr, occurrences...)
+			}
+			if page.GetOdataNextLink() == nil {
+				break
+			}
+			page, err = c.client.
+				Me().
+				Events().
+				WithUrl(*page.GetOdataNextLink()).
+				Get(context.Background(), nil)
+		}
+	}
+	return arr, nil
+}
+
+func (c *MicrosoftCalendar) Watch(channel *WatchChannel, address string) error {
+	resource := "me/events"
+	if channel.CalendarID != "" {
+		resource = "me/calendars/" + channel.CalendarID + "/events"
+	}
+	changeType := "created,updated,deleted"
+	expiration := time.Now().Add(graphSubscriptionDuration)
+
+	subscription := models.NewSubscription()
+	subscription.SetChangeType(&changeType)
+	subscription.SetNotificationUrl(&address)
+	subscription.SetResource(&resource)
+	subscription.SetExpirationDateTime(&expiration)
+	subscription.SetClientState(&channel.Secret)
+
+	created, err := c.client.
+		Subscriptions().
+		Post(context.Background(), subscription, nil)
+	if err != nil {
+		return err
+	}
+	channel.ChannelID = *created.GetId()
+	channel.Expiration = expiration
+	return nil
+}
+
+func (c *MicrosoftCalendar) StopWatch(channel *WatchChannel) error {
+	return c.client.
+		Subscriptions().
+		BySubscriptionId(channel.ChannelID).
+		Delete(context.Background(), nil)
+}
+
+// graphDeltaURL is where the changes to a calendar between start and end
+// are first requested. Later requests follow the links in the responses.
+func graphDeltaURL(calendarID string, start, end time.Time) string {
+	path := "me/calendarView/delta"
+	if calendarID != "" {
+		path = "me/calendars/" + url.PathEscape(calendarID) + "/calendarView/delta"
+	}
+	query := url.Values{
+		"startDateTime": {start.UTC().Format(time.RFC3339)},
+		"endDateTime":   {end.UTC().Format(time.RFC3339)},
+	}
+	return "https://graph.microsoft.com/v1.0/" + path + "?" + query.Encode()
+}
+
+func (c *MicrosoftCalendar) SyncEvents(token string, start, end time.Time) (*SyncResult, error) {
+	calendarIDs := c.calendarIDs
+	if len(calendarIDs) == 0 {
+		calendarIDs = []string{""}
+	}
+
+	links := decodeSyncTokens(token, calendarIDs)
+	result := &SyncResult{Full: links == nil}
+	next := map[string]string{}
+	for _, calendarID := range calendarIDs {
+		link := links[calendarID]
+		if result.Full {
+			link = graphDeltaURL(calendarID, start, end)
+		}
+		for {
+			page, err := c.client.
+				Me().
+				CalendarView().
+				Delta().
+				WithUrl(link).
+				GetAsDeltaGetResponse(context.Background(), nil)
+			var odataErr *odataerrors.ODataError
+			if !result.Full && errors.As(err, &odataErr) && odataErr.ResponseStatusCode == http.StatusGone {
+				// The delta link expired, so start over
+				return c.SyncEvents("", start, end)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			for _, event := range page.GetValue() {
+				if _, removed := event.GetAdditionalData()["@removed"]; removed {
+					result.Removed = append(result.Removed, *event.GetId())
+					continue
+				}
+				e := microsoftToEvent(event)
+				e.CalendarID = calendarID
+				result.Changed = append(result.Changed, e)
+			}
+
+			if page.GetOdataNextLink() != nil {
+				link = *page.GetOdataNextLink()
+				continue
+			}
+			if page.GetOdataDeltaLink() != nil {
+				next[calendarID] = *page.GetOdataDeltaLink()
+			}
+			break
+		}
+	}
+	result.Token = encodeSyncTokens(next)
+	return result, nil
+}
 func (c *MicrosoftCalendar) CreateEvent(event Event) error {
+	_, err := c.CreateEventID(event)
+	return err
+}
+
+// CreateEventID creates the event and returns the ID Graph gave it
+func (c *MicrosoftCalendar) CreateEventID(event Event) (string, error) {
 	microsoftEvent := models.NewEvent()
 	microsoftEvent.SetSubject(&event.Title)
-	t, _ := time.Parse(time.RFC3339, event.StartTime)
-	timeZone, _ := t.Zone()
-	startTime := models.NewDateTimeTimeZone()
-	startTime.SetDateTime(&event.StartTime)
-	startTime.SetTimeZone(&timeZone)
-
-	endTime := models.NewDateTimeTimeZone()
-	endTime.SetDateTime(&event.EndTime)
-	endTime.SetTimeZone(&timeZone)
-	microsoftEvent.SetStart(startTime)
-	microsoftEvent.SetEnd(endTime)
+	loc, timeZone := graphTimeZone(event)
+	t, _ := parseEventTime(event.StartTime)
+	microsoftEvent.SetIsAllDay(&event.AllDay)
+	microsoftEvent.SetStart(toGraphDateTime(event.StartTime, event))
+	microsoftEvent.SetEnd(toGraphDateTime(event.EndTime, event))
+	setGraphDetails(microsoftEvent, event)
 
-	_, err := c.client.
+	if !event.AllDay {
+		t = t.In(loc)
+	}
+	recurrence, err := toGraphRecurrence(event.Recurrence, t, timeZone)
+	if err != nil {
+		return "", err
+	}
+	if recurrence != nil {
+		microsoftEvent.SetRecurrence(recurrence)
+	}
+
+	var created models.Eventable
+	if event.CalendarID == "" {
+		created, err = c.client.Me().Calendar().Events().Post(context.Background(), microsoftEvent, nil)
+	} else {
+		created, err = c.client.Me().Calendars().ByCalendarId(event.CalendarID).Events().Post(context.Background(), microsoftEvent, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Graph has no EXDATE, so excluded occurrences are cancelled after creating the series
+	for _, line := range event.Recurrence {
+		if !strings.HasPrefix(line, "EXDATE") {
+			continue
+		}
+		loc := eventLocation(event)
+		if loc == nil {
+			loc = time.UTC
+		}
+		dates, err := parseRecurrenceDates(line, loc)
+		if err != nil {
+			return "", err
+		}
+		for _, date := range dates {
+			if err := c.removeOccurrence(*created.GetId(), date); err != nil {
+				return "", err
+			}
+		}
+	}
+	return *created.GetId(), nil
+}
+
+func (c *MicrosoftCalendar) removeOccurrence(seriesID string, start time.Time) error {
+	startStr := start.UTC().Format(time.RFC3339)
+	endStr := start.Add(time.Minute).UTC().Format(time.RFC3339)
+	instances, err := c.client.
 		Me().
-		Calendar().
 		Events().
-		Post(context.Background(), microsoftEvent, nil)
+		ByEventId(seriesID).
+		Instances().
+		Get(context.Background(), &users.ItemEventsItemInstancesRequestBuilderGetRequestConfiguration{
+			QueryParameters: &users.ItemEventsItemInstancesRequestBuilderGetQueryParameters{
+				StartDateTime: &startStr,
+				EndDateTime:   &endStr,
+			},
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances.GetValue() {
+		if err := c.RemoveEvent(Event{ID: *instance.GetId()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Graph sends times without an offset, in the zone given next to them
+const graphDateTimeLayout = "2006-01-02T15:04:05"
+
+// graphTimeZone returns the event's zone and its Windows name, which is
+// what Graph expects. Zones without one fall back to UTC.
+func graphTimeZone(event Event) (*time.Location, string) {
+	loc, err := LoadTimeZone(event.TimeZone)
+	if event.TimeZone == "" || err != nil {
+		return time.UTC, "UTC"
+	}
+	timeZone, err := WindowsTimeZone(loc.String())
+	if err != nil {
+		return time.UTC, "UTC"
+	}
+	return loc, timeZone
+}
+
+func toGraphDateTime(value string, event Event) models.DateTimeTimeZoneable {
+	loc, timeZone := graphTimeZone(event)
+	dateTime := models.NewDateTimeTimeZone()
+	dateTime.SetTimeZone(&timeZone)
+	if event.AllDay {
+		// All-day events must start and end at midnight
+		midnight := value + "T00:00:00"
+		dateTime.SetDateTime(&midnight)
+		return dateTime
+	}
+	t, _ := time.Parse(time.RFC3339, value)
+	local := t.In(loc).Format(graphDateTimeLayout)
+	dateTime.SetDateTime(&local)
+	return dateTime
+}
+
+func fromGraphDateTime(dateTime models.DateTimeTimeZoneable, allDay bool) string {
+	if dateTime == nil || dateTime.GetDateTime() == nil {
+		return ""
+	}
+	loc := time.UTC
+	if dateTime.GetTimeZone() != nil {
+		if l, err := LoadTimeZone(*dateTime.GetTimeZone()); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation(graphDateTimeLayout, *dateTime.GetDateTime(), loc)
+	if err != nil {
+		return *dateTime.GetDateTime()
+	}
+	return formatEventTime(t, allDay)
+}
+
+// setGraphDetails copies everything but the title and times of event
+func setGraphDetails(microsoftEvent models.Eventable, event Event) {
+	if event.Location != "" {
+		location := models.NewLocation()
+		location.SetDisplayName(&event.Location)
+		microsoftEvent.SetLocation(location)
+	}
+	if event.Description != "" {
+		body := models.NewItemBody()
+		contentType := models.TEXT_BODYTYPE
+		body.SetContentType(&contentType)
+		body.SetContent(&event.Description)
+		microsoftEvent.SetBody(body)
+	}
+	if event.Attendees != nil {
+		attendees := []models.Attendeeable{}
+		for _, a := range event.Attendees {
+			email := models.NewEmailAddress()
+			email.SetAddress(&a.Email)
+			if a.Name != "" {
+				email.SetName(&a.Name)
+			}
+			attendeeType := models.REQUIRED_ATTENDEETYPE
+			attendee := models.NewAttendee()
+			attendee.SetEmailAddress(email)
+			attendee.SetTypeEscaped(&attendeeType)
+			attendees = append(attendees, attendee)
+		}
+		microsoftEvent.SetAttendees(attendees)
+	}
+	if event.OnlineMeeting {
+		online := true
+		provider := models.TEAMSFORBUSINESS_ONLINEMEETINGPROVIDERTYPE
+		microsoftEvent.SetIsOnlineMeeting(&online)
+		microsoftEvent.SetOnlineMeetingProvider(&provider)
+	}
+}
 
+var graphResponseStatus = map[models.ResponseType]string{
+	models.NONE_RESPONSETYPE:                StatusNeedsAction,
+	models.NOTRESPONDED_RESPONSETYPE:        StatusNeedsAction,
+	models.ORGANIZER_RESPONSETYPE:           StatusAccepted,
+	models.ACCEPTED_RESPONSETYPE:            StatusAccepted,
+	models.TENTATIVELYACCEPTED_RESPONSETYPE: StatusTentative,
+	models.DECLINED_RESPONSETYPE:            StatusDeclined,
+}
+
+func fromGraphDetails(e *Event, event models.Eventable) {
+	if event.GetLocation() != nil && event.GetLocation().GetDisplayName() != nil {
+		e.Location = *event.GetLocation().GetDisplayName()
+	}
+	if body := event.GetBody(); body != nil && body.GetContent() != nil {
+		if body.GetContentType() != nil && *body.GetContentType() == models.TEXT_BODYTYPE {
+			e.Description = *body.GetContent()
+		} else if event.GetBodyPreview() != nil {
+			// The preview is the plain text of HTML bodies
+			e.Description = *event.GetBodyPreview()
+		}
+	}
+	for _, attendee := range event.GetAttendees() {
+		if attendee.GetEmailAddress() == nil || attendee.GetEmailAddress().GetAddress() == nil {
+			continue
+		}
+		a := Attendee{Email: *attendee.GetEmailAddress().GetAddress(), Status: StatusNeedsAction}
+		if attendee.GetEmailAddress().GetName() != nil {
+			a.Name = *attendee.GetEmailAddress().GetName()
+		}
+		if attendee.GetStatus() != nil && attendee.GetStatus().GetResponse() != nil {
+			a.Status = graphResponseStatus[*attendee.GetStatus().GetResponse()]
+		}
+		e.Attendees = append(e.Attendees, a)
+	}
+	if event.GetOnlineMeeting() != nil && event.GetOnlineMeeting().GetJoinUrl() != nil {
+		e.MeetingURL = *event.GetOnlineMeeting().GetJoinUrl()
+	}
+}
+
+func (c *MicrosoftCalendar) UpdateEvent(event Event) error {
+	id := event.ID
+	if event.Scope == ScopeSeries && event.RecurringEventID != "" {
+		id = event.RecurringEventID
+		master, err := c.GetSeries(id)
+		if err != nil {
+			return err
+		}
+		if event.StartTime, event.EndTime, err = shiftSeries(master, event); err != nil {
+			return err
+		}
+		if event.TimeZone == "" {
+			event.TimeZone = master.TimeZone
+		}
+	} else if event.TimeZone == "" && (event.StartTime != "" || event.EndTime != "") {
+		// Keep the zone the event is shown in by Outlook
+		current, err := c.GetSeries(id)
+		if err != nil {
+			return err
+		}
+		event.TimeZone = current.TimeZone
+	}
+
+	microsoftEvent := models.NewEvent()
+	if event.Title != "" {
+		microsoftEvent.SetSubject(&event.Title)
+	}
+	if event.StartTime != "" {
+		loc, timeZone := graphTimeZone(event)
+		t, _ := parseEventTime(event.StartTime)
+		microsoftEvent.SetIsAllDay(&event.AllDay)
+		microsoftEvent.SetStart(toGraphDateTime(event.StartTime, event))
+
+		if event.Recurrence != nil {
+			if !event.AllDay {
+				t = t.In(loc)
+			}
+			recurrence, err := toGraphRecurrence(event.Recurrence, t, timeZone)
+			if err != nil {
+				return err
+			}
+			microsoftEvent.SetRecurrence(recurrence)
+		}
+	}
+	if event.EndTime != "" {
+		microsoftEvent.SetEnd(toGraphDateTime(event.EndTime, event))
+	}
+	setGraphDetails(microsoftEvent, event)
+
+	_, err := c.client.
+		Me().
+		Events().
+		ByEventId(id).
+		Patch(context.Background(), microsoftEvent, nil)
 	return err
 }
+
 func (c *MicrosoftCalendar) RemoveEvent(event Event) error {
+	id := event.ID
+	if event.Scope == ScopeSeries && event.RecurringEventID != "" {
+		id = event.RecurringEventID
+	}
 	return c.client.
 		Me().
-		Calendar().
 		Events().
-		ByEventId(event.ID).
+		ByEventId(id).
 		Delete(context.Background(), nil)
 }
 
+func (c *MicrosoftCalendar) GetSeries(id string) (*Event, error) {
+	event, err := c.client.
+		Me().
+		Events().
+		ByEventId(id).
+		Get(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return microsoftToEvent(event), nil
+}
+
+func microsoftToEvent(event models.Eventable) *Event {
+	allDay := event.GetIsAllDay() != nil && *event.GetIsAllDay()
+	e := &Event{
+		ID:         *event.GetId(),
+		Title:      *event.GetSubject(),
+		StartTime:  fromGraphDateTime(event.GetStart(), allDay),
+		EndTime:    fromGraphDateTime(event.GetEnd(), allDay),
+		AllDay:     allDay,
+		Recurrence: fromGraphRecurrence(event.GetRecurrence()),
+	}
+	fromGraphDetails(e, event)
+	if event.GetOriginalStartTimeZone() != nil {
+		if loc, err := LoadTimeZone(*event.GetOriginalStartTimeZone()); err == nil {
+			e.TimeZone = loc.String()
+		}
+	}
+	if event.GetSeriesMasterId() != nil {
+		e.RecurringEventID = *event.GetSeriesMasterId()
+	}
+	if event.GetOriginalStart() != nil {
+		e.OriginalStartTime = formatEventTime(*event.GetOriginalStart(), allDay)
+	}
+	return e
+}
+
+func init() {
+	RegisterProvider(&Provider{
+		Name:     Microsoft,
+		Path:     "microsoft",
+		Init:     InitMicrosoft,
+		Login:    MicrosoftLogin,
+		Callback: MicrosoftCallback,
+		NewCalendar: func(user User, token *oauth2.Token) (Calendar, error) {
+			service := NewMicrosoftCalendar(token)
+			if service == nil {
+				return nil, fmt.Errorf("could not connect to Microsoft calendar")
+			}
+			return service, nil
+		},
+		NewTaskList: func(token *oauth2.Token) (TaskList, error) {
+			return NewMicrosoftTaskList(token)
+		},
+		Webhook: MicrosoftWebhook,
+	})
+}
+
 func NewMicrosoftCalendar(token *oauth2.Token) *MicrosoftCalendar {
 
 	cred := TokenCredential{token}
@@ -128,6 +699,7 @@ func InitMicrosoft(config config.Config) {
 			"profile",
 			"email",
 			"Calendars.ReadWrite",
+			"Tasks.ReadWrite",
 		},
 		Endpoint: microsoft.AzureADEndpoint("common"),
 	}
@@ -144,6 +716,7 @@ func MicrosoftLogin(c *gin.Context) error {
 		Value:     state,
 		ExpiresAt: time.Now().Add(15 * time.Minute),
 	})
+	startLinking(c, session)
 	if err := session.Save(); err != nil {
 		return err
 	}
@@ -176,6 +749,10 @@ func MicrosoftCallback(c *gin.Context) error {
 		return err
 	}
 
+	if linkUser := linkingUser(c); linkUser != nil {
+		return linkAccount(c, linkUser, Microsoft, *userResp.GetId(), *userResp.GetMail(), token)
+	}
+
 	user.ProviderID = *userResp.GetId()
 	user.Email = *userResp.GetMail()
 	user.Provider = Microsoft
@@ -201,3 +778,405 @@ func MicrosoftCallback(c *gin.Context) error {
 	return nil
 
 }
+
+func toGraphRecurrence(recurrence []string, start time.Time, timeZone string) (models.PatternedRecurrenceable, error) {
+	var rule *RecurrenceRule
+	for _, line := range recurrence {
+		if strings.HasPrefix(line, "RRULE:") {
+			r, err := ParseRecurrenceRule(line, start.Location())
+			if err != nil {
+				return nil, err
+			}
+			rule = r
+		}
+	}
+	if rule == nil {
+		return nil, nil
+	}
+	if len(rule.BySetPos) > 1 || len(rule.ByMonthDay) > 1 || len(rule.ByMonth) > 1 {
+		return nil, fmt.Errorf("recurrence %s is not supported by Microsoft", rule.String())
+	}
+
+	pattern := models.NewRecurrencePattern()
+	interval := int32(rule.Interval)
+	pattern.SetInterval(&interval)
+
+	var days []models.DayOfWeek
+	ordinal := 0
+	for _, wd := range rule.ByDay {
+		days = append(days, models.DayOfWeek(wd.Day))
+		if wd.N != 0 {
+			ordinal = wd.N
+		}
+	}
+	if len(rule.BySetPos) == 1 {
+		ordinal = rule.BySetPos[0]
+	}
+
+	dayOfMonth := int32(start.Day())
+	if len(rule.ByMonthDay) == 1 {
+		dayOfMonth = int32(rule.ByMonthDay[0])
+	}
+	if dayOfMonth == -1 && len(days) == 0 {
+		// Graph has the last day of the month as the last of any weekday
+		days = allGraphDays()
+		ordinal = -1
+	} else if dayOfMonth < 1 {
+		return nil, fmt.Errorf("recurrence %s is not supported by Microsoft", rule.String())
+	}
+	month := int32(start.Month())
+	if len(rule.ByMonth) == 1 {
+		month = int32(rule.ByMonth[0])
+	}
+
+	var patternType models.RecurrencePatternType
+	switch rule.Freq {
+	case "DAILY":
+		patternType = models.DAILY_RECURRENCEPATTERNTYPE
+		if len(days) > 0 {
+			// "Every weekday" is a weekly pattern in Graph
+			patternType = models.WEEKLY_RECURRENCEPATTERNTYPE
+			pattern.SetDaysOfWeek(days)
+		}
+	case "WEEKLY":
+		patternType = models.WEEKLY_RECURRENCEPATTERNTYPE
+		if len(days) == 0 {
+			days = []models.DayOfWeek{models.DayOfWeek(start.Weekday())}
+		}
+		pattern.SetDaysOfWeek(days)
+		firstDay := models.DayOfWeek(rule.WeekStart)
+		pattern.SetFirstDayOfWeek(&firstDay)
+	case "MONTHLY", "YEARLY":
+		relative := len(days) > 0
+		if relative {
+			index, err := toGraphWeekIndex(ordinal)
+			if err != nil {
+				return nil, err
+			}
+			pattern.SetDaysOfWeek(days)
+			pattern.SetIndex(&index)
+		} else {
+			pattern.SetDayOfMonth(&dayOfMonth)
+		}
+
+		if rule.Freq == "MONTHLY" {
+			patternType = models.ABSOLUTEMONTHLY_RECURRENCEPATTERNTYPE
+			if relative {
+				patternType = models.RELATIVEMONTHLY_RECURRENCEPATTERNTYPE
+			}
+		} else {
+			pattern.SetMonth(&month)
+			patternType = models.ABSOLUTEYEARLY_RECURRENCEPATTERNTYPE
+			if relative {
+				patternType = models.RELATIVEYEARLY_RECURRENCEPATTERNTYPE
+			}
+		}
+	}
+	pattern.SetTypeEscaped(&patternType)
+
+	rangeValue := models.NewRecurrenceRange()
+	rangeValue.SetStartDate(serialization.NewDateOnly(start))
+	rangeValue.SetRecurrenceTimeZone(&timeZone)
+	rangeType := models.NOEND_RECURRENCERANGETYPE
+	if rule.Count > 0 {
+		rangeType = models.NUMBERED_RECURRENCERANGETYPE
+		count := int32(rule.Count)
+		rangeValue.SetNumberOfOccurrences(&count)
+	} else if !rule.Until.IsZero() {
+		rangeType = models.ENDDATE_RECURRENCERANGETYPE
+		rangeValue.SetEndDate(serialization.NewDateOnly(rule.Until.In(start.Location())))
+	}
+	rangeValue.SetTypeEscaped(&rangeType)
+
+	result := models.NewPatternedRecurrence()
+	result.SetPattern(pattern)
+	result.SetRangeEscaped(rangeValue)
+	return result, nil
+}
+
+func allGraphDays() []models.DayOfWeek {
+	days := make([]models.DayOfWeek, 7)
+	for i := range days {
+		days[i] = models.DayOfWeek(i)
+	}
+	return days
+}
+
+func toGraphWeekIndex(ordinal int) (models.WeekIndex, error) {
+	switch ordinal {
+	case 1, 0:
+		return models.FIRST_WEEKINDEX, nil
+	case 2:
+		return models.SECOND_WEEKINDEX, nil
+	case 3:
+		return models.THIRD_WEEKINDEX, nil
+	case 4:
+		return models.FOURTH_WEEKINDEX, nil
+	case -1:
+		return models.LAST_WEEKINDEX, nil
+	}
+	return 0, fmt.Errorf("week index %d is not supported by Microsoft", ordinal)
+}
+
+func fromGraphRecurrence(recurrence models.PatternedRecurrenceable) []string {
+	if recurrence == nil || recurrence.GetPattern() == nil || recurrence.GetPattern().GetTypeEscaped() == nil {
+		return nil
+	}
+	pattern := recurrence.GetPattern()
+	rule := &RecurrenceRule{Interval: 1, WeekStart: time.Monday}
+	if pattern.GetInterval() != nil && *pattern.GetInterval() > 0 {
+		rule.Interval = int(*pattern.GetInterval())
+	}
+	if pattern.GetFirstDayOfWeek() != nil {
+		rule.WeekStart = time.Weekday(*pattern.GetFirstDayOfWeek())
+	}
+
+	ordinal := 0
+	if pattern.GetIndex() != nil {
+		ordinal = map[models.WeekIndex]int{
+			models.FIRST_WEEKINDEX:  1,
+			models.SECOND_WEEKINDEX: 2,
+			models.THIRD_WEEKINDEX:  3,
+			models.FOURTH_WEEKINDEX: 4,
+			models.LAST_WEEKINDEX:   -1,
+		}[*pattern.GetIndex()]
+	}
+	byDay := func(n int) {
+		days := pattern.GetDaysOfWeek()
+		if n == -1 && len(days) == 7 {
+			rule.ByMonthDay = []int{-1}
+			return
+		}
+		if n != 0 && len(days) > 1 {
+			// The nth of any of the days, like the first weekday
+			rule.BySetPos = []int{n}
+			n = 0
+		}
+		for _, day := range days {
+			rule.ByDay = append(rule.ByDay, WeekdayNum{N: n, Day: time.Weekday(day)})
+		}
+	}
+	byMonthDay := func() {
+		if pattern.GetDayOfMonth() != nil {
+			rule.ByMonthDay = []int{int(*pattern.GetDayOfMonth())}
+		}
+	}
+	byMonth := func() {
+		if pattern.GetMonth() != nil {
+			rule.ByMonth = []int{int(*pattern.GetMonth())}
+		}
+	}
+
+	switch *pattern.GetTypeEscaped() {
+	case models.DAILY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "DAILY"
+	case models.WEEKLY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "WEEKLY"
+		byDay(0)
+	case models.ABSOLUTEMONTHLY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "MONTHLY"
+		byMonthDay()
+	case models.RELATIVEMONTHLY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "MONTHLY"
+		byDay(ordinal)
+	case models.ABSOLUTEYEARLY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "YEARLY"
+		byMonth()
+		byMonthDay()
+	case models.RELATIVEYEARLY_RECURRENCEPATTERNTYPE:
+		rule.Freq = "YEARLY"
+		byMonth()
+		byDay(ordinal)
+	}
+
+	if r := recurrence.GetRangeEscaped(); r != nil && r.GetTypeEscaped() != nil {
+		switch *r.GetTypeEscaped() {
+		case models.NUMBERED_RECURRENCERANGETYPE:
+			if r.GetNumberOfOccurrences() != nil {
+				rule.Count = int(*r.GetNumberOfOccurrences())
+			}
+		case models.ENDDATE_RECURRENCERANGETYPE:
+			if r.GetEndDate() != nil {
+				if until, err := time.Parse("2006-01-02", r.GetEndDate().String()); err == nil {
+					rule.Until = until.Add(24*time.Hour - time.Second)
+				}
+			}
+		}
+	}
+
+	return []string{rule.String()}
+}
+
+// MicrosoftTaskList reads and writes the lists of Microsoft To Do
+type MicrosoftTaskList struct {
+	client *msgraphsdk.GraphServiceClient
+}
+
+func NewMicrosoftTaskList(token *oauth2.Token) (*MicrosoftTaskList, error) {
+	client, err := msgraphsdk.NewGraphServiceClientWithCredentials(&TokenCredential{token}, []string{
+		"Tasks.ReadWrite",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MicrosoftTaskList{
+		client: client,
+	}, nil
+}
+
+// microsoftTaskError tells apart tokens granted before the tasks scopes
+func microsoftTaskError(err error) error {
+	var odataErr *odataerrors.ODataError
+	if errors.As(err, &odataErr) && odataErr.ResponseStatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %v", errMissingTaskScope, err)
+	}
+	return err
+}
+
+func (l *MicrosoftTaskList) lists() ([]models.TodoTaskListable, error) {
+	page, err := l.client.Me().Todo().Lists().Get(context.Background(), nil)
+	var arr []models.TodoTaskListable
+	for {
+		if err != nil {
+			return nil, microsoftTaskError(err)
+		}
+		arr = append(arr, page.GetValue()...)
+		if page.GetOdataNextLink() == nil {
+			break
+		}
+		page, err = l.client.Me().Todo().Lists().WithUrl(*page.GetOdataNextLink()).Get(context.Background(), nil)
+	}
+	return arr, nil
+}
+
+// listID returns the list of the task, which is the default list of To Do
+// when none is given
+func (l *MicrosoftTaskList) listID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	lists, err := l.lists()
+	if err != nil {
+		return "", err
+	}
+	for _, list := range lists {
+		if name := list.GetWellknownListName(); name != nil && *name == models.DEFAULTLIST_WELLKNOWNLISTNAME {
+			return *list.GetId(), nil
+		}
+	}
+	return "", fmt.Errorf("no default task list found")
+}
+
+func (l *MicrosoftTaskList) GetTasks(includeCompleted bool) ([]*Task, error) {
+	lists, err := l.lists()
+	if err != nil {
+		return nil, err
+	}
+	var filter *string
+	if !includeCompleted {
+		open := "status ne 'completed'"
+		filter = &open
+	}
+
+	var arr []*Task
+	for _, list := range lists {
+		listID := *list.GetId()
+		tasks := l.client.Me().Todo().Lists().ByTodoTaskListId(listID).Tasks()
+		page, err := tasks.Get(context.Background(), &users.ItemTodoListsItemTasksRequestBuilderGetRequestConfiguration{
+			QueryParameters: &users.ItemTodoListsItemTasksRequestBuilderGetQueryParameters{
+				Filter: filter,
+			},
+		})
+		for {
+			if err != nil {
+				return nil, microsoftTaskError(err)
+			}
+			for _, task := range page.GetValue() {
+				t := microsoftToTask(task)
+				t.ListID = listID
+				arr = append(arr, t)
+			}
+			if page.GetOdataNextLink() == nil {
+				break
+			}
+			page, err = tasks.WithUrl(*page.GetOdataNextLink()).Get(context.Background(), nil)
+		}
+	}
+	return arr, nil
+}
+
+func microsoftToTask(task models.TodoTaskable) *Task {
+	t := &Task{
+		ID:     *task.GetId(),
+		Status: TaskOpen,
+	}
+	if task.GetTitle() != nil {
+		t.Title = *task.GetTitle()
+	}
+	if task.GetBody() != nil && task.GetBody().GetContent() != nil {
+		t.Notes = *task.GetBody().GetContent()
+	}
+	if task.GetStatus() != nil && *task.GetStatus() == models.COMPLETED_TASKSTATUS {
+		t.Status = TaskCompleted
+	}
+	t.Due = fromGraphDateTime(task.GetDueDateTime(), true)
+	return t
+}
+
+// toMicrosoftTask copies the fields of task that are given
+func toMicrosoftTask(task Task) models.TodoTaskable {
+	todoTask := models.NewTodoTask()
+	if task.Title != "" {
+		todoTask.SetTitle(&task.Title)
+	}
+	if task.Notes != "" {
+		body := models.NewItemBody()
+		contentType := models.TEXT_BODYTYPE
+		body.SetContentType(&contentType)
+		body.SetContent(&task.Notes)
+		todoTask.SetBody(body)
+	}
+	if task.Due != "" {
+		todoTask.SetDueDateTime(toGraphDateTime(task.Due, Event{AllDay: true}))
+	}
+	switch task.Status {
+	case TaskOpen:
+		status := models.NOTSTARTED_TASKSTATUS
+		todoTask.SetStatus(&status)
+	case TaskCompleted:
+		status := models.COMPLETED_TASKSTATUS
+		todoTask.SetStatus(&status)
+	}
+	return todoTask
+}
+
+func (l *MicrosoftTaskList) CreateTask(task Task) (*Task, error) {
+	listID, err := l.listID(task.ListID)
+	if err != nil {
+		return nil, err
+	}
+	created, err := l.client.Me().Todo().Lists().ByTodoTaskListId(listID).Tasks().Post(context.Background(), toMicrosoftTask(task), nil)
+	if err != nil {
+		return nil, microsoftTaskError(err)
+	}
+	t := microsoftToTask(created)
+	t.ListID = listID
+	return t, nil
+}
+
+func (l *MicrosoftTaskList) UpdateTask(task Task) error {
+	listID, err := l.listID(task.ListID)
+	if err != nil {
+		return err
+	}
+	_, err = l.client.Me().Todo().Lists().ByTodoTaskListId(listID).Tasks().ByTodoTaskId(task.ID).Patch(context.Background(), toMicrosoftTask(task), nil)
+	return microsoftTaskError(err)
+}
+
+func (l *MicrosoftTaskList) RemoveTask(task Task) error {
+	listID, err := l.listID(task.ListID)
+	if err != nil {
+		return err
+	}
+	return microsoftTaskError(l.client.Me().Todo().Lists().ByTodoTaskListId(listID).Tasks().ByTodoTaskId(task.ID).Delete(context.Background(), nil))
+}
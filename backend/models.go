@@ -12,6 +12,8 @@ const (
 	Basic     string = "Basic"
 	Microsoft string = "MICROSOFT"
 	Google    string = "GOOGLE"
+	CalDAV    string = "CALDAV"
+	Local     string = "LOCAL"
 	Stripe    string = "STRIPE"
 	Paypal    string = "PAYPAL"
 )
@@ -27,6 +29,38 @@ type User struct {
 	SubscriptionID       string
 	SubscriptionPlan     string
 	CalenderToken        json.RawMessage `gorm:"type:jsonb"`
+	// Calendar collection of users on a CalDAV server, with the password
+	// encrypted
+	CalDAVURL      string
+	CalDAVUsername string
+	CalDAVPassword string
+	// IANA name of the zone the user lives in
+	TimeZone string
+}
+
+// CalendarSetting holds the choices of a user for one calendar of their
+// account. Without any settings only the default calendar is used.
+type CalendarSetting struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	// Empty for the account the user signed up with
+	AccountID  string
+	CalendarID string
+	// Events are shown and searched
+	Enabled bool
+	// Events are given to the assistant
+	AIContext bool
+}
+
+// LinkedAccount is a calendar account connected in addition to the one the
+// user signed up with
+type LinkedAccount struct {
+	gorm.Model
+	UserID     uint   `gorm:"index;not null"`
+	Provider   string `gorm:"not null"`
+	ProviderID string `gorm:"not null"`
+	Email      string
+	Token      json.RawMessage `gorm:"type:jsonb"`
 }
 
 type SubscriptionDetails struct {
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Arch-4ng3l/StartupFramework/backend/config"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Notifier delivers reminders to the user. Notifiers the user didn't set up
+// do nothing.
+type Notifier interface {
+	Notify(reminder Reminder) error
+}
+
+var notifiers []Notifier
+
+func InitNotifiers(config config.Config) {
+	notifiers = []Notifier{&WebhookNotifier{client: newPublicClient(10 * time.Second)}}
+	if config.SMTPHost != "" {
+		notifiers = append(notifiers, &EmailNotifier{
+			host:     config.SMTPHost,
+			port:     config.SMTPPort,
+			username: config.SMTPUsername,
+			password: config.SMTPPassword,
+			from:     config.SMTPFrom,
+		})
+	}
+	if config.VAPIDPrivateKey != "" {
+		push, err := NewPushNotifier(config.VAPIDPublicKey, config.VAPIDPrivateKey, config.VAPIDSubject)
+		if err != nil {
+			log.Println(err.Error())
+		} else {
+			notifiers = append(notifiers, push)
+		}
+	}
+}
+
+type EmailNotifier struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func (n *EmailNotifier) Notify(reminder Reminder) error {
+	if !reminder.Preference.Email {
+		return nil
+	}
+	subject, body := reminder.Message()
+	return n.Send(reminder.User.Email, subject, body)
+}
+
+// EmailAttachment is a file sent along with an email
+type EmailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Send mails a plain text message, with the attachments as a multipart
+// message
+func (n *EmailNotifier) Send(to, subject, body string, attachments ...EmailAttachment) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if len(attachments) == 0 {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(body)
+	} else if err := writeMultipartEmail(&msg, body, attachments); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	return smtp.SendMail(n.host+":"+n.port, auth, n.from, []string{to}, msg.Bytes())
+}
+
+func writeMultipartEmail(msg *bytes.Buffer, body string, attachments []EmailAttachment) error {
+	writer := multipart.NewWriter(msg)
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(body))
+
+	for _, attachment := range attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return err
+		}
+		// Lines of base64 may be at most 76 characters long
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	return writer.Close()
+}
+
+// emailNotifier returns the notifier for sending emails, or nil when SMTP
+// isn't set up
+func emailNotifier() *EmailNotifier {
+	for _, notifier := range notifiers {
+		if email, ok := notifier.(*EmailNotifier); ok {
+			return email
+		}
+	}
+	return nil
+}
+
+var errNonPublicAddress = errors.New("only public https addresses can be used")
+
+// allowPrivateURLs turns the checks of addresses users give us off, for
+// development
+var allowPrivateURLs bool
+
+// sharedAddressSpace is 100.64.0.0/10, used inside carrier and cloud networks
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// validatePublicURL checks a URL users give us to post to. Names are
+// checked again when connecting, as they may resolve differently by then.
+func validatePublicURL(raw string) error {
+	address, err := url.Parse(raw)
+	if err != nil || address.Hostname() == "" {
+		return errNonPublicAddress
+	}
+	if allowPrivateURLs && (address.Scheme == "http" || address.Scheme == "https") {
+		return nil
+	}
+	if address.Scheme != "https" {
+		return errNonPublicAddress
+	}
+	if ip := net.ParseIP(address.Hostname()); ip != nil && !isPublicIP(ip) {
+		return errNonPublicAddress
+	}
+	return nil
+}
+
+// newPublicClient returns a client for URLs users give us. It connects only
+// to public addresses over https, also after redirects, so that users can't
+// reach our internal network or the metadata service of the cloud.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// Called with the address names resolved to
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivateURLs {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return validatePublicURL(req.URL.String())
+		},
+	}
+}
+
+// WebhookNotifier posts reminders as JSON to an address of the user
+type WebhookNotifier struct {
+	client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(reminder Reminder) error {
+	if reminder.Preference.WebhookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(gin.H{
+		"type":          "reminder",
+		"event":         reminder.Event,
+		"start":         reminder.Start.Format(time.RFC3339),
+		"minutesBefore": int(reminder.Offset.Minutes()),
+	})
+	if err != nil {
+		return err
+	}
+	if err := validatePublicURL(reminder.Preference.WebhookURL); err != nil {
+		return err
+	}
+	resp, err := n.client.Post(reminder.Preference.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s failed: %s", reminder.Preference.WebhookURL, resp.Status)
+	}
+	return nil
+}
+
+// PushSubscription is a browser that accepts Web Push messages for the user
+type PushSubscription struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null"`
+	Endpoint string `gorm:"not null"`
+	// Public key and authentication secret of the browser, base64url encoded
+	P256dh string
+	Auth   string
+}
+
+// PushNotifier sends Web Push messages, encrypted as in RFC 8291 and signed
+// with a VAPID key
+type PushNotifier struct {
+	client     *http.Client
+	publicKey  string
+	privateKey *ecdsa.PrivateKey
+	subject    string
+}
+
+func NewPushNotifier(publicKey, privateKey, subject string) (*PushNotifier, error) {
+	d, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	// Uncompressed point: 0x04 || X || Y
+	point := key.PublicKey().Bytes()
+	signingKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	if publicKey == "" {
+		publicKey = base64.RawURLEncoding.EncodeToString(point)
+	}
+	return &PushNotifier{
+		client:     newPublicClient(10 * time.Second),
+		publicKey:  publicKey,
+		privateKey: signingKey,
+		subject:    subject,
+	}, nil
+}
+
+func (n *PushNotifier) Notify(reminder Reminder) error {
+	var subscriptions []PushSubscription
+	if err := db.Where("user_id = ?", reminder.User.ID).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	subject, body := reminder.Message()
+	payload, err := json.Marshal(gin.H{"title": subject, "body": body})
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if err := n.send(subscription, payload); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return nil
+}
+
+func (n *PushNotifier) send(subscription PushSubscription, payload []byte) error {
+	body, err := encryptPushPayload(subscription, payload)
+	if err != nil {
+		return err
+	}
+	if err := validatePublicURL(subscription.Endpoint); err != nil {
+		return err
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": n.subject,
+	}).SignedString(n.privateKey)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "3600")
+	req.Header.Set("Authorization", "vapid t="+token+", k="+n.publicKey)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The user revoked the permission or the browser is gone
+		return db.Unscoped().Delete(&subscription).Error
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push to %s failed: %s", endpoint.Host, resp.Status)
+	}
+	return nil
+}
+
+// encryptPushPayload encrypts a message for a browser with the aes128gcm
+// content coding of RFC 8188, keyed as described in RFC 8291
+func encryptPushPayload(subscription PushSubscription, payload []byte) ([]byte, error) {
+	uaKeyBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asKeyBytes := asKey.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaKeyBytes...)
+	keyInfo = append(keyInfo, asKeyBytes...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record, ended by the delimiter 0x02
+	record := gcm.Seal(nil, nonce, append(payload, 0x02), nil)
+
+	var out bytes.Buffer
+	out.Write(salt)
+	binary.Write(&out, binary.BigEndian, uint32(4096))
+	out.WriteByte(byte(len(asKeyBytes)))
+	out.Write(asKeyBytes)
+	out.Write(record)
+	return out.Bytes(), nil
+}
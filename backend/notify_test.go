@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// decryptPushPayload does what the browser does with a message
+func decryptPushPayload(t *testing.T, uaKey *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("body of %d bytes is too short", len(body))
+	}
+	salt := body[:16]
+	if size := binary.BigEndian.Uint32(body[16:20]); size != 4096 {
+		t.Errorf("record size = %d, want 4096", size)
+	}
+	keyLength := int(body[20])
+	asKeyBytes := body[21 : 21+keyLength]
+	record := body[21+keyLength:]
+
+	asKey, err := ecdh.P256().NewPublicKey(asKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret, err := uaKey.ECDH(asKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaKey.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asKeyBytes...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, sharedSecret, authSecret, keyInfo), ikm)
+	cek := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	nonce := make([]byte, 12)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	if len(plain) == 0 || plain[len(plain)-1] != 0x02 {
+		t.Fatalf("record doesn't end with the last record delimiter")
+	}
+	return plain[:len(plain)-1]
+}
+
+func TestEncryptPushPayload(t *testing.T) {
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	subscription := PushSubscription{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+		Auth:   base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+	padded := subscription
+	padded.P256dh = base64.URLEncoding.EncodeToString(uaKey.PublicKey().Bytes())
+	padded.Auth = base64.URLEncoding.EncodeToString(authSecret)
+
+	tests := []struct {
+		name         string
+		subscription PushSubscription
+		payload      []byte
+		wantErr      bool
+	}{
+		{name: "message", subscription: subscription, payload: []byte(`{"title":"Standup","body":"in 10 minutes"}`)},
+		{name: "empty", subscription: subscription, payload: []byte{}},
+		{name: "near the record size", subscription: subscription, payload: bytes.Repeat([]byte("a"), 3000)},
+		{name: "padded base64 keys", subscription: padded, payload: []byte("hello")},
+		{name: "invalid key", subscription: PushSubscription{P256dh: "not-a-key", Auth: subscription.Auth}, wantErr: true},
+		{name: "key not on the curve", subscription: PushSubscription{P256dh: base64.RawURLEncoding.EncodeToString(make([]byte, 65)), Auth: subscription.Auth}, wantErr: true},
+		{name: "invalid auth secret", subscription: PushSubscription{P256dh: subscription.P256dh, Auth: "!!"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := encryptPushPayload(tt.subscription, tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("encryptPushPayload() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encryptPushPayload(): %v", err)
+			}
+			if got := decryptPushPayload(t, uaKey, authSecret, body); !bytes.Equal(got, tt.payload) {
+				t.Errorf("decrypted %q, want %q", got, tt.payload)
+			}
+		})
+	}
+
+	// Every message gets its own salt and key
+	a, _ := encryptPushPayload(subscription, []byte("same"))
+	b, _ := encryptPushPayload(subscription, []byte("same"))
+	if bytes.Equal(a, b) {
+		t.Error("two messages were encrypted the same way")
+	}
+}
+
+func TestValidatePublicURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://hooks.example.com/reminders"},
+		{url: "https://93.184.216.34/hook"},
+		{url: "http://hooks.example.com/reminders", wantErr: true},
+		{url: "ftp://hooks.example.com", wantErr: true},
+		{url: "https://127.0.0.1/hook", wantErr: true},
+		{url: "https://[::1]/hook", wantErr: true},
+		{url: "https://10.0.0.5/hook", wantErr: true},
+		{url: "https://192.168.1.1/hook", wantErr: true},
+		{url: "https://169.254.169.254/latest/meta-data", wantErr: true},
+		{url: "https://100.64.0.1/hook", wantErr: true},
+		{url: "https://0.0.0.0/hook", wantErr: true},
+		{url: "https:///hook", wantErr: true},
+		{url: "://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := validatePublicURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePublicURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublicClientRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The address is checked again when connecting, whatever the URL passed
+	_, err := newPublicClient(time.Second).Post(server.URL, "application/json", nil)
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("posting to %s: %v, want %v", server.URL, err, errNonPublicAddress)
+	}
+}
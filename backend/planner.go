@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+
+	// Tasks are planned into this much of the calendar ahead
+	planHorizon = 14 * 24 * time.Hour
+	// Tasks are split into blocks of at least this length
+	minTaskBlock = 30 * time.Minute
+	// Blocks start at multiples of this after midnight
+	taskBlockStep  = 15 * time.Minute
+	maxTaskMinutes = 40 * 60
+)
+
+// PlanTask is a task to be planned into the calendar
+type PlanTask struct {
+	TaskID string `json:"taskId,omitempty"`
+	ListID string `json:"listId,omitempty"`
+	Title  string `json:"title"`
+	// Estimate of the work left
+	Minutes int `json:"minutes"`
+	// Date (YYYY-MM-DD) the work has to be done by, empty without one
+	Due string `json:"due,omitempty"`
+	// PriorityHigh, PriorityNormal or PriorityLow, normal by default
+	Priority string `json:"priority,omitempty"`
+}
+
+// PlannedBlock is time proposed for working on a task
+type PlannedBlock struct {
+	PlanTask
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+// TaskBlock is an approved block in the default calendar of the main
+// account. It is moved when a meeting takes its place.
+type TaskBlock struct {
+	gorm.Model
+	UserID   uint `gorm:"index;not null"`
+	TaskID   string
+	ListID   string
+	Title    string
+	Due      string
+	Priority string
+	Start    time.Time `gorm:"index"`
+	End      time.Time
+	// ID of the event of the block, which is only ever moved when found here
+	EventID string `gorm:"index"`
+}
+
+func (b *TaskBlock) planTask() PlanTask {
+	return PlanTask{
+		TaskID:   b.TaskID,
+		ListID:   b.ListID,
+		Title:    b.Title,
+		Minutes:  int(b.End.Sub(b.Start).Minutes()),
+		Due:      b.Due,
+		Priority: b.Priority,
+	}
+}
+
+func (b *TaskBlock) event(loc *time.Location) Event {
+	return Event{
+		Title:       b.Title,
+		StartTime:   b.Start.UTC().Format(time.RFC3339),
+		EndTime:     b.End.UTC().Format(time.RFC3339),
+		TimeZone:    loc.String(),
+		Description: "Planned by your assistant.",
+	}
+}
+
+// taskBlockEvents are the event IDs of the blocks of the user
+func taskBlockEvents(userID uint) map[string]bool {
+	var ids []string
+	db.Model(&TaskBlock{}).Where("user_id = ? AND event_id <> ''", userID).Pluck("event_id", &ids)
+	arr := map[string]bool{}
+	for _, id := range ids {
+		arr[id] = true
+	}
+	return arr
+}
+
+func priorityRank(priority string) int {
+	switch priority {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// deadline is the end of the due day where the user is
+func (t *PlanTask) deadline(loc *time.Location) (time.Time, bool) {
+	due, err := time.ParseInLocation(dateLayout, t.Due, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return due.AddDate(0, 0, 1), true
+}
+
+// validatePlanTask checks a task of a plan. Blocks of approved plans have
+// their length instead of an estimate.
+func validatePlanTask(v *ValidationError, field string, task *PlanTask, estimate bool) {
+	if strings.TrimSpace(task.Title) == "" {
+		v.add(field+"title", "is required")
+	}
+	if estimate && (task.Minutes <= 0 || task.Minutes > maxTaskMinutes) {
+		v.add(field+"minutes", "must be between 1 and %d", maxTaskMinutes)
+	}
+	if task.Due != "" {
+		if _, err := time.Parse(dateLayout, task.Due); err != nil {
+			v.add(field+"due", "must be a date (YYYY-MM-DD)")
+		}
+	}
+	switch task.Priority {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+	default:
+		v.add(field+"priority", "must be %q, %q or %q", PriorityHigh, PriorityNormal, PriorityLow)
+	}
+}
+
+// planTaskBlocks places the tasks into the free intervals, the most
+// important and most urgent first. Tasks are split into blocks of at least
+// minBlock. Tasks that don't fit before their deadline are returned as
+// unplaced and take no time.
+func planTaskBlocks(tasks []PlanTask, free []Interval, minBlock time.Duration, loc *time.Location) ([]PlannedBlock, []PlanTask) {
+	tasks = append([]PlanTask(nil), tasks...)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if a, b := priorityRank(tasks[i].Priority), priorityRank(tasks[j].Priority); a != b {
+			return a < b
+		}
+		a, aOK := tasks[i].deadline(loc)
+		b, bOK := tasks[j].deadline(loc)
+		if aOK != bOK {
+			return aOK
+		}
+		return a.Before(b)
+	})
+	free = append([]Interval(nil), free...)
+
+	blocks := []PlannedBlock{}
+	unplaced := []PlanTask{}
+	for _, task := range tasks {
+		deadline, hasDeadline := task.deadline(loc)
+		remaining := time.Duration(task.Minutes) * time.Minute
+		left := append([]Interval(nil), free...)
+		var placed []PlannedBlock
+		for i := range left {
+			if remaining <= 0 {
+				break
+			}
+			start := roundUpTime(left[i].Start, taskBlockStep)
+			end := left[i].End
+			if hasDeadline && end.After(deadline) {
+				end = deadline
+			}
+			length := end.Sub(start)
+			if length > remaining {
+				length = remaining
+			}
+			if length <= 0 || length < minDuration(minBlock, remaining) {
+				continue
+			}
+			placed = append(placed, PlannedBlock{
+				PlanTask:  task,
+				StartTime: start.Format(time.RFC3339),
+				EndTime:   start.Add(length).Format(time.RFC3339),
+			})
+			left[i].Start = start.Add(length)
+			remaining -= length
+		}
+		if remaining > 0 {
+			unplaced = append(unplaced, task)
+			continue
+		}
+		free = left
+		blocks = append(blocks, placed...)
+	}
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].StartTime < blocks[j].StartTime })
+	return blocks, unplaced
+}
+
+func roundUpTime(t time.Time, step time.Duration) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	return midnight.Add((offset + step - 1) / step * step)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// freeForTasks is the working time of the user within the range that no
+// event or lunch break takes. Days without meetings are meant for work like
+// this, so they are included.
+func freeForTasks(user *User, events []*Event, start, end time.Time) []Interval {
+	loc := userLocation(user)
+	preference := getSchedulingPreference(user.ID)
+	hours := preference.WorkingHours()
+	hours.Days = parseWeekdays(preference.WorkDays)
+	busy := BusyIntervals(events, loc)
+	busy = mergeIntervals(append(busy, preference.LunchIntervals(start, end, loc)...))
+	return FreeIntervals(busy, SlotOptions{
+		WindowStart:  start,
+		WindowEnd:    end,
+		WorkingHours: hours,
+		Location:     loc,
+	})
+}
+
+// planTasks proposes blocks for the tasks in the free time of the next
+// weeks. Nothing is written until the user approves.
+func planTasks(user *User, service Calendar, tasks []PlanTask) ([]PlannedBlock, []PlanTask, error) {
+	now := time.Now()
+	end := now.Add(planHorizon)
+	events, err := service.GetEvents(now, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	free := freeForTasks(user, events, now, end)
+	blocks, unplaced := planTaskBlocks(tasks, free, minTaskBlock, userLocation(user))
+	return blocks, unplaced, nil
+}
+
+func PlanTasks(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Tasks []PlanTask `json:"tasks"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	v := &ValidationError{}
+	if len(json.Tasks) == 0 {
+		v.add("tasks", "needs at least one task")
+	}
+	for i := range json.Tasks {
+		validatePlanTask(v, fmt.Sprintf("tasks[%d].", i), &json.Tasks[i], true)
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	blocks, unplaced, err := planTasks(user, service, json.Tasks)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"blocks": blocks, "unplaced": unplaced})
+	return nil
+}
+
+// ApplyPlan writes the blocks the user approved. Blocks overlapping events
+// that came up in the meantime reject the whole plan.
+func ApplyPlan(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	loc := userLocation(user)
+
+	var json struct {
+		Blocks []PlannedBlock `json:"blocks"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	v := &ValidationError{}
+	if len(json.Blocks) == 0 {
+		v.add("blocks", "needs at least one block")
+	}
+	var blocks []*TaskBlock
+	for i, planned := range json.Blocks {
+		field := fmt.Sprintf("blocks[%d].", i)
+		start, startOK := validateEventTime(v, field+"startTime", planned.StartTime, true)
+		end, endOK := validateEventTime(v, field+"endTime", planned.EndTime, true)
+		if startOK && endOK && !end.After(start) {
+			v.add(field+"endTime", "must be after startTime")
+		}
+		validatePlanTask(v, field, &planned.PlanTask, false)
+		blocks = append(blocks, &TaskBlock{
+			UserID:   user.ID,
+			TaskID:   planned.TaskID,
+			ListID:   planned.ListID,
+			Title:    planned.Title,
+			Due:      planned.Due,
+			Priority: planned.Priority,
+			Start:    start,
+			End:      end,
+		})
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	var conflicts []Conflict
+	for _, block := range blocks {
+		found, err := findConflicts(service, block.event(loc), loc)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, found...)
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+
+	// A block that fails takes the ones written before it back
+	for i, block := range blocks {
+		eventID, err := createEventID(service, block.event(loc))
+		if err == nil {
+			block.EventID = eventID
+			if err = db.Create(block).Error; err != nil {
+				removeTaskBlockEvent(service, block, loc)
+			}
+		}
+		if err != nil {
+			for _, written := range blocks[:i] {
+				removeTaskBlockEvent(service, written, loc)
+				db.Unscoped().Delete(written)
+			}
+			return err
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "planned", "blocks": len(blocks)})
+	return nil
+}
+
+func removeTaskBlockEvent(service Calendar, block *TaskBlock, loc *time.Location) {
+	event := block.event(loc)
+	event.ID = block.EventID
+	if err := service.RemoveEvent(event); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// StartPlannerJob moves the blocks of all users out of the way of meetings
+// that took their place
+func StartPlannerJob() {
+	go func() {
+		for {
+			var userIDs []uint
+			if err := db.Model(&TaskBlock{}).Where("start > ?", time.Now()).Pluck("DISTINCT user_id", &userIDs).Error; err != nil {
+				log.Println(err.Error())
+			}
+			for _, userID := range userIDs {
+				if err := replanTasks(userID); err != nil {
+					log.Println(err.Error())
+				}
+			}
+			time.Sleep(policyInterval)
+		}
+	}()
+}
+
+// replanTasks moves the future blocks of the user that overlap other events
+// to the earliest free time before their deadline. Blocks that don't fit
+// anywhere stay where they are.
+func replanTasks(userID uint) error {
+	user := &User{}
+	if err := db.First(user, userID).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	var blocks []TaskBlock
+	if err := db.Where("user_id = ? AND start > ?", userID, now).Order("start").Find(&blocks).Error; err != nil {
+		return err
+	}
+
+	// Blocks are read back from where they are written, like policy blocks
+	target := newUserCalendar(user)
+	service := newUserService(user)
+	if target == nil || service == nil {
+		return errNoCalendar
+	}
+	loc := userLocation(user)
+	end := now.Add(planHorizon)
+	for _, block := range blocks {
+		end = maxTime(end, block.End)
+	}
+	events, err := service.GetEvents(now, end)
+	if err != nil {
+		return err
+	}
+	blockEvents := map[string]bool{}
+	for _, block := range blocks {
+		blockEvents[block.EventID] = true
+	}
+	var others []*Event
+	for _, event := range events {
+		if !blockEvents[event.ID] {
+			others = append(others, event)
+		}
+	}
+	busy := BusyIntervals(others, loc)
+
+	var kept []*Event
+	var moving []*TaskBlock
+	for i := range blocks {
+		overlaps := false
+		for _, interval := range busy {
+			if interval.Start.Before(blocks[i].End) && interval.End.After(blocks[i].Start) {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			moving = append(moving, &blocks[i])
+		} else {
+			event := blocks[i].event(loc)
+			kept = append(kept, &event)
+		}
+	}
+	if len(moving) == 0 {
+		return nil
+	}
+
+	existing, err := target.GetEvents(now, end)
+	if err != nil {
+		return err
+	}
+	written := map[string]*Event{}
+	for _, event := range existing {
+		if blockEvents[event.ID] {
+			written[event.ID] = event
+		}
+	}
+
+	free := freeForTasks(user, append(others, kept...), now, end)
+	for _, block := range moving {
+		// Moved blocks stay in one piece
+		event, ok := written[block.EventID]
+		if block.EventID == "" || !ok {
+			// The user removed the block
+			db.Delete(block)
+			continue
+		}
+		task := block.planTask()
+		planned, _ := planTaskBlocks([]PlanTask{task}, free, time.Duration(task.Minutes)*time.Minute, loc)
+		if len(planned) != 1 {
+			continue
+		}
+		start, _ := parseEventTime(planned[0].StartTime)
+		stop, _ := parseEventTime(planned[0].EndTime)
+		block.Start, block.End = start, stop
+		moved := block.event(loc)
+		moved.ID = event.ID
+		moved.CalendarID = event.CalendarID
+		if err := target.UpdateEvent(moved); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if err := db.Save(block).Error; err != nil {
+			log.Println(err.Error())
+		}
+		placed := block.event(loc)
+		free = freeForTasks(user, append(append(others, kept...), &placed), now, end)
+		kept = append(kept, &placed)
+	}
+	return nil
+}
+
+// checkAIPlan plans the tasks the assistant wants to time-block. The
+// blocks are added to the reply for the user to approve.
+func checkAIPlan(user *User, service Calendar, reply map[string]any, response string) string {
+	data, err := json.Marshal(reply["details"])
+	if err != nil {
+		return response
+	}
+	var details struct {
+		Tasks []PlanTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &details); err != nil {
+		return response
+	}
+
+	v := &ValidationError{}
+	if len(details.Tasks) == 0 {
+		v.add("tasks", "needs at least one task")
+	}
+	for i := range details.Tasks {
+		validatePlanTask(v, fmt.Sprintf("tasks[%d].", i), &details.Tasks[i], true)
+	}
+	if len(v.Fields) > 0 {
+		reply["errors"] = v.Fields
+	} else if blocks, unplaced, err := planTasks(user, service, details.Tasks); err != nil {
+		log.Println(err.Error())
+		reply["errors"] = []FieldError{{Field: "plan", Message: "could not be made: " + err.Error()}}
+	} else {
+		reply["plan"] = gin.H{"blocks": blocks, "unplaced": unplaced}
+	}
+
+	checked, err := json.Marshal(reply)
+	if err != nil {
+		return response
+	}
+	return string(checked)
+}
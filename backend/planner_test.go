@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanTaskBlocks(t *testing.T) {
+	block := func(title string, start, end time.Time) string {
+		return title + " " + start.Format(time.RFC3339) + " - " + end.Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name         string
+		tasks        []PlanTask
+		free         []Interval
+		want         []string
+		wantUnplaced []string
+	}{
+		{
+			name:  "fits the first free time",
+			tasks: []PlanTask{{Title: "Report", Minutes: 60}},
+			free:  []Interval{{day(8, 9, 0), day(8, 12, 0)}},
+			want:  []string{block("Report", day(8, 9, 0), day(8, 10, 0))},
+		},
+		{
+			name:         "important tasks first",
+			tasks:        []PlanTask{{Title: "Inbox", Minutes: 60, Priority: PriorityLow}, {Title: "Launch", Minutes: 60, Priority: PriorityHigh}},
+			free:         []Interval{{day(8, 9, 0), day(8, 10, 0)}},
+			want:         []string{block("Launch", day(8, 9, 0), day(8, 10, 0))},
+			wantUnplaced: []string{"Inbox"},
+		},
+		{
+			name:  "urgent tasks first",
+			tasks: []PlanTask{{Title: "Later", Minutes: 60, Due: "2024-01-20"}, {Title: "Sooner", Minutes: 60, Due: "2024-01-08"}, {Title: "Whenever", Minutes: 60}},
+			free:  []Interval{{day(8, 9, 0), day(8, 12, 0)}},
+			want: []string{
+				block("Sooner", day(8, 9, 0), day(8, 10, 0)),
+				block("Later", day(8, 10, 0), day(8, 11, 0)),
+				block("Whenever", day(8, 11, 0), day(8, 12, 0)),
+			},
+		},
+		{
+			name:  "split over free times",
+			tasks: []PlanTask{{Title: "Review", Minutes: 90}},
+			free:  []Interval{{day(8, 9, 0), day(8, 10, 0)}, {day(8, 11, 0), day(8, 11, 45)}},
+			want: []string{
+				block("Review", day(8, 9, 0), day(8, 10, 0)),
+				block("Review", day(8, 11, 0), day(8, 11, 30)),
+			},
+		},
+		{
+			name:  "gaps shorter than a block are skipped",
+			tasks: []PlanTask{{Title: "Review", Minutes: 60}},
+			free:  []Interval{{day(8, 9, 0), day(8, 9, 20)}, {day(8, 10, 0), day(8, 11, 0)}},
+			want:  []string{block("Review", day(8, 10, 0), day(8, 11, 0))},
+		},
+		{
+			name:  "short tasks fit short gaps",
+			tasks: []PlanTask{{Title: "Call back", Minutes: 15}},
+			free:  []Interval{{day(8, 9, 0), day(8, 9, 20)}},
+			want:  []string{block("Call back", day(8, 9, 0), day(8, 9, 15))},
+		},
+		{
+			name:  "blocks start on the step",
+			tasks: []PlanTask{{Title: "Report", Minutes: 60}},
+			free:  []Interval{{day(8, 9, 5), day(8, 10, 30)}},
+			want:  []string{block("Report", day(8, 9, 15), day(8, 10, 15))},
+		},
+		{
+			name:         "no time before the deadline",
+			tasks:        []PlanTask{{Title: "Taxes", Minutes: 60, Due: "2024-01-08"}},
+			free:         []Interval{{day(9, 9, 0), day(9, 17, 0)}},
+			want:         []string{},
+			wantUnplaced: []string{"Taxes"},
+		},
+		{
+			name:         "unplaced tasks leave their time to others",
+			tasks:        []PlanTask{{Title: "Rewrite", Minutes: 120, Priority: PriorityHigh}, {Title: "Report", Minutes: 60}},
+			free:         []Interval{{day(8, 9, 0), day(8, 10, 0)}},
+			want:         []string{block("Report", day(8, 9, 0), day(8, 10, 0))},
+			wantUnplaced: []string{"Rewrite"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, unplaced := planTaskBlocks(tt.tasks, tt.free, minTaskBlock, time.UTC)
+			got := []string{}
+			for _, b := range blocks {
+				start, _ := time.Parse(time.RFC3339, b.StartTime)
+				end, _ := time.Parse(time.RFC3339, b.EndTime)
+				got = append(got, block(b.Title, start, end))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blocks = %v, want %v", got, tt.want)
+			}
+			var gotUnplaced []string
+			for _, task := range unplaced {
+				gotUnplaced = append(gotUnplaced, task.Title)
+			}
+			if !reflect.DeepEqual(gotUnplaced, tt.wantUnplaced) {
+				t.Errorf("unplaced = %v, want %v", gotUnplaced, tt.wantUnplaced)
+			}
+		})
+	}
+}
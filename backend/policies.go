@@ -0,0 +1,527 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	PolicyFocus  string = "focus"
+	PolicyBuffer string = "buffer"
+
+	// Blocks are kept for this long ahead
+	policyHorizon  = 14 * 24 * time.Hour
+	policyInterval = 15 * time.Minute
+)
+
+// PolicyRule is a rule for keeping time free, like "2 hours of focus time
+// each morning" or "15 minutes after external meetings". The blocks are
+// created in the default calendar of the main account.
+type PolicyRule struct {
+	gorm.Model
+	UserID uint `gorm:"index;not null"`
+	// PolicyFocus or PolicyBuffer
+	Kind string
+	// Title of the blocks, by default "Focus time" or "Buffer"
+	Title string
+	// Focus time: Minutes kept free between WindowStart and WindowEnd, like
+	// "08:00" and "12:00", on Days (weekdays as numbers, Sunday being 0)
+	Days        string
+	WindowStart string
+	WindowEnd   string
+	// Length of focus time and buffers
+	Minutes int
+	// Buffers: where they go, and which meetings get them
+	Before       bool
+	After        bool
+	ExternalOnly bool
+	// Meetings with a location, for travel time
+	InPersonOnly bool
+}
+
+// PolicyBlock is a block created for a rule. Blocks are only ever removed
+// when they are found here, never by what an event looks like.
+type PolicyBlock struct {
+	gorm.Model
+	UserID  uint   `gorm:"index;not null"`
+	RuleID  uint   `gorm:"not null"`
+	EventID string `gorm:"index;not null"`
+	// Blocks are kept for analytics after they are over
+	Start time.Time
+	End   time.Time
+}
+
+func (r *PolicyRule) title() string {
+	if r.Title != "" {
+		return r.Title
+	}
+	if r.Kind == PolicyFocus {
+		return "Focus time"
+	}
+	return "Buffer"
+}
+
+func (r *PolicyRule) weekdays() []time.Weekday {
+	return parseWeekdays(r.Days)
+}
+
+// policyBlockRules maps the event IDs of the blocks of the user to the rules
+// they were created for
+func policyBlockRules(userID uint) map[string]uint {
+	var blocks []PolicyBlock
+	db.Where("user_id = ?", userID).Find(&blocks)
+	rules := map[string]uint{}
+	for _, block := range blocks {
+		rules[block.EventID] = block.RuleID
+	}
+	return rules
+}
+
+func policyBlockKey(ruleID uint, start, end time.Time) string {
+	return fmt.Sprint(ruleID, "/", start.Unix(), "/", end.Unix())
+}
+
+// StartPolicyJob keeps the blocks of all users in line with their calendars
+func StartPolicyJob() {
+	go func() {
+		for {
+			var userIDs []uint
+			if err := db.Model(&PolicyRule{}).Pluck("DISTINCT user_id", &userIDs).Error; err != nil {
+				log.Println(err.Error())
+			}
+			for _, userID := range userIDs {
+				if err := applyPolicies(userID); err != nil {
+					log.Println(err.Error())
+				}
+			}
+			time.Sleep(policyInterval)
+		}
+	}()
+}
+
+// Runs for the same user, from the job and after saving rules, go one after
+// another, so that a block isn't created or removed twice
+var policyLocks sync.Map
+
+// applyPolicies creates the blocks the rules of the user ask for and removes
+// the ones no longer needed, like when a meeting moved
+func applyPolicies(userID uint) error {
+	lock, _ := policyLocks.LoadOrStore(userID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	user := &User{}
+	if err := db.First(user, userID).Error; err != nil {
+		return err
+	}
+	var rules []PolicyRule
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&rules).Error; err != nil {
+		return err
+	}
+
+	// Blocks are read back from where they are written, whatever calendars
+	// the user selected
+	target := newUserCalendar(user)
+	service := newUserService(user)
+	if target == nil || service == nil {
+		return errNoCalendar
+	}
+
+	// Blocks are planned from the start of the day, so that they stay where
+	// they are as the day goes on
+	loc := userLocation(user)
+	now := time.Now()
+	today := time.Date(now.In(loc).Year(), now.In(loc).Month(), now.In(loc).Day(), 0, 0, 0, 0, loc)
+	end := now.Add(policyHorizon)
+	events, err := service.GetEvents(today, end)
+	if err != nil {
+		return err
+	}
+	// Task blocks are busy, but they aren't meetings that need buffers
+	blockRules := policyBlockRules(userID)
+	taskBlocks := taskBlockEvents(userID)
+	var meetings, planned []*Event
+	for _, event := range events {
+		switch {
+		case taskBlocks[event.ID]:
+			planned = append(planned, event)
+		case blockRules[event.ID] == 0:
+			meetings = append(meetings, event)
+		}
+	}
+
+	busy := BusyIntervals(append(meetings, planned...), loc)
+	wanted := map[string]*Event{}
+	blocks := map[string]*PolicyBlock{}
+	add := func(rule *PolicyRule, interval Interval) {
+		busy = mergeIntervals(append(busy, interval))
+		if !interval.Start.After(now) {
+			return
+		}
+		wanted[policyBlockKey(rule.ID, interval.Start, interval.End)] = &Event{
+			Title:       rule.title(),
+			StartTime:   interval.Start.UTC().Format(time.RFC3339),
+			EndTime:     interval.End.UTC().Format(time.RFC3339),
+			TimeZone:    loc.String(),
+			Description: "Kept free by your assistant.",
+		}
+		blocks[policyBlockKey(rule.ID, interval.Start, interval.End)] = &PolicyBlock{
+			UserID: userID,
+			RuleID: rule.ID,
+			Start:  interval.Start,
+			End:    interval.End,
+		}
+	}
+
+	// Buffers come first, so that focus time is planned around them
+	internal := internalDomains(user)
+	for i := range rules {
+		if rules[i].Kind == PolicyBuffer {
+			for _, interval := range bufferIntervals(&rules[i], meetings, busy, internal) {
+				add(&rules[i], interval)
+			}
+		}
+	}
+	for i := range rules {
+		if rules[i].Kind == PolicyFocus {
+			for _, interval := range focusIntervals(&rules[i], busy, today, end, loc) {
+				add(&rules[i], interval)
+			}
+		}
+	}
+
+	existing, err := target.GetEvents(now, end)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, event := range existing {
+		ruleID := blockRules[event.ID]
+		if ruleID == 0 {
+			continue
+		}
+		found[event.ID] = true
+		start, err := parseEventTime(event.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := parseEventTime(event.EndTime)
+		if err != nil {
+			continue
+		}
+		key := policyBlockKey(ruleID, start, end)
+		if _, ok := wanted[key]; ok {
+			delete(wanted, key)
+			continue
+		}
+		// Blocks that already started are left alone
+		if start.After(now) {
+			if err := target.RemoveEvent(*event); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			db.Where("user_id = ? AND event_id = ?", userID, event.ID).Delete(&PolicyBlock{})
+		}
+	}
+	// Blocks the user removed
+	var upcoming []PolicyBlock
+	db.Where("user_id = ? AND start > ?", userID, now).Find(&upcoming)
+	for i := range upcoming {
+		if !found[upcoming[i].EventID] {
+			db.Delete(&upcoming[i])
+		}
+	}
+	for key, event := range wanted {
+		eventID, err := createEventID(target, *event)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		block := blocks[key]
+		block.EventID = eventID
+		if err := db.Create(block).Error; err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return nil
+}
+
+// focusIntervals keeps the earliest stretch of the window that fits the
+// focus time free on each day
+func focusIntervals(rule *PolicyRule, busy []Interval, start, end time.Time, loc *time.Location) []Interval {
+	windowStart, err := parseClock(rule.WindowStart)
+	if err != nil {
+		return nil
+	}
+	windowEnd, err := parseClock(rule.WindowEnd)
+	if err != nil {
+		return nil
+	}
+	duration := time.Duration(rule.Minutes) * time.Minute
+	free := FreeIntervals(busy, SlotOptions{
+		WindowStart:  start,
+		WindowEnd:    end,
+		WorkingHours: WorkingHours{Start: windowStart, End: windowEnd, Days: rule.weekdays()},
+		Location:     loc,
+	})
+
+	var arr []Interval
+	planned := map[string]bool{}
+	for _, interval := range free {
+		day := interval.Start.Format(dateLayout)
+		if planned[day] || interval.End.Sub(interval.Start) < duration {
+			continue
+		}
+		planned[day] = true
+		arr = append(arr, Interval{Start: interval.Start, End: interval.Start.Add(duration)})
+	}
+	return arr
+}
+
+// bufferIntervals returns the buffers around the meetings the rule applies
+// to, cut short where they would run into other events
+func bufferIntervals(rule *PolicyRule, meetings []*Event, busy []Interval, internal map[string]bool) []Interval {
+	duration := time.Duration(rule.Minutes) * time.Minute
+	busy = append([]Interval(nil), busy...)
+	var arr []Interval
+	for _, meeting := range meetings {
+		if meeting.AllDay || (rule.InPersonOnly && meeting.Location == "") || (rule.ExternalOnly && !isExternalMeeting(meeting, internal)) {
+			continue
+		}
+		start, err := parseEventTime(meeting.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := parseEventTime(meeting.EndTime)
+		if err != nil {
+			continue
+		}
+		if rule.Before {
+			from := start.Add(-duration)
+			for _, b := range busy {
+				if b.Start.Before(start) && b.End.After(from) {
+					from = minTime(b.End, start)
+				}
+			}
+			if from.Before(start) {
+				interval := Interval{Start: from, End: start}
+				arr = append(arr, interval)
+				busy = mergeIntervals(append(busy, interval))
+			}
+		}
+		if rule.After {
+			until := end.Add(duration)
+			for _, b := range busy {
+				if b.End.After(end) && b.Start.Before(until) {
+					until = maxTime(b.Start, end)
+				}
+			}
+			if end.Before(until) {
+				interval := Interval{Start: end, End: until}
+				arr = append(arr, interval)
+				// Buffers of the next meetings keep clear of this one
+				busy = mergeIntervals(append(busy, interval))
+			}
+		}
+	}
+	return arr
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// internalDomains are the email domains of the accounts of the user
+func internalDomains(user *User) map[string]bool {
+	domains := map[string]bool{emailDomain(user.Email): true}
+	var accounts []LinkedAccount
+	db.Where("user_id = ?", user.ID).Find(&accounts)
+	for _, account := range accounts {
+		domains[emailDomain(account.Email)] = true
+	}
+	return domains
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	return domain
+}
+
+func isExternalMeeting(event *Event, internal map[string]bool) bool {
+	for _, attendee := range event.Attendees {
+		if !internal[emailDomain(attendee.Email)] {
+			return true
+		}
+	}
+	return false
+}
+
+type policyRuleJSON struct {
+	ID           uint   `json:"id"`
+	Kind         string `json:"kind"`
+	Title        string `json:"title"`
+	Days         []int  `json:"days"`
+	WindowStart  string `json:"windowStart"`
+	WindowEnd    string `json:"windowEnd"`
+	Minutes      int    `json:"minutes"`
+	Before       bool   `json:"before"`
+	After        bool   `json:"after"`
+	ExternalOnly bool   `json:"externalOnly"`
+	InPersonOnly bool   `json:"inPersonOnly"`
+}
+
+func GetPolicies(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var rules []PolicyRule
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&rules).Error; err != nil {
+		return err
+	}
+	arr := []policyRuleJSON{}
+	for _, rule := range rules {
+		arr = append(arr, policyRuleJSON{
+			ID:           rule.ID,
+			Kind:         rule.Kind,
+			Title:        rule.Title,
+			Days:         weekdayNumbers(rule.weekdays()),
+			WindowStart:  rule.WindowStart,
+			WindowEnd:    rule.WindowEnd,
+			Minutes:      rule.Minutes,
+			Before:       rule.Before,
+			After:        rule.After,
+			ExternalOnly: rule.ExternalOnly,
+			InPersonOnly: rule.InPersonOnly,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": arr})
+	return nil
+}
+
+// SetPolicies replaces the rules of the user. Rules sent with their id keep
+// their blocks.
+func SetPolicies(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Rules []policyRuleJSON `json:"rules"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	v := &ValidationError{}
+	for i, rule := range json.Rules {
+		field := fmt.Sprintf("rules[%d].", i)
+		if rule.Minutes <= 0 || rule.Minutes > 8*60 {
+			v.add(field+"minutes", "must be between 1 and 480")
+		}
+		switch rule.Kind {
+		case PolicyFocus:
+			start, err := parseClock(rule.WindowStart)
+			if err != nil {
+				v.add(field+"windowStart", "must be a time of day like 08:00")
+			}
+			end, err := parseClock(rule.WindowEnd)
+			if err != nil {
+				v.add(field+"windowEnd", "must be a time of day like 12:00")
+			}
+			if end-start < rule.Minutes {
+				v.add(field+"windowEnd", "leaves no room for %d minutes", rule.Minutes)
+			}
+			if len(rule.Days) == 0 {
+				v.add(field+"days", "needs at least one weekday")
+			}
+			for _, day := range rule.Days {
+				if day < 0 || day > 6 {
+					v.add(field+"days", "are numbers from 0 (Sunday) to 6")
+				}
+			}
+		case PolicyBuffer:
+			if !rule.Before && !rule.After {
+				v.add(field+"before", "or after has to be set")
+			}
+		default:
+			v.add(field+"kind", "must be %q or %q", PolicyFocus, PolicyBuffer)
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	var kept []uint
+	for _, rule := range json.Rules {
+		if rule.ID != 0 {
+			kept = append(kept, rule.ID)
+		}
+	}
+	scope := tx.Where("user_id = ?", user.ID)
+	if len(kept) > 0 {
+		scope = scope.Where("id NOT IN (?)", kept)
+	}
+	if err := scope.Delete(&PolicyRule{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, rule := range json.Rules {
+		saved := &PolicyRule{}
+		if rule.ID != 0 {
+			if err := tx.Where("user_id = ? AND id = ?", user.ID, rule.ID).First(saved).Error; err != nil {
+				tx.Rollback()
+				return fmt.Errorf("unknown rule %d", rule.ID)
+			}
+		}
+		saved.UserID = user.ID
+		saved.Kind = rule.Kind
+		saved.Title = rule.Title
+		saved.Days = joinInts(rule.Days)
+		saved.WindowStart = rule.WindowStart
+		saved.WindowEnd = rule.WindowEnd
+		saved.Minutes = rule.Minutes
+		saved.Before = rule.Before
+		saved.After = rule.After
+		saved.ExternalOnly = rule.ExternalOnly
+		saved.InPersonOnly = rule.InPersonOnly
+		if err := tx.Save(saved).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	// Also removes the blocks of deleted rules
+	go func() {
+		if err := applyPolicies(user.ID); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+	c.JSON(http.StatusOK, gin.H{"status": "saved"})
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyPoliciesRunsOneAtATime(t *testing.T) {
+	database := useFakeDatabase(t, nil)
+
+	// A run for the user is going on
+	lock, _ := policyLocks.LoadOrStore(uint(7), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+
+	done := make(chan struct{})
+	go func() {
+		applyPolicies(7)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("applyPolicies() ran while another run for the user was going on")
+	case <-time.After(100 * time.Millisecond):
+	}
+	database.mu.Lock()
+	queries := len(database.queries)
+	database.mu.Unlock()
+	if queries != 0 {
+		t.Errorf("%d queries before the other run ended, want 0", queries)
+	}
+
+	lock.(*sync.Mutex).Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("applyPolicies() didn't run after the other run ended")
+	}
+
+	// Other users don't wait
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	other := make(chan struct{})
+	go func() {
+		applyPolicies(8)
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("applyPolicies() of another user waited")
+	}
+}
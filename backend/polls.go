@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	PollOpen      = "open"
+	PollScheduled = "scheduled"
+	PollExpired   = "expired"
+
+	pollInterval = 5 * time.Minute
+	// Polls without an expiry take votes for this long
+	pollDefaultExpiry = 7 * 24 * time.Hour
+	pollMaxExpiry     = 60 * 24 * time.Hour
+	// Expired polls are deleted after this long
+	pollRetention = 90 * 24 * time.Hour
+	maxPollSlots  = 20
+	maxPollVoters = 100
+	// Slots suggested from free time, at most one a day
+	pollSuggestions = 5
+)
+
+var (
+	errPollClosed = errors.New("the poll no longer takes votes")
+	errPollFull   = errors.New("the poll takes no more voters")
+)
+
+// Poll asks participants without accounts which of the slots suits them.
+// Anyone with the token can see the poll and vote.
+type Poll struct {
+	gorm.Model
+	UserID      uint   `gorm:"index;not null"`
+	Token       string `gorm:"unique_index;not null"`
+	Title       string
+	Description string
+	Location    string
+	// PollOpen, PollScheduled or PollExpired
+	Status    string
+	ExpiresAt time.Time `gorm:"index"`
+	// Schedule the winning slot when the poll expires
+	AutoSchedule bool
+	ChosenSlotID uint
+	Slots        []PollSlot
+	Votes        []PollVote
+}
+
+type PollSlot struct {
+	gorm.Model
+	PollID uint `gorm:"index;not null"`
+	Start  time.Time
+	End    time.Time
+}
+
+// PollVote is a slot that suits a participant. Participants are told apart
+// by a secret handed out with their first vote, of which only the hash is
+// kept, and replace their votes when they vote again with it.
+type PollVote struct {
+	gorm.Model
+	PollID uint   `gorm:"index;not null"`
+	SlotID uint   `gorm:"index;not null"`
+	Voter  string `gorm:"index"`
+	Name   string
+	Email  string
+}
+
+func hashVoterToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadPoll(query string, args ...any) (*Poll, error) {
+	poll := &Poll{}
+	if err := db.Preload("Slots", func(db *gorm.DB) *gorm.DB {
+		return db.Order("start")
+	}).Preload("Votes").Where(query, args...).First(poll).Error; err != nil {
+		return nil, fmt.Errorf("poll not found")
+	}
+	return poll, nil
+}
+
+// participants are the people who voted, in the order they first voted
+func (p *Poll) participants() []Attendee {
+	return voteAttendees(p.Votes)
+}
+
+func voteAttendees(votes []PollVote) []Attendee {
+	seen := map[string]bool{}
+	var arr []Attendee
+	for _, vote := range votes {
+		email := strings.ToLower(vote.Email)
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		arr = append(arr, Attendee{Email: vote.Email, Name: vote.Name, Status: StatusNeedsAction})
+	}
+	return arr
+}
+
+func (p *Poll) hasVoter(voter string) bool {
+	for _, vote := range p.Votes {
+		if vote.Voter == voter {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Poll) slotVotes(slotID uint) []PollVote {
+	var arr []PollVote
+	for _, vote := range p.Votes {
+		if vote.SlotID == slotID {
+			arr = append(arr, vote)
+		}
+	}
+	return arr
+}
+
+// winner is the future slot with the most votes, the earliest of equals
+func (p *Poll) winner() *PollSlot {
+	var best *PollSlot
+	bestVotes := 0
+	now := time.Now()
+	for i := range p.Slots {
+		slot := &p.Slots[i]
+		votes := len(p.slotVotes(slot.ID))
+		if !slot.Start.After(now) || votes == 0 {
+			continue
+		}
+		if best == nil || votes > bestVotes || (votes == bestVotes && slot.Start.Before(best.Start)) {
+			best, bestVotes = slot, votes
+		}
+	}
+	return best
+}
+
+func (p *Poll) slot(id uint) *PollSlot {
+	for i := range p.Slots {
+		if p.Slots[i].ID == id {
+			return &p.Slots[i]
+		}
+	}
+	return nil
+}
+
+func (p *Poll) takesVotes() bool {
+	return p.Status == PollOpen && time.Now().Before(p.ExpiresAt)
+}
+
+func (p *Poll) event(slot *PollSlot, loc *time.Location) Event {
+	return Event{
+		Title:       p.Title,
+		StartTime:   slot.Start.UTC().Format(time.RFC3339),
+		EndTime:     slot.End.UTC().Format(time.RFC3339),
+		TimeZone:    loc.String(),
+		Location:    p.Location,
+		Description: p.Description,
+		Attendees:   voteAttendees(p.slotVotes(slot.ID)),
+	}
+}
+
+type pollSlotJSON struct {
+	ID        uint     `json:"id"`
+	StartTime string   `json:"startTime"`
+	EndTime   string   `json:"endTime"`
+	Votes     []string `json:"votes"`
+}
+
+type pollJSON struct {
+	ID           uint           `json:"id,omitempty"`
+	Token        string         `json:"token,omitempty"`
+	Link         string         `json:"link"`
+	Title        string         `json:"title"`
+	Description  string         `json:"description,omitempty"`
+	Location     string         `json:"location,omitempty"`
+	Organizer    string         `json:"organizer,omitempty"`
+	Status       string         `json:"status"`
+	ExpiresAt    string         `json:"expiresAt"`
+	AutoSchedule bool           `json:"autoSchedule"`
+	ChosenSlotID uint           `json:"chosenSlotId,omitempty"`
+	Slots        []pollSlotJSON `json:"slots"`
+	Participants []Attendee     `json:"participants,omitempty"`
+}
+
+// toJSON describes the poll for its owner, or for participants without
+// their email addresses
+func (p *Poll) toJSON(owner bool) pollJSON {
+	result := pollJSON{
+		Link:         "/poll/" + p.Token,
+		Title:        p.Title,
+		Description:  p.Description,
+		Location:     p.Location,
+		Status:       p.Status,
+		ExpiresAt:    p.ExpiresAt.UTC().Format(time.RFC3339),
+		AutoSchedule: p.AutoSchedule,
+		ChosenSlotID: p.ChosenSlotID,
+		Slots:        []pollSlotJSON{},
+	}
+	if p.Status == PollOpen && !p.takesVotes() {
+		// The job hasn't caught up yet
+		result.Status = PollExpired
+	}
+	for _, slot := range p.Slots {
+		votes := []string{}
+		for _, vote := range p.slotVotes(slot.ID) {
+			name := vote.Name
+			if owner {
+				name += " <" + vote.Email + ">"
+			}
+			votes = append(votes, name)
+		}
+		result.Slots = append(result.Slots, pollSlotJSON{
+			ID:        slot.ID,
+			StartTime: slot.Start.UTC().Format(time.RFC3339),
+			EndTime:   slot.End.UTC().Format(time.RFC3339),
+			Votes:     votes,
+		})
+	}
+	if owner {
+		result.ID = p.ID
+		result.Token = p.Token
+		result.Participants = p.participants()
+	}
+	return result
+}
+
+// suggestPollSlots picks free slots of the user in the next two weeks, at
+// most one a day so that participants have a choice
+func suggestPollSlots(user *User, service Calendar, duration time.Duration) ([]Interval, error) {
+	loc := userLocation(user)
+	preference := getSchedulingPreference(user.ID)
+	// Participants need time to vote
+	start := time.Now().Add(24 * time.Hour)
+	end := start.Add(14 * 24 * time.Hour)
+	events, err := service.GetEvents(start, end)
+	if err != nil {
+		return nil, err
+	}
+	busy := BusyIntervals(events, loc)
+	busy = mergeIntervals(append(busy, preference.LunchIntervals(start, end, loc)...))
+	slots := FindFreeSlots(busy, SlotOptions{
+		Duration:     duration,
+		WindowStart:  start,
+		WindowEnd:    end,
+		WorkingHours: preference.WorkingHours(),
+		Location:     loc,
+	})
+
+	var arr []Interval
+	days := map[string]bool{}
+	for _, slot := range slots {
+		day := slot.Start.Format(dateLayout)
+		if days[day] {
+			continue
+		}
+		days[day] = true
+		arr = append(arr, slot)
+		if len(arr) >= pollSuggestions {
+			break
+		}
+	}
+	return arr, nil
+}
+
+func CreatePoll(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Title        string `json:"title"`
+		Description  string `json:"description"`
+		Location     string `json:"location"`
+		ExpiresAt    string `json:"expiresAt"`
+		AutoSchedule bool   `json:"autoSchedule"`
+		// Without slots they are suggested from free time
+		Slots []struct {
+			StartTime string `json:"startTime"`
+			EndTime   string `json:"endTime"`
+		} `json:"slots"`
+		// Length of suggested slots, the default meeting length by default
+		Minutes int `json:"minutes"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	poll := &Poll{
+		UserID:       user.ID,
+		Title:        strings.TrimSpace(json.Title),
+		Description:  json.Description,
+		Location:     json.Location,
+		Status:       PollOpen,
+		ExpiresAt:    now.Add(pollDefaultExpiry),
+		AutoSchedule: json.AutoSchedule,
+	}
+	v := &ValidationError{}
+	if poll.Title == "" {
+		v.add("title", "is required")
+	}
+	if len(poll.Title) > maxTitleLength {
+		v.add("title", "can be at most %d characters", maxTitleLength)
+	}
+	if json.ExpiresAt != "" {
+		if poll.ExpiresAt, err = time.Parse(time.RFC3339, json.ExpiresAt); err != nil {
+			v.add("expiresAt", "must be an RFC 3339 time")
+		} else if !poll.ExpiresAt.After(now) || poll.ExpiresAt.Sub(now) > pollMaxExpiry {
+			v.add("expiresAt", "must be in the next 60 days")
+		}
+	}
+	if len(json.Slots) > maxPollSlots {
+		v.add("slots", "can be at most %d", maxPollSlots)
+	}
+	for i, slot := range json.Slots {
+		field := fmt.Sprintf("slots[%d].", i)
+		start, startOK := validateEventTime(v, field+"startTime", slot.StartTime, true)
+		end, endOK := validateEventTime(v, field+"endTime", slot.EndTime, true)
+		if !startOK || !endOK {
+			continue
+		}
+		if !end.After(start) {
+			v.add(field+"endTime", "must be after startTime")
+		} else if !start.After(now) {
+			v.add(field+"startTime", "must be in the future")
+		}
+		poll.Slots = append(poll.Slots, PollSlot{Start: start, End: end})
+	}
+	if json.Minutes < 0 || json.Minutes > 8*60 {
+		v.add("minutes", "must be between 1 and 480")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	if len(poll.Slots) == 0 {
+		duration := getSchedulingPreference(user.ID).DefaultDuration()
+		if json.Minutes > 0 {
+			duration = time.Duration(json.Minutes) * time.Minute
+		}
+		suggested, err := suggestPollSlots(user, service, duration)
+		if err != nil {
+			return err
+		}
+		if len(suggested) == 0 {
+			v.add("slots", "are required, there is no free time in the next two weeks")
+			return v
+		}
+		for _, interval := range suggested {
+			poll.Slots = append(poll.Slots, PollSlot{Start: interval.Start, End: interval.End})
+		}
+	}
+
+	sort.Slice(poll.Slots, func(i, j int) bool { return poll.Slots[i].Start.Before(poll.Slots[j].Start) })
+	if poll.Token, err = newEventUID(); err != nil {
+		return err
+	}
+	// Slots are created along with the poll
+	if err := db.Create(poll).Error; err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "created", "poll": poll.toJSON(true)})
+	return nil
+}
+
+func GetPolls(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var polls []Poll
+	if err := db.Preload("Slots", func(db *gorm.DB) *gorm.DB {
+		return db.Order("start")
+	}).Preload("Votes").Where("user_id = ?", user.ID).Order("created_at desc").Find(&polls).Error; err != nil {
+		return err
+	}
+	arr := []pollJSON{}
+	for i := range polls {
+		arr = append(arr, polls[i].toJSON(true))
+	}
+	c.JSON(http.StatusOK, gin.H{"polls": arr})
+	return nil
+}
+
+// SchedulePoll turns a slot into an event with the participants invited.
+// Without a slot the winner is taken.
+func SchedulePoll(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		ID           uint `json:"id"`
+		SlotID       uint `json:"slotId"`
+		AllowOverlap bool `json:"allowOverlap"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	poll, err := loadPoll("id = ? AND user_id = ?", json.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	if poll.Status == PollScheduled {
+		return fmt.Errorf("the poll has been scheduled already")
+	}
+	slot := poll.winner()
+	if json.SlotID != 0 {
+		slot = poll.slot(json.SlotID)
+	}
+	if slot == nil {
+		v := &ValidationError{}
+		v.add("slotId", "is required, no slot has votes")
+		return v
+	}
+
+	loc := userLocation(user)
+	event := poll.event(slot, loc)
+	if !json.AllowOverlap {
+		conflicts, err := findConflicts(service, event, loc)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return &ConflictError{Conflicts: conflicts}
+		}
+	}
+	if err := schedulePoll(poll, slot, service, event); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "scheduled", "poll": poll.toJSON(true)})
+	return nil
+}
+
+func schedulePoll(poll *Poll, slot *PollSlot, service Calendar, event Event) error {
+	if err := service.CreateEvent(event); err != nil {
+		return err
+	}
+	poll.Status = PollScheduled
+	poll.ChosenSlotID = slot.ID
+	return db.Model(poll).Updates(map[string]any{"status": poll.Status, "chosen_slot_id": poll.ChosenSlotID}).Error
+}
+
+func RemovePoll(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+	var json struct {
+		ID uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	poll, err := loadPoll("id = ? AND user_id = ?", json.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	if err := deletePoll(poll); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	return nil
+}
+
+func deletePoll(poll *Poll) error {
+	tx := db.Begin()
+	for _, value := range []any{&PollVote{}, &PollSlot{}} {
+		if err := tx.Unscoped().Where("poll_id = ?", poll.ID).Delete(value).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Unscoped().Delete(poll).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// GetPublicPoll shows a poll to anyone with its token
+func GetPublicPoll(c *gin.Context) error {
+	poll, err := loadPoll("token = ?", c.Param("token"))
+	if err != nil {
+		return err
+	}
+	result := poll.toJSON(false)
+	owner := &User{}
+	if db.First(owner, poll.UserID).Error == nil {
+		result.Organizer = owner.Email
+	}
+	c.JSON(http.StatusOK, result)
+	return nil
+}
+
+// VotePoll records the slots that suit a participant. A participant who
+// sends the voterToken of an earlier vote replaces those votes, anyone else
+// is a new voter and gets a token.
+func VotePoll(c *gin.Context) error {
+	poll, err := loadPoll("token = ?", c.Param("token"))
+	if err != nil {
+		return err
+	}
+	if !poll.takesVotes() {
+		return errPollClosed
+	}
+
+	var json struct {
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+		Slots      []uint `json:"slots"`
+		VoterToken string `json:"voterToken"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	v := &ValidationError{}
+	name := strings.TrimSpace(json.Name)
+	if name == "" || len(name) > 200 {
+		v.add("name", "is required")
+	}
+	if hasControlChars(name) {
+		v.add("name", "can't contain line breaks or control characters")
+	}
+	address, err := mail.ParseAddress(json.Email)
+	if err != nil {
+		v.add("email", "is not an email address")
+	}
+	for _, id := range json.Slots {
+		if poll.slot(id) == nil {
+			v.add("slots", "%d is not a slot of the poll", id)
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	token := json.VoterToken
+	newVoter := token == "" || !poll.hasVoter(hashVoterToken(token))
+	if newVoter {
+		if token, err = newEventUID(); err != nil {
+			return err
+		}
+	}
+	voter := hashVoterToken(token)
+
+	email := strings.ToLower(address.Address)
+	tx := db.Begin()
+	if newVoter {
+		// Lock the poll so that concurrent first votes can't pass the cap
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&Poll{}, poll.ID).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		voters := 0
+		if err := tx.Model(&PollVote{}).Where("poll_id = ?", poll.ID).
+			Select("count(distinct coalesce(nullif(voter, ''), lower(email)))").Row().Scan(&voters); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if voters >= maxPollVoters {
+			tx.Rollback()
+			return errPollFull
+		}
+	}
+	if err := tx.Unscoped().Where("poll_id = ? AND voter = ?", poll.ID, voter).Delete(&PollVote{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, id := range json.Slots {
+		if err := tx.Create(&PollVote{PollID: poll.ID, SlotID: id, Voter: voter, Name: name, Email: email}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "voted", "voterToken": token})
+	return nil
+}
+
+func PollPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "poll.html", gin.H{"token": c.Param("token")})
+}
+
+// StartPollJob closes polls when they expire, scheduling the winner of
+// those that ask for it, and deletes polls long expired
+func StartPollJob() {
+	go func() {
+		for {
+			expirePolls()
+			time.Sleep(pollInterval)
+		}
+	}()
+}
+
+func expirePolls() {
+	var polls []Poll
+	if err := db.Preload("Slots").Preload("Votes").Where("status = ? AND expires_at <= ?", PollOpen, time.Now()).Find(&polls).Error; err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for i := range polls {
+		poll := &polls[i]
+		if poll.AutoSchedule {
+			if err := autoSchedulePoll(poll); err != nil {
+				log.Println(err.Error())
+			}
+		}
+		if poll.Status == PollOpen {
+			db.Model(poll).Update("status", PollExpired)
+		}
+	}
+
+	var old []Poll
+	db.Where("expires_at <= ?", time.Now().Add(-pollRetention)).Find(&old)
+	for i := range old {
+		if err := deletePoll(&old[i]); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// autoSchedulePoll schedules the winner of an expired poll, unless the time
+// has been taken in the meantime
+func autoSchedulePoll(poll *Poll) error {
+	slot := poll.winner()
+	if slot == nil {
+		return nil
+	}
+	user := &User{}
+	if err := db.First(user, poll.UserID).Error; err != nil {
+		return err
+	}
+	service := newUserService(user)
+	if service == nil {
+		return errNoCalendar
+	}
+	loc := userLocation(user)
+	event := poll.event(slot, loc)
+	conflicts, err := findConflicts(service, event, loc)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("poll %d: the winning slot overlaps %s", poll.ID, strings.Join(conflictMessages(conflicts), ", "))
+	}
+	return schedulePoll(poll, slot, service, event)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// SchedulingPreference is when the user wants to have meetings. The home
+// time zone is User.TimeZone. Users without one get defaultWorkingHours.
+type SchedulingPreference struct {
+	gorm.Model
+	UserID uint `gorm:"unique_index;not null"`
+	// Times of day like "09:00"
+	WorkStart string
+	WorkEnd   string
+	// Weekdays as numbers separated by commas, Sunday being 0
+	WorkDays      string
+	NoMeetingDays string
+	// Empty when the user takes no fixed lunch break
+	LunchStart string
+	LunchEnd   string
+	// Minutes, separated by commas, the first being the default
+	MeetingLengths string
+}
+
+func defaultSchedulingPreference(userID uint) *SchedulingPreference {
+	return &SchedulingPreference{
+		UserID:         userID,
+		WorkStart:      formatClock(defaultWorkingHours.Start),
+		WorkEnd:        formatClock(defaultWorkingHours.End),
+		WorkDays:       "1,2,3,4,5",
+		MeetingLengths: "30,60",
+	}
+}
+
+func getSchedulingPreference(userID uint) *SchedulingPreference {
+	preference := &SchedulingPreference{}
+	if err := db.Where("user_id = ?", userID).First(preference).Error; err != nil {
+		return defaultSchedulingPreference(userID)
+	}
+	return preference
+}
+
+func parseWeekdays(value string) []time.Weekday {
+	var arr []time.Weekday
+	for _, part := range strings.Split(value, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(part))
+		if err == nil && day >= 0 && day <= 6 {
+			arr = append(arr, time.Weekday(day))
+		}
+	}
+	return arr
+}
+
+func joinInts(values []int) string {
+	var arr []string
+	for _, value := range values {
+		arr = append(arr, strconv.Itoa(value))
+	}
+	return strings.Join(arr, ",")
+}
+
+func weekdayNumbers(days []time.Weekday) []int {
+	arr := []int{}
+	for _, day := range days {
+		arr = append(arr, int(day))
+	}
+	return arr
+}
+
+// WorkingHours are the hours meetings can be scheduled in, which leave out
+// the days without meetings
+func (p *SchedulingPreference) WorkingHours() WorkingHours {
+	hours := defaultWorkingHours
+	if start, err := parseClock(p.WorkStart); err == nil {
+		hours.Start = start
+	}
+	if end, err := parseClock(p.WorkEnd); err == nil {
+		hours.End = end
+	}
+	noMeetings := p.noMeetingDays()
+	hours.Days = nil
+	for _, day := range parseWeekdays(p.WorkDays) {
+		if !containsWeekday(noMeetings, day) {
+			hours.Days = append(hours.Days, day)
+		}
+	}
+	return hours
+}
+
+func (p *SchedulingPreference) noMeetingDays() []time.Weekday {
+	return parseWeekdays(p.NoMeetingDays)
+}
+
+func (p *SchedulingPreference) meetingLengths() []int {
+	var arr []int
+	for _, part := range strings.Split(p.MeetingLengths, ",") {
+		minutes, err := strconv.Atoi(strings.TrimSpace(part))
+		if err == nil && minutes > 0 {
+			arr = append(arr, minutes)
+		}
+	}
+	return arr
+}
+
+// DefaultDuration is the length of meetings when none is asked for
+func (p *SchedulingPreference) DefaultDuration() time.Duration {
+	if lengths := p.meetingLengths(); len(lengths) > 0 {
+		return time.Duration(lengths[0]) * time.Minute
+	}
+	return 30 * time.Minute
+}
+
+// LunchIntervals are the lunch breaks between start and end, which are kept
+// free like meetings
+func (p *SchedulingPreference) LunchIntervals(start, end time.Time, loc *time.Location) []Interval {
+	lunchStart, err := parseClock(p.LunchStart)
+	if err != nil {
+		return nil
+	}
+	lunchEnd, err := parseClock(p.LunchEnd)
+	if err != nil || lunchEnd <= lunchStart {
+		return nil
+	}
+	var arr []Interval
+	first := start.In(loc)
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc); day.Before(end); day = day.AddDate(0, 0, 1) {
+		arr = append(arr, Interval{
+			Start: time.Date(day.Year(), day.Month(), day.Day(), 0, lunchStart, 0, 0, loc),
+			End:   time.Date(day.Year(), day.Month(), day.Day(), 0, lunchEnd, 0, 0, loc),
+		})
+	}
+	return arr
+}
+
+// Describe tells the assistant about the preferences
+func (p *SchedulingPreference) Describe() string {
+	hours := p.WorkingHours()
+	var days []string
+	for _, day := range hours.Days {
+		days = append(days, day.String())
+	}
+	lines := []string{fmt.Sprintf("Working hours: %s - %s on %s", formatClock(hours.Start), formatClock(hours.End), strings.Join(days, ", "))}
+	if noMeetings := p.noMeetingDays(); len(noMeetings) > 0 {
+		var arr []string
+		for _, day := range noMeetings {
+			arr = append(arr, day.String())
+		}
+		lines = append(lines, "No meetings on: "+strings.Join(arr, ", "))
+	}
+	if p.LunchStart != "" && p.LunchEnd != "" {
+		lines = append(lines, "Lunch break: "+p.LunchStart+" - "+p.LunchEnd)
+	}
+	if lengths := p.meetingLengths(); len(lengths) > 0 {
+		var arr []string
+		for _, minutes := range lengths {
+			arr = append(arr, strconv.Itoa(minutes))
+		}
+		lines = append(lines, "Preferred meeting lengths in minutes: "+strings.Join(arr, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func GetPreferences(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	preference := getSchedulingPreference(user.ID)
+	lengths := preference.meetingLengths()
+	if lengths == nil {
+		lengths = []int{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"timeZone":       user.TimeZone,
+		"workStart":      preference.WorkStart,
+		"workEnd":        preference.WorkEnd,
+		"workDays":       weekdayNumbers(parseWeekdays(preference.WorkDays)),
+		"noMeetingDays":  weekdayNumbers(preference.noMeetingDays()),
+		"lunchStart":     preference.LunchStart,
+		"lunchEnd":       preference.LunchEnd,
+		"meetingLengths": lengths,
+	})
+	return nil
+}
+
+func SetPreferences(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		TimeZone       string `json:"timeZone"`
+		WorkStart      string `json:"workStart"`
+		WorkEnd        string `json:"workEnd"`
+		WorkDays       []int  `json:"workDays"`
+		NoMeetingDays  []int  `json:"noMeetingDays"`
+		LunchStart     string `json:"lunchStart"`
+		LunchEnd       string `json:"lunchEnd"`
+		MeetingLengths []int  `json:"meetingLengths"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	v := &ValidationError{}
+	timeZone := user.TimeZone
+	if json.TimeZone != "" {
+		loc, err := LoadTimeZone(json.TimeZone)
+		if err != nil {
+			v.add("timeZone", "is unknown")
+		} else {
+			timeZone = loc.String()
+		}
+	}
+	workStart, err := parseClock(json.WorkStart)
+	if err != nil {
+		v.add("workStart", "must be a time of day like 09:00")
+	}
+	workEnd, err := parseClock(json.WorkEnd)
+	if err != nil {
+		v.add("workEnd", "must be a time of day like 17:00")
+	} else if workEnd <= workStart {
+		v.add("workEnd", "must be after workStart")
+	}
+	if len(json.WorkDays) == 0 {
+		v.add("workDays", "needs at least one weekday")
+	}
+	for _, days := range [][]int{json.WorkDays, json.NoMeetingDays} {
+		for _, day := range days {
+			if day < 0 || day > 6 {
+				v.add("workDays", "are numbers from 0 (Sunday) to 6")
+			}
+		}
+	}
+	var lunchStart, lunchEnd int
+	if json.LunchStart != "" || json.LunchEnd != "" {
+		lunchStart, err = parseClock(json.LunchStart)
+		if err != nil {
+			v.add("lunchStart", "must be a time of day like 12:00")
+		}
+		lunchEnd, err = parseClock(json.LunchEnd)
+		if err != nil {
+			v.add("lunchEnd", "must be a time of day like 13:00")
+		} else if lunchEnd <= lunchStart {
+			v.add("lunchEnd", "must be after lunchStart")
+		}
+	}
+	for _, minutes := range json.MeetingLengths {
+		if minutes <= 0 || minutes > 8*60 {
+			v.add("meetingLengths", "must be between 1 and 480 minutes")
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	preference := &SchedulingPreference{}
+	db.Where("user_id = ?", user.ID).First(preference)
+	preference.UserID = user.ID
+	preference.WorkStart = formatClock(workStart)
+	preference.WorkEnd = formatClock(workEnd)
+	preference.WorkDays = joinInts(json.WorkDays)
+	preference.NoMeetingDays = joinInts(json.NoMeetingDays)
+	preference.LunchStart = ""
+	preference.LunchEnd = ""
+	if json.LunchStart != "" {
+		preference.LunchStart = formatClock(lunchStart)
+		preference.LunchEnd = formatClock(lunchEnd)
+	}
+	preference.MeetingLengths = joinInts(json.MeetingLengths)
+
+	tx := db.Begin()
+	if err := tx.Save(preference).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(user).Update("time_zone", timeZone).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	// The assistant was told the old preferences
+	forgetSession(token)
+
+	c.JSON(http.StatusOK, gin.H{"status": "saved"})
+	return nil
+}
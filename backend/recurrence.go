@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeThis   string = "this"
+	ScopeSeries string = "series"
+)
+
+// maxRecurrencePeriods bounds the expansion of rules without COUNT or UNTIL
+const maxRecurrencePeriods = 100000
+
+type WeekdayNum struct {
+	// N is the ordinal in BYDAY=2TU or -1FR, 0 if not given
+	N   int
+	Day time.Weekday
+}
+
+type RecurrenceRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func weekdayCode(day time.Weekday) string {
+	return strings.ToUpper(day.String()[:2])
+}
+
+func parseIntList(value string) ([]int, error) {
+	var arr []int
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, n)
+	}
+	return arr, nil
+}
+
+// ParseRecurrenceRule reads an RRULE. An UNTIL without zone is a local time
+// of the event, read in loc.
+func ParseRecurrenceRule(rule string, loc *time.Location) (*RecurrenceRule, error) {
+	rule = strings.TrimPrefix(rule, "RRULE:")
+	r := &RecurrenceRule{Interval: 1, WeekStart: time.Monday}
+
+	for _, part := range strings.Split(rule, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+		case "UNTIL":
+			if len(value) == 8 {
+				r.Until, err = time.Parse("20060102", value)
+				// UNTIL is inclusive, so a date covers the whole day
+				r.Until = r.Until.Add(24*time.Hour - time.Second)
+			} else if strings.HasSuffix(value, "Z") {
+				r.Until, err = time.Parse(icsTimeLayout, value)
+			} else {
+				r.Until, err = time.ParseInLocation(icsLocalTimeLayout, value, loc)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				if len(day) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				weekday, ok := icsWeekdays[strings.ToUpper(day[len(day)-2:])]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				n := 0
+				if ordinal := day[:len(day)-2]; ordinal != "" {
+					if n, err = strconv.Atoi(ordinal); err != nil {
+						return nil, fmt.Errorf("invalid BYDAY %q", day)
+					}
+				}
+				r.ByDay = append(r.ByDay, WeekdayNum{N: n, Day: weekday})
+			}
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseIntList(value)
+		case "BYMONTH":
+			r.ByMonth, err = parseIntList(value)
+		case "BYSETPOS":
+			r.BySetPos, err = parseIntList(value)
+		case "WKST":
+			weekday, ok := icsWeekdays[strings.ToUpper(value)]
+			if !ok {
+				return nil, fmt.Errorf("invalid WKST %q", value)
+			}
+			r.WeekStart = weekday
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported frequency %q", r.Freq)
+	}
+	if r.Interval < 1 {
+		return nil, fmt.Errorf("invalid interval %d", r.Interval)
+	}
+	return r, nil
+}
+
+func (r *RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(icsTimeLayout))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, d := range r.ByDay {
+			days[i] = weekdayCode(d.Day)
+			if d.N != 0 {
+				days[i] = strconv.Itoa(d.N) + days[i]
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	joinInts := func(key string, values []int) {
+		if len(values) == 0 {
+			return
+		}
+		strs := make([]string, len(values))
+		for i, v := range values {
+			strs[i] = strconv.Itoa(v)
+		}
+		parts = append(parts, key+"="+strings.Join(strs, ","))
+	}
+	joinInts("BYMONTHDAY", r.ByMonthDay)
+	joinInts("BYMONTH", r.ByMonth)
+	joinInts("BYSETPOS", r.BySetPos)
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+weekdayCode(r.WeekStart))
+	}
+	return "RRULE:" + strings.Join(parts, ";")
+}
+
+func (r *RecurrenceRule) hasWeekday(day time.Weekday) bool {
+	for _, wd := range r.ByDay {
+		if wd.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// daysInMonthMatching returns the days of the month selected by BYMONTHDAY
+// and BYDAY, falling back to the day of dtstart.
+func (r *RecurrenceRule) daysInMonthMatching(year int, month time.Month, dtstart time.Time) []int {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	var days []int
+
+	for _, d := range r.ByMonthDay {
+		if d < 0 {
+			d = last + d + 1
+		}
+		if d >= 1 && d <= last {
+			days = append(days, d)
+		}
+	}
+
+	for _, wd := range r.ByDay {
+		var matching []int
+		for d := 1; d <= last; d++ {
+			if time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Weekday() == wd.Day {
+				matching = append(matching, d)
+			}
+		}
+		switch {
+		case wd.N == 0:
+			days = append(days, matching...)
+		case wd.N > 0 && wd.N <= len(matching):
+			days = append(days, matching[wd.N-1])
+		case wd.N < 0 && -wd.N <= len(matching):
+			days = append(days, matching[len(matching)+wd.N])
+		}
+	}
+
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 && dtstart.Day() <= last {
+		days = append(days, dtstart.Day())
+	}
+	return days
+}
+
+// candidates returns the occurrence dates of the period with the given index
+func (r *RecurrenceRule) candidates(dtstart time.Time, period int) []time.Time {
+	loc := dtstart.Location()
+	hour, min, sec := dtstart.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, loc)
+	}
+
+	var dates []time.Time
+	switch r.Freq {
+	case "DAILY":
+		d := dtstart.AddDate(0, 0, period*r.Interval)
+		dates = append(dates, at(d.Year(), d.Month(), d.Day()))
+	case "WEEKLY":
+		offset := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+		weekStart := dtstart.AddDate(0, 0, period*r.Interval*7-offset)
+		if len(r.ByDay) == 0 {
+			d := weekStart.AddDate(0, 0, offset)
+			dates = append(dates, at(d.Year(), d.Month(), d.Day()))
+			break
+		}
+		for i := 0; i < 7; i++ {
+			d := weekStart.AddDate(0, 0, i)
+			for _, wd := range r.ByDay {
+				if wd.Day == d.Weekday() {
+					dates = append(dates, at(d.Year(), d.Month(), d.Day()))
+				}
+			}
+		}
+	case "MONTHLY":
+		first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(period*r.Interval), 1, 0, 0, 0, 0, loc)
+		for _, day := range r.daysInMonthMatching(first.Year(), first.Month(), dtstart) {
+			dates = append(dates, at(first.Year(), first.Month(), day))
+		}
+	case "YEARLY":
+		year := dtstart.Year() + period*r.Interval
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []int{int(dtstart.Month())}
+		}
+		for _, month := range months {
+			for _, day := range r.daysInMonthMatching(year, time.Month(month), dtstart) {
+				dates = append(dates, at(year, time.Month(month), day))
+			}
+		}
+	}
+
+	// BYDAY and BYMONTH limit the result of the shorter frequencies
+	filtered := dates[:0]
+	for _, d := range dates {
+		if r.Freq == "DAILY" && len(r.ByDay) > 0 && !r.hasWeekday(d.Weekday()) {
+			continue
+		}
+		if r.Freq != "YEARLY" && len(r.ByMonth) > 0 && !containsInt(r.ByMonth, int(d.Month())) {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	dates = filtered
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	if len(r.BySetPos) > 0 && len(dates) > 0 {
+		var selected []time.Time
+		for _, pos := range r.BySetPos {
+			if pos > 0 && pos <= len(dates) {
+				selected = append(selected, dates[pos-1])
+			} else if pos < 0 && -pos <= len(dates) {
+				selected = append(selected, dates[len(dates)+pos])
+			}
+		}
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+		dates = selected
+	}
+	return dates
+}
+
+// Occurrences returns the start times of all occurrences that begin before
+// endTime, starting with dtstart itself.
+func (r *RecurrenceRule) Occurrences(dtstart, endTime time.Time) []time.Time {
+	var arr []time.Time
+	count := 0
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, t := range r.candidates(dtstart, period) {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return arr
+			}
+			if !t.Before(endTime) {
+				return arr
+			}
+			arr = append(arr, t)
+			count++
+			if r.Count > 0 && count >= r.Count {
+				return arr
+			}
+		}
+	}
+	return arr
+}
+
+// parseRecurrenceDates reads the values of an EXDATE or RDATE line, floating
+// ones in loc
+func parseRecurrenceDates(line string, loc *time.Location) ([]time.Time, error) {
+	prop := parseICSProperty(line)
+	var dates []time.Time
+	for _, value := range strings.Split(prop.Value, ",") {
+		prop.Value = value
+		s, _, err := parseICSTime(prop, loc)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseEventTime(s)
+		if err != nil {
+			return nil, err
+		}
+		dates = append(dates, t)
+	}
+	return dates, nil
+}
+
+func recurrenceInstanceID(id string, start time.Time) string {
+	return id + "_" + start.UTC().Format(icsTimeLayout)
+}
+
+// ExpandRecurrence turns a recurring event into its occurrences within
+// [startTime, endTime). Events without recurrence are returned unchanged
+// if they overlap the range.
+func ExpandRecurrence(event *Event, startTime, endTime time.Time) ([]*Event, error) {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseEventTime(event.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	duration := end.Sub(start)
+
+	if len(event.Recurrence) == 0 {
+		if start.Before(endTime) && end.After(startTime) {
+			return []*Event{event}, nil
+		}
+		return nil, nil
+	}
+
+	// All-day events repeat on dates, which are kept in UTC
+	if loc := eventLocation(*event); loc != nil && !event.AllDay {
+		start = start.In(loc)
+	}
+
+	var rule *RecurrenceRule
+	var extra []time.Time
+	excluded := map[int64]bool{}
+	for _, line := range event.Recurrence {
+		prop := parseICSProperty(line)
+		switch prop.Name {
+		case "RRULE":
+			if rule, err = ParseRecurrenceRule(prop.Value, start.Location()); err != nil {
+				return nil, err
+			}
+		case "EXDATE", "RDATE":
+			dates, err := parseRecurrenceDates(line, start.Location())
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range dates {
+				if prop.Name == "EXDATE" {
+					excluded[d.Unix()] = true
+				} else {
+					extra = append(extra, d)
+				}
+			}
+		}
+	}
+
+	occurrences := []time.Time{start}
+	if rule != nil {
+		occurrences = rule.Occurrences(start, endTime)
+	}
+	occurrences = append(occurrences, extra...)
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].Before(occurrences[j]) })
+
+	var arr []*Event
+	for _, t := range occurrences {
+		if excluded[t.Unix()] || !t.Add(duration).After(startTime) || !t.Before(endTime) {
+			continue
+		}
+		instance := *event
+		instance.ID = recurrenceInstanceID(event.ID, t)
+		instance.RecurringEventID = event.ID
+		instance.OriginalStartTime = formatEventTime(t, event.AllDay)
+		instance.StartTime = formatEventTime(t, event.AllDay)
+		instance.EndTime = formatEventTime(t.Add(duration), event.AllDay)
+		instance.Recurrence = nil
+		arr = append(arr, &instance)
+	}
+	return arr, nil
+}
+
+// AddExceptionDate returns the recurrence with an EXDATE for the occurrence
+// starting at originalStart, which removes it from the series.
+func AddExceptionDate(recurrence []string, originalStart string) ([]string, error) {
+	exdate, err := exceptionDateLine(originalStart)
+	if err != nil {
+		return nil, err
+	}
+	return append(recurrence, exdate), nil
+}
+
+func exceptionDateLine(originalStart string) (string, error) {
+	t, err := parseEventTime(originalStart)
+	if err != nil {
+		return "", err
+	}
+	if isDateOnly(originalStart) {
+		return "EXDATE;VALUE=DATE:" + t.Format("20060102"), nil
+	}
+	return "EXDATE:" + t.UTC().Format(icsTimeLayout), nil
+}
+
+// shiftSeries moves the times of a series master by as much as the
+// occurrence was moved, so that changing one occurrence with ScopeSeries
+// moves all of them
+func shiftSeries(master *Event, occurrence Event) (string, string, error) {
+	if occurrence.StartTime == "" || occurrence.OriginalStartTime == "" {
+		return "", "", nil
+	}
+	original, err := parseEventTime(occurrence.OriginalStartTime)
+	if err != nil {
+		return "", "", err
+	}
+	newStart, err := parseEventTime(occurrence.StartTime)
+	if err != nil {
+		return "", "", err
+	}
+	masterStart, err := parseEventTime(master.StartTime)
+	if err != nil {
+		return "", "", err
+	}
+	masterEnd, err := parseEventTime(master.EndTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	duration := masterEnd.Sub(masterStart)
+	if occurrence.EndTime != "" {
+		newEnd, err := parseEventTime(occurrence.EndTime)
+		if err != nil {
+			return "", "", err
+		}
+		duration = newEnd.Sub(newStart)
+	}
+
+	allDay := isDateOnly(occurrence.StartTime)
+	start := masterStart.Add(newStart.Sub(original))
+	return formatEventTime(start, allDay), formatEventTime(start.Add(duration), allDay), nil
+}
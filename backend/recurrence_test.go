@@ -0,0 +1,216 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrenceRule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		rule    string
+		want    *RecurrenceRule
+		wantErr bool
+	}{
+		{
+			name: "weekly on days",
+			rule: "RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10",
+			want: &RecurrenceRule{
+				Freq:      "WEEKLY",
+				Interval:  2,
+				Count:     10,
+				ByDay:     []WeekdayNum{{Day: time.Monday}, {Day: time.Wednesday}},
+				WeekStart: time.Monday,
+			},
+		},
+		{
+			name: "ordinal weekday and week start",
+			rule: "FREQ=MONTHLY;BYDAY=-1FR;WKST=SU",
+			want: &RecurrenceRule{
+				Freq:      "MONTHLY",
+				Interval:  1,
+				ByDay:     []WeekdayNum{{N: -1, Day: time.Friday}},
+				WeekStart: time.Sunday,
+			},
+		},
+		{
+			name: "last day of the month",
+			rule: "FREQ=MONTHLY;BYMONTHDAY=-1",
+			want: &RecurrenceRule{Freq: "MONTHLY", Interval: 1, ByMonthDay: []int{-1}, WeekStart: time.Monday},
+		},
+		{
+			name: "first weekday of the year",
+			rule: "FREQ=YEARLY;BYMONTH=1;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1",
+			want: &RecurrenceRule{
+				Freq:     "YEARLY",
+				Interval: 1,
+				ByDay: []WeekdayNum{
+					{Day: time.Monday}, {Day: time.Tuesday}, {Day: time.Wednesday}, {Day: time.Thursday}, {Day: time.Friday},
+				},
+				ByMonth:   []int{1},
+				BySetPos:  []int{1},
+				WeekStart: time.Monday,
+			},
+		},
+		{
+			name: "UTC until",
+			rule: "FREQ=DAILY;UNTIL=20240110T090000Z",
+			want: &RecurrenceRule{Freq: "DAILY", Interval: 1, Until: time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC), WeekStart: time.Monday},
+		},
+		{
+			name: "floating until is in the zone of the event",
+			rule: "FREQ=DAILY;UNTIL=20240110T090000",
+			want: &RecurrenceRule{Freq: "DAILY", Interval: 1, Until: time.Date(2024, 1, 10, 9, 0, 0, 0, berlin), WeekStart: time.Monday},
+		},
+		{
+			name: "date until covers the day",
+			rule: "FREQ=DAILY;UNTIL=20240110",
+			want: &RecurrenceRule{Freq: "DAILY", Interval: 1, Until: time.Date(2024, 1, 10, 23, 59, 59, 0, time.UTC), WeekStart: time.Monday},
+		},
+		{name: "missing frequency", rule: "INTERVAL=2", wantErr: true},
+		{name: "unsupported frequency", rule: "FREQ=HOURLY", wantErr: true},
+		{name: "zero interval", rule: "FREQ=DAILY;INTERVAL=0", wantErr: true},
+		{name: "invalid weekday", rule: "FREQ=WEEKLY;BYDAY=XX", wantErr: true},
+		{name: "part without value", rule: "FREQ=DAILY;COUNT", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRecurrenceRule(tt.rule, berlin)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseRecurrenceRule(%q) = %+v, want an error", tt.rule, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRecurrenceRule(%q): %v", tt.rule, err)
+			}
+			if !got.Until.Equal(tt.want.Until) {
+				t.Errorf("Until = %v, want %v", got.Until, tt.want.Until)
+			}
+			got.Until, tt.want.Until = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRecurrenceRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, berlin)
+	}
+
+	tests := []struct {
+		name    string
+		rule    string
+		dtstart time.Time
+		end     time.Time
+		want    []time.Time
+	}{
+		{
+			name:    "daily with count",
+			rule:    "FREQ=DAILY;COUNT=3",
+			dtstart: at(2024, 1, 1, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 1, 9), at(2024, 1, 2, 9), at(2024, 1, 3, 9)},
+		},
+		{
+			name:    "weekdays skip the weekend",
+			rule:    "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR",
+			dtstart: at(2024, 1, 4, 9),
+			end:     at(2024, 1, 10, 0),
+			want:    []time.Time{at(2024, 1, 4, 9), at(2024, 1, 5, 9), at(2024, 1, 8, 9), at(2024, 1, 9, 9)},
+		},
+		{
+			name:    "every other week",
+			rule:    "FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			dtstart: at(2024, 1, 1, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 1, 9), at(2024, 1, 15, 9), at(2024, 1, 29, 9)},
+		},
+		{
+			name:    "last friday of the month",
+			rule:    "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			dtstart: at(2024, 1, 26, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 26, 9), at(2024, 2, 23, 9), at(2024, 3, 29, 9)},
+		},
+		{
+			name:    "last day of the month",
+			rule:    "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			dtstart: at(2024, 1, 31, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 31, 9), at(2024, 2, 29, 9), at(2024, 3, 31, 9)},
+		},
+		{
+			name:    "months without the day are skipped",
+			rule:    "FREQ=MONTHLY;COUNT=3",
+			dtstart: at(2024, 1, 31, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 31, 9), at(2024, 3, 31, 9), at(2024, 5, 31, 9)},
+		},
+		{
+			name:    "leap day",
+			rule:    "FREQ=YEARLY;COUNT=2",
+			dtstart: at(2024, 2, 29, 9),
+			end:     at(2033, 1, 1, 0),
+			want:    []time.Time{at(2024, 2, 29, 9), at(2028, 2, 29, 9)},
+		},
+		{
+			name:    "first weekday of the month",
+			rule:    "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1;COUNT=2",
+			dtstart: at(2024, 6, 3, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 6, 3, 9), at(2024, 7, 1, 9)},
+		},
+		{
+			name:    "until is inclusive",
+			rule:    "FREQ=DAILY;UNTIL=20240103T080000Z",
+			dtstart: at(2024, 1, 1, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 1, 1, 9), at(2024, 1, 2, 9), at(2024, 1, 3, 9)},
+		},
+		{
+			name:    "the range ends before the rule",
+			rule:    "FREQ=DAILY",
+			dtstart: at(2024, 1, 1, 9),
+			end:     at(2024, 1, 3, 9),
+			want:    []time.Time{at(2024, 1, 1, 9), at(2024, 1, 2, 9)},
+		},
+		{
+			name:    "local time is kept across the clock change",
+			rule:    "FREQ=DAILY;COUNT=3",
+			dtstart: at(2024, 3, 30, 9),
+			end:     at(2025, 1, 1, 0),
+			want:    []time.Time{at(2024, 3, 30, 9), at(2024, 3, 31, 9), at(2024, 4, 1, 9)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRecurrenceRule(tt.rule, berlin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rule.Occurrences(tt.dtstart, tt.end)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Occurrences() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("occurrence %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
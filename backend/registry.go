@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Arch-4ng3l/StartupFramework/backend/config"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// Provider is a calendar service users can connect. Providers register
+// themselves in an init function of their own file.
+type Provider struct {
+	// Stored as the provider of users and linked accounts
+	Name string
+	// Sign in goes through /auth/<Path>/login and /auth/<Path>/callback
+	Path string
+	// Init sets up the OAuth config of the provider
+	Init     func(config config.Config)
+	Login    HTTPHandlerFunction
+	Callback HTTPHandlerFunction
+	// token is nil for providers without OAuth
+	NewCalendar    func(user User, token *oauth2.Token) (Calendar, error)
+	NewEmailClient func(token *oauth2.Token) EmailClient
+	// Nil for providers without tasks, whose users get a LocalTaskList
+	NewTaskList func(token *oauth2.Token) (TaskList, error)
+	// Webhook takes the change notifications of the provider's calendars
+	// at /api/<Path>-webhook, nil for providers without them
+	Webhook HTTPHandlerFunction
+}
+
+func (p *Provider) usesOAuth() bool {
+	return p.Callback != nil
+}
+
+func (p *Provider) webhookPath() string {
+	return "/api/" + p.Path + "-webhook"
+}
+
+var (
+	providers     = map[string]*Provider{}
+	providerOrder []*Provider
+)
+
+func RegisterProvider(provider *Provider) {
+	if _, ok := providers[provider.Name]; ok {
+		panic("provider " + provider.Name + " registered twice")
+	}
+	providers[provider.Name] = provider
+	providerOrder = append(providerOrder, provider)
+}
+
+func InitProviders(config config.Config) {
+	for _, provider := range providerOrder {
+		if provider.Init != nil {
+			provider.Init(config)
+		}
+	}
+}
+
+// RegisterProviderRoutes adds the sign in routes of all OAuth providers
+// and the webhooks of providers with change notifications
+func RegisterProviderRoutes(r *gin.Engine) {
+	for _, provider := range providerOrder {
+		if provider.Webhook != nil {
+			r.POST(provider.webhookPath(), HandleError(provider.Webhook))
+		}
+		if !provider.usesOAuth() {
+			continue
+		}
+		r.GET("/auth/"+provider.Path+"/login", HandleError(provider.Login))
+		r.GET("/auth/"+provider.Path+"/callback", HandleError(provider.Callback))
+	}
+}
+
+// oauthProviders are the names of providers users sign in to with OAuth
+func oauthProviders() []string {
+	var names []string
+	for _, provider := range providerOrder {
+		if provider.usesOAuth() {
+			names = append(names, provider.Name)
+		}
+	}
+	return names
+}
+
+// newProviderCalendar connects to a calendar of the provider with the
+// stored OAuth token
+func newProviderCalendar(name string, user User, tokenJSON json.RawMessage) (Calendar, error) {
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", name)
+	}
+	var token *oauth2.Token
+	if provider.usesOAuth() {
+		token = &oauth2.Token{}
+		if err := json.Unmarshal(tokenJSON, token); err != nil {
+			return nil, err
+		}
+	}
+	return provider.NewCalendar(user, token)
+}
+
+func newProviderEmailClient(user *User) (EmailClient, error) {
+	provider, ok := providers[user.Provider]
+	if !ok || provider.NewEmailClient == nil {
+		return nil, fmt.Errorf("email is not supported for this account")
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(user.CalenderToken, token); err != nil {
+		return nil, err
+	}
+	return provider.NewEmailClient(token), nil
+}
+
+func newProviderTaskList(provider *Provider, tokenJSON json.RawMessage) (TaskList, error) {
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(tokenJSON, token); err != nil {
+		return nil, err
+	}
+	return provider.NewTaskList(token)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	reminderInterval = time.Minute
+	// Reminders missed for longer, like while the server was down, are dropped
+	reminderGrace = 10 * time.Minute
+	// Services are built again now and then to pick up new settings
+	reminderServiceLifetime = time.Hour
+)
+
+// ReminderPreference is how and when a user wants to be reminded of events.
+// Users without one get no reminders.
+type ReminderPreference struct {
+	gorm.Model
+	UserID uint `gorm:"unique_index;not null"`
+	// Minutes before the start of events, separated by commas
+	Offsets    string
+	Email      bool
+	WebhookURL string
+}
+
+func (p *ReminderPreference) offsets() []time.Duration {
+	var arr []time.Duration
+	for _, value := range strings.Split(p.Offsets, ",") {
+		minutes, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || minutes < 0 {
+			continue
+		}
+		arr = append(arr, time.Duration(minutes)*time.Minute)
+	}
+	return arr
+}
+
+// SentReminder records a reminder so that it is sent only once
+type SentReminder struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"index;not null"`
+	// Account, id and start of the occurrence
+	EventKey string `gorm:"index"`
+	// Minutes before the start
+	Minutes int
+	SentAt  time.Time `gorm:"index"`
+}
+
+type Reminder struct {
+	User       *User
+	Preference *ReminderPreference
+	Event      *Event
+	// In the user's zone
+	Start  time.Time
+	Offset time.Duration
+}
+
+// Message is the subject and text shown to the user
+func (r Reminder) Message() (string, string) {
+	var subject, when string
+	if r.Event.AllDay {
+		when = r.Start.Format("Mon, Jan 2")
+		subject = fmt.Sprintf("Reminder: %s on %s", r.Event.Title, when)
+	} else {
+		when = r.Start.Format("Mon, Jan 2 15:04 MST")
+		subject = fmt.Sprintf("Reminder: %s at %s", r.Event.Title, r.Start.Format("15:04"))
+	}
+
+	lines := []string{r.Event.Title, "When: " + when}
+	if r.Event.Location != "" {
+		lines = append(lines, "Where: "+r.Event.Location)
+	}
+	if r.Event.MeetingURL != "" {
+		lines = append(lines, "Join: "+r.Event.MeetingURL)
+	}
+	return subject, strings.Join(lines, "\n")
+}
+
+// StartReminderJob checks every minute for events users want a reminder of
+func StartReminderJob() {
+	go func() {
+		services := map[uint]Calendar{}
+		built := time.Now()
+		for {
+			if time.Since(built) > reminderServiceLifetime {
+				services = map[uint]Calendar{}
+				built = time.Now()
+			}
+			sendReminders(services)
+			time.Sleep(reminderInterval)
+		}
+	}()
+}
+
+func sendReminders(services map[uint]Calendar) {
+	now := time.Now()
+	db.Where("sent_at < ?", now.Add(-48*time.Hour)).Delete(&SentReminder{})
+
+	var preferences []ReminderPreference
+	if err := db.Find(&preferences).Error; err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for i := range preferences {
+		preference := &preferences[i]
+		offsets := preference.offsets()
+		if len(offsets) == 0 {
+			continue
+		}
+
+		user := &User{}
+		if err := db.First(user, preference.UserID).Error; err != nil {
+			continue
+		}
+		service, ok := services[user.ID]
+		if !ok {
+			if service = newUserService(user); service == nil {
+				continue
+			}
+			services[user.ID] = service
+		}
+
+		latest := offsets[0]
+		for _, offset := range offsets {
+			if offset > latest {
+				latest = offset
+			}
+		}
+		events, err := service.GetEvents(now, now.Add(latest+reminderInterval))
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		loc := userLocation(user)
+		blockRules := policyBlockRules(user.ID)
+		taskBlocks := taskBlockEvents(user.ID)
+		for _, event := range events {
+			// Focus time, buffers and task blocks the assistant planned
+			if blockRules[event.ID] != 0 || taskBlocks[event.ID] {
+				continue
+			}
+			start, err := parseEventTime(event.StartTime)
+			if err != nil {
+				continue
+			}
+			if event.AllDay {
+				// All-day events start at midnight where the user is
+				start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+			}
+			// Events that started are left to the grace period, so that
+			// reminders at the start of an event are sent too
+			for _, offset := range offsets {
+				at := start.Add(-offset)
+				if at.After(now) || now.Sub(at) > reminderGrace {
+					continue
+				}
+				sendReminder(Reminder{
+					User:       user,
+					Preference: preference,
+					Event:      event,
+					Start:      start.In(loc),
+					Offset:     offset,
+				})
+			}
+		}
+	}
+}
+
+func sendReminder(reminder Reminder) {
+	key := reminder.Event.AccountID + "/" + reminder.Event.ID + "/" + reminder.Start.UTC().Format(time.RFC3339)
+	minutes := int(reminder.Offset.Minutes())
+
+	count := 0
+	db.Model(&SentReminder{}).Where("user_id = ? AND event_key = ? AND minutes = ?", reminder.User.ID, key, minutes).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(reminder); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	db.Create(&SentReminder{
+		UserID:   reminder.User.ID,
+		EventKey: key,
+		Minutes:  minutes,
+		SentAt:   time.Now(),
+	})
+}
+
+func GetReminders(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	preference := &ReminderPreference{}
+	db.Where("user_id = ?", user.ID).First(preference)
+	offsets := []int{}
+	for _, offset := range preference.offsets() {
+		offsets = append(offsets, int(offset.Minutes()))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"offsets":    offsets,
+		"email":      preference.Email,
+		"webhookUrl": preference.WebhookURL,
+		"push":       pushNotifier() != nil,
+	})
+	return nil
+}
+
+func SetReminders(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	var json struct {
+		Offsets    []int  `json:"offsets"`
+		Email      bool   `json:"email"`
+		WebhookURL string `json:"webhookUrl" binding:"omitempty,url"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+	if json.WebhookURL != "" {
+		if err := validatePublicURL(json.WebhookURL); err != nil {
+			return err
+		}
+	}
+	var offsets []string
+	for _, offset := range json.Offsets {
+		if offset < 0 || offset > 7*24*60 {
+			return fmt.Errorf("reminders can be at most a week before events")
+		}
+		offsets = append(offsets, strconv.Itoa(offset))
+	}
+
+	preference := &ReminderPreference{}
+	db.Where("user_id = ?", user.ID).First(preference)
+	preference.UserID = user.ID
+	preference.Offsets = strings.Join(offsets, ",")
+	preference.Email = json.Email
+	preference.WebhookURL = json.WebhookURL
+	if err := db.Save(preference).Error; err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "saved"})
+	return nil
+}
+
+func pushNotifier() *PushNotifier {
+	for _, notifier := range notifiers {
+		if push, ok := notifier.(*PushNotifier); ok {
+			return push
+		}
+	}
+	return nil
+}
+
+func GetPushKey(c *gin.Context) error {
+	push := pushNotifier()
+	if push == nil {
+		return fmt.Errorf("push notifications are not configured")
+	}
+	c.JSON(http.StatusOK, gin.H{"publicKey": push.publicKey})
+	return nil
+}
+
+func SubscribePush(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	// The PushSubscription of the browser as JSON
+	var json struct {
+		Endpoint string `json:"endpoint" binding:"required,url"`
+		Keys     struct {
+			P256dh string `json:"p256dh" binding:"required"`
+			Auth   string `json:"auth" binding:"required"`
+		} `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&json); err != nil {
+		return err
+	}
+
+	if err := validatePublicURL(json.Endpoint); err != nil {
+		return err
+	}
+
+	subscription := &PushSubscription{}
+	db.Where("user_id = ? AND endpoint = ?", user.ID, json.Endpoint).First(subscription)
+	subscription.UserID = user.ID
+	subscription.Endpoint = json.Endpoint
+	subscription.P256dh = json.Keys.P256dh
+	subscription.Auth = json.Keys.Auth
+	if err := db.Save(subscription).Error; err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "subscribed"})
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Searches without a range look this far back and ahead
+	searchPast   = 5 * 365 * 24 * time.Hour
+	searchFuture = 365 * 24 * time.Hour
+	searchLimit  = 50
+)
+
+// Matches tells whether the event fits the query. Providers search loosely,
+// so their results are checked again.
+func (q SearchQuery) Matches(event *Event) bool {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return false
+	}
+	end, err := parseEventTime(event.EndTime)
+	if err != nil {
+		return false
+	}
+	if !q.Start.IsZero() && !end.After(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && !start.Before(q.End) {
+		return false
+	}
+
+	if text := strings.ToLower(q.Text); text != "" {
+		found := false
+		for _, field := range []string{event.Title, event.Description, event.Location} {
+			if strings.Contains(strings.ToLower(field), text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if attendee := strings.ToLower(q.Attendee); attendee != "" {
+		found := false
+		for _, a := range event.Attendees {
+			if strings.Contains(strings.ToLower(a.Email), attendee) || strings.Contains(strings.ToLower(a.Name), attendee) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchTerm is what providers are asked to search for
+func (q SearchQuery) searchTerm() string {
+	if q.Text != "" {
+		return q.Text
+	}
+	return q.Attendee
+}
+
+// searchEvents searches on the server when the calendar can, and reads the
+// whole range otherwise
+func searchEvents(service Calendar, query SearchQuery) ([]*Event, error) {
+	var events []*Event
+	var err error
+	if searcher, ok := service.(SearchCalendar); ok {
+		events, err = searcher.SearchEvents(query)
+	} else {
+		events, err = service.GetEvents(query.Start, query.End)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filterSearchResults(events, query), nil
+}
+
+// filterSearchResults keeps the matching events, the latest first
+func filterSearchResults(events []*Event, query SearchQuery) []*Event {
+	arr := []*Event{}
+	for _, event := range events {
+		if query.Matches(event) {
+			arr = append(arr, event)
+		}
+	}
+	sortEventsByStart(arr)
+	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
+		arr[i], arr[j] = arr[j], arr[i]
+	}
+	if query.Limit > 0 && len(arr) > query.Limit {
+		arr = arr[:query.Limit]
+	}
+	return arr
+}
+
+func SearchCalendarEvents(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	service := getServiceFromToken(token)
+	if service == nil {
+		return errNoCalendar
+	}
+
+	now := time.Now()
+	query := SearchQuery{
+		Text:     strings.TrimSpace(c.Query("q")),
+		Attendee: strings.TrimSpace(c.Query("attendee")),
+		Start:    now.Add(-searchPast),
+		End:      now.Add(searchFuture),
+		Limit:    searchLimit,
+	}
+	v := &ValidationError{}
+	if query.Text == "" && query.Attendee == "" {
+		v.add("q", "or attendee is required")
+	}
+	var err error
+	if start := c.Query("start"); start != "" {
+		if query.Start, err = parseEventTime(start); err != nil {
+			v.add("start", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if end := c.Query("end"); end != "" {
+		if query.End, err = parseEventTime(end); err != nil {
+			v.add("end", "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		}
+	}
+	if !query.End.After(query.Start) {
+		v.add("end", "must be after start")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 || query.Limit > 500 {
+			v.add("limit", "must be between 1 and 500")
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	events, err := searchEvents(service, query)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+	return nil
+}
+
+// describeSearchResults lists found events for the assistant
+func describeSearchResults(events []*Event, loc *time.Location) string {
+	if len(events) == 0 {
+		return "No events found."
+	}
+	var lines []string
+	for _, event := range events {
+		line := fmt.Sprint(event.Title, " start: ", formatInLocation(event.StartTime, loc), " end: ", formatInLocation(event.EndTime, loc))
+		if len(event.Attendees) > 0 {
+			var attendees []string
+			for _, attendee := range event.Attendees {
+				attendees = append(attendees, attendee.Email)
+			}
+			line += " attendees: " + strings.Join(attendees, " ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runAISearch runs the search the assistant asked for, over the calendars
+// the user shares with it
+func runAISearch(service Calendar, request aiToolRequest, settings []CalendarSetting, loc *time.Location) string {
+	now := time.Now()
+	query := SearchQuery{
+		Text:     request.Details.Query,
+		Attendee: request.Details.Attendee,
+		Start:    now.Add(-searchPast),
+		End:      now.Add(searchFuture),
+		Limit:    searchLimit,
+	}
+	if start, err := parseEventTime(request.Details.StartTime); err == nil {
+		query.Start = start
+	}
+	if end, err := parseEventTime(request.Details.EndTime); err == nil {
+		query.End = end
+	}
+	if query.Text == "" && query.Attendee == "" {
+		return "Search results: a query or an attendee is needed to search."
+	}
+
+	events, err := searchEvents(service, query)
+	if err != nil {
+		return "Search results: the search failed: " + err.Error()
+	}
+	events = filterAIContext(events, settings)
+	return "Search results, the latest first:\n" + describeSearchResults(events, loc)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// The cache holds events from syncPast before to syncFuture after the
+	// first sync. Ranges outside of it are loaded from the provider.
+	syncPast   = 30 * 24 * time.Hour
+	syncFuture = 365 * 24 * time.Hour
+	// Reads within this time of the last sync are answered from the cache
+	// without asking the provider for changes
+	syncInterval = time.Minute
+)
+
+// CachedEvent is a copy of an event of an external calendar
+type CachedEvent struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"index;not null"`
+	AccountID string `gorm:"index"`
+	EventID   string `gorm:"index;not null"`
+	// Master of the series the event is an occurrence of
+	SeriesID  string          `gorm:"index"`
+	StartTime time.Time       `gorm:"index"`
+	EndTime   time.Time       `gorm:"index"`
+	Data      json.RawMessage `gorm:"type:jsonb"`
+}
+
+// SyncState is where the last sync of an account stopped
+type SyncState struct {
+	gorm.Model
+	UserID      uint `gorm:"index;not null"`
+	AccountID   string
+	Token       string `gorm:"type:text"`
+	WindowStart time.Time
+	WindowEnd   time.Time
+}
+
+type SyncResult struct {
+	// The cache has to be replaced with Changed
+	Full    bool
+	Changed []*Event
+	// IDs of removed events
+	Removed []string
+	Token   string
+}
+
+type syncProvider interface {
+	Calendar
+	SeriesCalendar
+	MultiCalendar
+	SyncCalendar
+}
+
+// CachedCalendar answers GetEvents from the database and keeps it up to date
+// with the changes reported by the provider
+type CachedCalendar struct {
+	provider  syncProvider
+	userID    uint
+	accountID string
+
+	mu          sync.Mutex
+	syncedAt    time.Time
+	windowStart time.Time
+	windowEnd   time.Time
+}
+
+func NewCachedCalendar(provider syncProvider, userID uint, accountID string) *CachedCalendar {
+	return &CachedCalendar{
+		provider:  provider,
+		userID:    userID,
+		accountID: accountID,
+	}
+}
+
+// withCache puts the events of providers that support syncing in the cache
+func withCache(service Calendar, userID uint, accountID string) Calendar {
+	if provider, ok := service.(syncProvider); ok {
+		return NewCachedCalendar(provider, userID, accountID)
+	}
+	return service
+}
+
+// Sync fetches the changes since the last sync into the cache
+func (c *CachedCalendar) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sync()
+}
+
+// Syncs of the same account are run one after another, even when several
+// sessions of the user have their own CachedCalendar
+var accountSyncLocks sync.Map
+
+func (c *CachedCalendar) sync() error {
+	lock, _ := accountSyncLocks.LoadOrStore(fmt.Sprint(c.userID, "/", c.accountID), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	now := time.Now()
+	state := &SyncState{}
+	db.Where("user_id = ? AND account_id = ?", c.userID, c.accountID).First(state)
+	state.UserID = c.userID
+	state.AccountID = c.accountID
+
+	// Start over once the window has moved too far into the past
+	if state.Token == "" || now.Add(-2*syncPast).After(state.WindowStart) {
+		state.Token = ""
+		state.WindowStart = now.Add(-syncPast)
+		state.WindowEnd = now.Add(syncFuture)
+	}
+
+	result, err := c.provider.SyncEvents(state.Token, state.WindowStart, state.WindowEnd)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	scope := tx.Where("user_id = ? AND account_id = ?", c.userID, c.accountID)
+	if result.Full {
+		if err := scope.Delete(&CachedEvent{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, id := range result.Removed {
+		if err := scope.Where("event_id = ? OR series_id = ?", id, id).Delete(&CachedEvent{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, event := range result.Changed {
+		if err := scope.Where("event_id = ?", event.ID).Delete(&CachedEvent{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		cached, err := c.toCachedEvent(event)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Create(cached).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	state.Token = result.Token
+	if err := tx.Save(state).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	c.syncedAt = now
+	c.windowStart = state.WindowStart
+	c.windowEnd = state.WindowEnd
+	return nil
+}
+
+func (c *CachedCalendar) toCachedEvent(event *Event) (*CachedEvent, error) {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseEventTime(event.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedEvent{
+		UserID:    c.userID,
+		AccountID: c.accountID,
+		EventID:   event.ID,
+		SeriesID:  event.RecurringEventID,
+		StartTime: start,
+		EndTime:   end,
+		Data:      data,
+	}, nil
+}
+
+// invalidate makes the next read ask the provider for changes
+func (c *CachedCalendar) invalidate() {
+	c.mu.Lock()
+	c.syncedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+// covers syncs when it is due and tells whether the cache holds the range
+func (c *CachedCalendar) covers(startTime, endTime time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.syncedAt) > syncInterval {
+		if err := c.sync(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return !c.syncedAt.IsZero() && !startTime.Before(c.windowStart) && !endTime.After(c.windowEnd)
+}
+
+func (c *CachedCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	if !c.covers(startTime, endTime) {
+		return c.provider.GetEvents(startTime, endTime)
+	}
+
+	var cached []CachedEvent
+	err := db.
+		Where("user_id = ? AND account_id = ? AND start_time < ? AND end_time > ?", c.userID, c.accountID, endTime, startTime).
+		Find(&cached).Error
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0, len(cached))
+	for _, row := range cached {
+		event := &Event{}
+		if err := json.Unmarshal(row.Data, event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	sortEventsByStart(events)
+	return events, nil
+}
+
+// SearchEvents reads the cache when it holds the range, and asks the
+// provider about older or later events
+func (c *CachedCalendar) SearchEvents(query SearchQuery) ([]*Event, error) {
+	if !c.covers(query.Start, query.End) {
+		return searchEvents(c.provider, query)
+	}
+	return c.GetEvents(query.Start, query.End)
+}
+
+func (c *CachedCalendar) CreateEvent(event Event) error {
+	defer c.invalidate()
+	return c.provider.CreateEvent(event)
+}
+
+func (c *CachedCalendar) CreateEventID(event Event) (string, error) {
+	defer c.invalidate()
+	return createEventID(c.provider, event)
+}
+
+func (c *CachedCalendar) UpdateEvent(event Event) error {
+	defer c.invalidate()
+	return c.provider.UpdateEvent(event)
+}
+
+func (c *CachedCalendar) RemoveEvent(event Event) error {
+	defer c.invalidate()
+	return c.provider.RemoveEvent(event)
+}
+
+func (c *CachedCalendar) GetSeries(id string) (*Event, error) {
+	return c.provider.GetSeries(id)
+}
+
+func (c *CachedCalendar) ListCalendars() ([]CalendarInfo, error) {
+	return c.provider.ListCalendars()
+}
+
+// SelectCalendars changes the calendars synced. Providers start over when
+// the token was made for other calendars.
+func (c *CachedCalendar) SelectCalendars(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.provider.SelectCalendars(ids)
+	c.syncedAt = time.Time{}
+}
+
+// decodeSyncTokens reads the tokens of each calendar. It returns nil when
+// the token doesn't cover exactly the given calendars.
+func decodeSyncTokens(token string, calendarIDs []string) map[string]string {
+	if token == "" {
+		return nil
+	}
+	tokens := map[string]string{}
+	if err := json.Unmarshal([]byte(token), &tokens); err != nil {
+		return nil
+	}
+	if len(tokens) != len(calendarIDs) {
+		return nil
+	}
+	for _, id := range calendarIDs {
+		if tokens[id] == "" {
+			return nil
+		}
+	}
+	return tokens
+}
+
+func encodeSyncTokens(tokens map[string]string) string {
+	data, _ := json.Marshal(tokens)
+	return string(data)
+}
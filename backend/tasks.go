@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	TaskOpen      = "open"
+	TaskCompleted = "completed"
+)
+
+type Task struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Notes string `json:"notes,omitempty"`
+	// Date (YYYY-MM-DD) the task is due, empty without one
+	Due string `json:"due,omitempty"`
+	// TaskOpen or TaskCompleted
+	Status string `json:"status,omitempty"`
+	// List the task is in, empty for the default one
+	ListID string `json:"listId,omitempty"`
+}
+
+// TaskList is the to-do list of the account the user signed up with, next
+// to its Calendar and EmailClient
+type TaskList interface {
+	GetTasks(includeCompleted bool) ([]*Task, error)
+	// CreateTask returns the task with the ID the provider gave it
+	CreateTask(Task) (*Task, error)
+	// UpdateTask changes the task with the given ID, leaving empty fields as they are
+	UpdateTask(Task) error
+	RemoveTask(Task) error
+}
+
+// errMissingTaskScope is returned by task lists of accounts that signed in
+// before the tasks scopes were asked for
+var errMissingTaskScope = errors.New("the account hasn't granted access to its tasks")
+
+// newUserTaskList connects to the tasks of the provider of the user, or to
+// our own store for providers without tasks
+func newUserTaskList(user *User) (TaskList, error) {
+	provider, ok := providers[user.Provider]
+	if !ok || provider.NewTaskList == nil || localCalendarOnly {
+		return NewLocalTaskList(*user), nil
+	}
+	remote, err := newProviderTaskList(provider, user.CalenderToken)
+	if err != nil {
+		return nil, err
+	}
+	return &scopeFallbackTaskList{remote: remote, local: NewLocalTaskList(*user)}, nil
+}
+
+// scopeFallbackTaskList keeps the tasks in our own store while the token of
+// the user lacks the tasks scopes, until they sign in again
+type scopeFallbackTaskList struct {
+	remote TaskList
+	local  TaskList
+}
+
+func missingTaskScope(err error) bool {
+	if errors.Is(err, errMissingTaskScope) {
+		log.Println(err.Error())
+		return true
+	}
+	return false
+}
+
+func (l *scopeFallbackTaskList) GetTasks(includeCompleted bool) ([]*Task, error) {
+	tasks, err := l.remote.GetTasks(includeCompleted)
+	if missingTaskScope(err) {
+		return l.local.GetTasks(includeCompleted)
+	}
+	return tasks, err
+}
+
+func (l *scopeFallbackTaskList) CreateTask(task Task) (*Task, error) {
+	created, err := l.remote.CreateTask(task)
+	if missingTaskScope(err) {
+		return l.local.CreateTask(task)
+	}
+	return created, err
+}
+
+func (l *scopeFallbackTaskList) UpdateTask(task Task) error {
+	err := l.remote.UpdateTask(task)
+	if missingTaskScope(err) {
+		return l.local.UpdateTask(task)
+	}
+	return err
+}
+
+func (l *scopeFallbackTaskList) RemoveTask(task Task) error {
+	err := l.remote.RemoveTask(task)
+	if missingTaskScope(err) {
+		return l.local.RemoveTask(task)
+	}
+	return err
+}
+
+// validateTask checks a task before it is written, like validateEvent
+func validateTask(task *Task, create bool) error {
+	v := &ValidationError{}
+	title := strings.TrimSpace(task.Title)
+	if create && title == "" {
+		v.add("title", "is required")
+	}
+	if len(title) > maxTitleLength {
+		v.add("title", "can be at most %d characters", maxTitleLength)
+	}
+	if !create && task.ID == "" {
+		v.add("id", "is required")
+	}
+	if task.Due != "" {
+		if _, err := time.Parse(dateLayout, task.Due); err != nil {
+			v.add("due", "must be a date (YYYY-MM-DD)")
+		}
+	}
+	switch task.Status {
+	case "", TaskOpen, TaskCompleted:
+	default:
+		v.add("status", "must be %q or %q", TaskOpen, TaskCompleted)
+	}
+	return v.err()
+}
+
+func taskListFromToken(token string) (TaskList, error) {
+	user, err := getUserFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return newUserTaskList(user)
+}
+
+func GetTasks(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	taskList, err := taskListFromToken(token)
+	if err != nil {
+		return err
+	}
+	tasks, err := taskList.GetTasks(c.Query("completed") == "true")
+	if err != nil {
+		return err
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
+	return nil
+}
+
+func CreateTask(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	taskList, err := taskListFromToken(token)
+	if err != nil {
+		return err
+	}
+	task := Task{}
+	if err := c.ShouldBindBodyWithJSON(&task); err != nil {
+		return err
+	}
+	if err := validateTask(&task, true); err != nil {
+		return err
+	}
+	created, err := taskList.CreateTask(task)
+	if err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "created", "task": created})
+	return nil
+}
+
+func UpdateTask(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	taskList, err := taskListFromToken(token)
+	if err != nil {
+		return err
+	}
+	task := Task{}
+	if err := c.ShouldBindBodyWithJSON(&task); err != nil {
+		return err
+	}
+	if err := validateTask(&task, false); err != nil {
+		return err
+	}
+	if err := taskList.UpdateTask(task); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+	return nil
+}
+
+func RemoveTask(c *gin.Context) error {
+	token, _ := c.Cookie("token")
+	taskList, err := taskListFromToken(token)
+	if err != nil {
+		return err
+	}
+	task := Task{}
+	if err := c.ShouldBindBodyWithJSON(&task); err != nil {
+		return err
+	}
+	if task.ID == "" {
+		v := &ValidationError{}
+		v.add("id", "is required")
+		return v
+	}
+	if err := taskList.RemoveTask(task); err != nil {
+		return err
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+	return nil
+}
+
+// describeTasks lists the open tasks for the assistant, which needs their
+// IDs to complete them
+func describeTasks(user *User) string {
+	taskList, err := newUserTaskList(user)
+	if err != nil {
+		log.Println(err.Error())
+		return "unavailable"
+	}
+	tasks, err := taskList.GetTasks(false)
+	if err != nil {
+		log.Println(err.Error())
+		return "unavailable"
+	}
+	if len(tasks) == 0 {
+		return "none"
+	}
+	var arr []string
+	for _, task := range tasks {
+		line := fmt.Sprintf("%s (id: %s", task.Title, task.ID)
+		if task.ListID != "" {
+			line += ", listId: " + task.ListID
+		}
+		if task.Due != "" {
+			line += ", due: " + task.Due
+		}
+		arr = append(arr, line+")")
+	}
+	return strings.Join(arr, ", ")
+}
+
+// checkAITask validates the task the assistant wants to add or complete,
+// and adds the problems as errors like checkAIResponse
+func checkAITask(reply map[string]any, response string) string {
+	data, err := json.Marshal(reply["details"])
+	if err != nil {
+		return response
+	}
+	var task Task
+	var details struct {
+		TaskID string `json:"taskId"`
+	}
+	if json.Unmarshal(data, &task) != nil || json.Unmarshal(data, &details) != nil {
+		return response
+	}
+	create := reply["action"] == "add_task"
+	if !create {
+		task = Task{ID: details.TaskID, ListID: task.ListID, Status: TaskCompleted}
+	}
+	if err := validateTask(&task, create); err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			reply["errors"] = validation.Fields
+		}
+	}
+	checked, err := json.Marshal(reply)
+	if err != nil {
+		return response
+	}
+	return string(checked)
+}
+
+type LocalTask struct {
+	gorm.Model
+	UserID uint   `gorm:"index;not null"`
+	UID    string `gorm:"index;not null"`
+	Title  string
+	Notes  string
+	// Date (YYYY-MM-DD), empty without one
+	Due         string
+	CompletedAt *time.Time
+}
+
+func (t *LocalTask) toTask() *Task {
+	task := &Task{
+		ID:     t.UID,
+		Title:  t.Title,
+		Notes:  t.Notes,
+		Due:    t.Due,
+		Status: TaskOpen,
+	}
+	if t.CompletedAt != nil {
+		task.Status = TaskCompleted
+	}
+	return task
+}
+
+// LocalTaskList stores tasks in our own database, for users whose provider
+// has no tasks
+type LocalTaskList struct {
+	userID uint
+}
+
+func NewLocalTaskList(user User) *LocalTaskList {
+	return &LocalTaskList{
+		userID: user.ID,
+	}
+}
+
+func (l *LocalTaskList) GetTasks(includeCompleted bool) ([]*Task, error) {
+	query := db.Where("user_id = ?", l.userID)
+	if !includeCompleted {
+		query = query.Where("completed_at IS NULL")
+	}
+	var stored []LocalTask
+	if err := query.Order("created_at").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	var arr []*Task
+	for i := range stored {
+		arr = append(arr, stored[i].toTask())
+	}
+	return arr, nil
+}
+
+func (l *LocalTaskList) CreateTask(task Task) (*Task, error) {
+	uid, err := newEventUID()
+	if err != nil {
+		return nil, err
+	}
+	stored := &LocalTask{
+		UserID: l.userID,
+		UID:    uid,
+		Title:  task.Title,
+		Notes:  task.Notes,
+		Due:    task.Due,
+	}
+	if task.Status == TaskCompleted {
+		now := time.Now()
+		stored.CompletedAt = &now
+	}
+	if err := db.Create(stored).Error; err != nil {
+		return nil, err
+	}
+	return stored.toTask(), nil
+}
+
+func (l *LocalTaskList) find(id string) (*LocalTask, error) {
+	stored := &LocalTask{}
+	if err := db.Where("user_id = ? AND uid = ?", l.userID, id).First(stored).Error; err != nil {
+		return nil, fmt.Errorf("task %s not found", id)
+	}
+	return stored, nil
+}
+
+func (l *LocalTaskList) UpdateTask(task Task) error {
+	stored, err := l.find(task.ID)
+	if err != nil {
+		return err
+	}
+	if task.Title != "" {
+		stored.Title = task.Title
+	}
+	if task.Notes != "" {
+		stored.Notes = task.Notes
+	}
+	if task.Due != "" {
+		stored.Due = task.Due
+	}
+	switch task.Status {
+	case TaskOpen:
+		stored.CompletedAt = nil
+	case TaskCompleted:
+		if stored.CompletedAt == nil {
+			now := time.Now()
+			stored.CompletedAt = &now
+		}
+	}
+	return db.Save(stored).Error
+}
+
+func (l *LocalTaskList) RemoveTask(task Task) error {
+	stored, err := l.find(task.ID)
+	if err != nil {
+		return err
+	}
+	return db.Delete(stored).Error
+}
@@ -3,12 +3,10 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"log"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/oauth2"
 )
 
 func HashPassword(password string) (string, error) {
@@ -39,33 +37,77 @@ func GetUserPlan(token string) string {
 }
 
 func getServiceFromToken(token string) Calendar {
-	service, ok := calendarCache[token]
+	service, ok := cachedService(token)
 	if !ok {
 		claims, err := ValidateToken(token)
 		if err != nil {
 			log.Println(err.Error())
+			return nil
 		}
 		user := &User{}
 		if err := db.Where("email = ?", claims.Email).First(user).Error; err != nil {
-			log.Fatal(err)
-		}
-		t := &oauth2.Token{}
-		if err := json.Unmarshal(user.CalenderToken, t); err != nil {
+			log.Println(err.Error())
 			return nil
 		}
-		switch user.Provider {
-		case Microsoft:
-			service = NewMicrosoftCalendar(t)
-		case Google:
-			service = NewGoogleCalendar(googleOAuthConf, *user)
-		default:
+		service = newUserService(user)
+		if service == nil {
 			return nil
 		}
-		calendarCache[token] = service
+		storeService(token, service)
+	}
+	return service
+}
+
+// newUserService connects to all calendars of the user, with the calendars
+// they selected
+func newUserService(user *User) Calendar {
+	service := newUserCalendar(user)
+	if service == nil {
+		return nil
+	}
+	service = withCache(service, user.ID, "")
+	if !localCalendarOnly {
+		var accounts []LinkedAccount
+		db.Where("user_id = ?", user.ID).Find(&accounts)
+		if len(accounts) > 0 {
+			service = NewCompositeCalendar(service, accounts)
+		}
+	}
+	applyCalendarSettings(service, getCalendarSettings(user.ID))
+	return service
+}
+
+// newUserCalendar connects to the calendar of the account the user signed
+// up with
+func newUserCalendar(user *User) Calendar {
+	if _, ok := providers[user.Provider]; !ok || localCalendarOnly {
+		// Users registered with a password have no external calendar
+		return NewLocalCalendar(*user)
+	}
+	service, err := newProviderCalendar(user.Provider, *user, user.CalenderToken)
+	if err != nil {
+		log.Println(err.Error())
+		return nil
 	}
 	return service
 }
 
+func getCalendarSettings(userID uint) []CalendarSetting {
+	var settings []CalendarSetting
+	db.Where("user_id = ?", userID).Find(&settings)
+	return settings
+}
+
+func enabledCalendarIDs(settings []CalendarSetting, accountID string) []string {
+	var ids []string
+	for _, setting := range settings {
+		if setting.Enabled && setting.AccountID == accountID {
+			ids = append(ids, setting.CalendarID)
+		}
+	}
+	return ids
+}
+
 func UpdateSubscriptionID(email, subscriptionID string) error {
 	return db.Model(&User{}).Where("email = ?", email).Update("subscription_id", subscriptionID).Error
 }
@@ -90,6 +132,14 @@ func GetUser(email string) (*User, error) {
 	return user, nil
 }
 
+func getUserFromToken(token string) (*User, error) {
+	claims, err := ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return GetUser(claims.Email)
+}
+
 type StateToken struct {
 	Value     string
 	ExpiresAt time.Time
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	maxTitleLength = 1024
+	// Occurrences of new recurring events are checked for overlaps this far
+	conflictHorizon = 28 * 24 * time.Hour
+)
+
+// FieldError is a problem with one field of an event
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists everything wrong with an event. HandleError sends
+// the fields along with the message.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var arr []string
+	for _, field := range e.Fields {
+		arr = append(arr, field.Field+" "+field.Message)
+	}
+	return "invalid event: " + strings.Join(arr, ", ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Conflict is an event overlapping the one being written
+type Conflict struct {
+	Event   *Event `json:"event"`
+	Message string `json:"message"`
+}
+
+// ConflictError rejects a write that overlaps other events. Writes with
+// allowOverlap set go through and return the conflicts as warnings.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	return "the event overlaps " + strings.Join(conflictMessages(e.Conflicts), ", ")
+}
+
+func conflictMessages(conflicts []Conflict) []string {
+	arr := []string{}
+	for _, conflict := range conflicts {
+		arr = append(arr, conflict.Message)
+	}
+	return arr
+}
+
+// validateEvent checks an event before it is written. New events need a
+// title and times, while updates only change the fields they give.
+func validateEvent(event *Event, create bool) error {
+	v := &ValidationError{}
+
+	title := strings.TrimSpace(event.Title)
+	if create && title == "" {
+		v.add("title", "is required")
+	}
+	if len(title) > maxTitleLength {
+		v.add("title", "can be at most %d characters", maxTitleLength)
+	}
+
+	start, startOK := validateEventTime(v, "startTime", event.StartTime, create)
+	end, endOK := validateEventTime(v, "endTime", event.EndTime, create)
+	if !create && (event.StartTime == "") != (event.EndTime == "") {
+		v.add("endTime", "has to be changed together with startTime")
+	}
+	allDay := event.AllDay || isDateOnly(event.StartTime)
+	// normalizeAllDay gives all-day events at least one day
+	if startOK && endOK && !allDay && !end.After(start) {
+		v.add("endTime", "must be after startTime")
+	}
+
+	if len(event.Recurrence) > 0 {
+		for _, line := range event.Recurrence {
+			switch parseICSProperty(line).Name {
+			case "RRULE", "EXDATE", "RDATE":
+			default:
+				v.add("recurrence", "%q is not an RRULE, EXDATE or RDATE line", line)
+			}
+		}
+		if startOK && endOK {
+			if _, err := ExpandRecurrence(event, start, start.Add(24*time.Hour)); err != nil {
+				v.add("recurrence", "%s", err.Error())
+			}
+		}
+	}
+
+	switch event.Scope {
+	case "", ScopeThis, ScopeSeries:
+	default:
+		v.add("scope", "must be %q or %q", ScopeThis, ScopeSeries)
+	}
+
+	if event.MeetingURL != "" {
+		meetingURL, err := url.Parse(event.MeetingURL)
+		if err != nil || (meetingURL.Scheme != "http" && meetingURL.Scheme != "https") || meetingURL.Host == "" || hasControlChars(event.MeetingURL) {
+			v.add("meetingUrl", "must be an http or https address")
+		}
+	}
+
+	for _, attendee := range event.Attendees {
+		// Only the bare address, which is written as it is to mailto: URIs
+		if address, err := mail.ParseAddress(attendee.Email); err != nil || address.Address != attendee.Email {
+			v.add("attendees", "%q is not an email address", attendee.Email)
+		}
+	}
+	return v.err()
+}
+
+func validateEventTime(v *ValidationError, field, value string, required bool) (time.Time, bool) {
+	if value == "" {
+		if required {
+			v.add(field, "is required")
+		}
+		return time.Time{}, false
+	}
+	t, err := parseEventTime(value)
+	if err != nil {
+		v.add(field, "must be a date (YYYY-MM-DD) or an RFC 3339 time")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// hasControlChars tells whether s holds line breaks or other control
+// characters, which names written to emails and calendar files mustn't
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// findConflicts returns the events of the calendar overlapping event, which
+// has been validated. Occurrences of new recurring events are checked for
+// the first weeks. The event itself, or its series, doesn't count.
+func findConflicts(service Calendar, event Event, loc *time.Location) ([]Conflict, error) {
+	start, err := parseEventTime(event.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseEventTime(event.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	var occurrences []*Event
+	if len(event.Recurrence) > 0 {
+		if occurrences, err = ExpandRecurrence(&event, start, start.Add(conflictHorizon)); err != nil {
+			return nil, err
+		}
+	} else {
+		occurrences = []*Event{&event}
+	}
+	if len(occurrences) == 0 {
+		return nil, nil
+	}
+	last, err := parseEventTime(occurrences[len(occurrences)-1].EndTime)
+	if err != nil {
+		return nil, err
+	}
+	if last.After(end) {
+		end = last
+	}
+
+	// All-day events cover whole days where the user is
+	events, err := service.GetEvents(start.Add(-24*time.Hour), end.Add(24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var arr []Conflict
+	for _, occurrence := range occurrences {
+		busy := BusyIntervals([]*Event{occurrence}, loc)
+		if len(busy) == 0 {
+			continue
+		}
+		for _, other := range events {
+			if isSameEvent(event, other) || seen[other.AccountID+"/"+other.ID] {
+				continue
+			}
+			otherBusy := BusyIntervals([]*Event{other}, loc)
+			if len(otherBusy) == 0 {
+				continue
+			}
+			if otherBusy[0].Start.Before(busy[0].End) && otherBusy[0].End.After(busy[0].Start) {
+				seen[other.AccountID+"/"+other.ID] = true
+				arr = append(arr, Conflict{Event: other, Message: describeConflict(other, otherBusy[0])})
+			}
+		}
+	}
+	return arr, nil
+}
+
+// isSameEvent tells whether other is the event being written or, when a
+// whole series is changed, one of its occurrences
+func isSameEvent(event Event, other *Event) bool {
+	if event.ID == "" || event.AccountID != other.AccountID {
+		return false
+	}
+	if other.ID == event.ID || other.RecurringEventID == event.ID {
+		return true
+	}
+	return event.Scope == ScopeSeries && event.RecurringEventID != "" && other.RecurringEventID == event.RecurringEventID
+}
+
+func describeConflict(event *Event, interval Interval) string {
+	if event.AllDay {
+		return fmt.Sprintf("%q (all day %s)", event.Title, interval.Start.Format("Mon, Jan 2"))
+	}
+	return fmt.Sprintf("%q (%s - %s)", event.Title, interval.Start.Format("Mon, Jan 2 15:04"), interval.End.Format("15:04"))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCalendar returns its events from GetEvents and ignores writes
+type fakeCalendar struct {
+	events []*Event
+	err    error
+}
+
+func (c *fakeCalendar) CreateEvent(Event) error { return nil }
+func (c *fakeCalendar) RemoveEvent(Event) error { return nil }
+func (c *fakeCalendar) UpdateEvent(Event) error { return nil }
+
+func (c *fakeCalendar) GetEvents(startTime, endTime time.Time) ([]*Event, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var arr []*Event
+	for _, event := range c.events {
+		occurrences, err := ExpandRecurrence(event, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, occurrences...)
+	}
+	return arr, nil
+}
+
+func invalidFields(err error) []string {
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		return nil
+	}
+	var fields []string
+	for _, field := range validation.Fields {
+		fields = append(fields, field.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  Event
+		create bool
+		want   []string
+	}{
+		{
+			name:   "valid event",
+			event:  Event{Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z"},
+			create: true,
+		},
+		{
+			name:   "all-day event",
+			event:  Event{Title: "Holiday", StartTime: "2024-01-08", EndTime: "2024-01-08"},
+			create: true,
+		},
+		{
+			name:   "new event without anything",
+			create: true,
+			want:   []string{"endTime", "startTime", "title"},
+		},
+		{
+			name:   "blank title",
+			event:  Event{Title: "  ", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T10:00:00Z"},
+			create: true,
+			want:   []string{"title"},
+		},
+		{
+			name:   "long title",
+			event:  Event{Title: strings.Repeat("a", maxTitleLength+1), StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T10:00:00Z"},
+			create: true,
+			want:   []string{"title"},
+		},
+		{
+			name:   "ends before it starts",
+			event:  Event{Title: "Standup", StartTime: "2024-01-08T10:00:00Z", EndTime: "2024-01-08T09:00:00Z"},
+			create: true,
+			want:   []string{"endTime"},
+		},
+		{
+			name:   "invalid time",
+			event:  Event{Title: "Standup", StartTime: "tomorrow", EndTime: "2024-01-08T09:00:00Z"},
+			create: true,
+			want:   []string{"startTime"},
+		},
+		{
+			name:  "update of the title only",
+			event: Event{ID: "abc", Title: "Renamed"},
+		},
+		{
+			name:  "update of one time",
+			event: Event{ID: "abc", StartTime: "2024-01-08T09:00:00Z"},
+			want:  []string{"endTime"},
+		},
+		{
+			name: "recurrence",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Recurrence: []string{"RRULE:FREQ=WEEKLY;BYDAY=MO,WE", "EXDATE:20240110T090000Z"},
+			},
+			create: true,
+		},
+		{
+			name: "invalid rule",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Recurrence: []string{"RRULE:FREQ=SOMETIMES"},
+			},
+			create: true,
+			want:   []string{"recurrence"},
+		},
+		{
+			name: "not a recurrence line",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Recurrence: []string{"SUMMARY:Standup"},
+			},
+			create: true,
+			want:   []string{"recurrence"},
+		},
+		{
+			name:  "unknown scope",
+			event: Event{ID: "abc", Title: "Standup", Scope: "all"},
+			want:  []string{"scope"},
+		},
+		{
+			name: "attendee without address",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Attendees: []Attendee{{Email: "ada@example.com"}, {Email: "grace"}},
+			},
+			create: true,
+			want:   []string{"attendees"},
+		},
+		{
+			name: "attendee with a display name",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Attendees: []Attendee{{Email: "Ada <ada@example.com>"}},
+			},
+			create: true,
+			want:   []string{"attendees"},
+		},
+		{
+			name: "attendee with a line break",
+			event: Event{
+				Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+				Attendees: []Attendee{{Email: "ada@example.com\r\nATTENDEE:mailto:eve@example.com"}},
+			},
+			create: true,
+			want:   []string{"attendees"},
+		},
+		{
+			name:  "meeting link",
+			event: Event{ID: "abc", MeetingURL: "https://meet.example.com/abc-defg?pwd=1"},
+		},
+		{
+			name:  "meeting link without a scheme",
+			event: Event{ID: "abc", MeetingURL: "meet.example.com/abc"},
+			want:  []string{"meetingUrl"},
+		},
+		{
+			name:  "meeting link of another scheme",
+			event: Event{ID: "abc", MeetingURL: "javascript:alert(1)"},
+			want:  []string{"meetingUrl"},
+		},
+		{
+			name:  "meeting link with a line break",
+			event: Event{ID: "abc", MeetingURL: "https://meet.example.com/abc\r\nATTENDEE:mailto:eve@example.com"},
+			want:  []string{"meetingUrl"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.event
+			err := validateEvent(&event, tt.create)
+			if got := invalidFields(err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateEvent() = %v, want invalid fields %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	calendar := &fakeCalendar{events: []*Event{
+		{ID: "review", Title: "Review", StartTime: "2024-01-08T10:00:00Z", EndTime: "2024-01-08T11:00:00Z"},
+		{ID: "lunch", Title: "Lunch", StartTime: "2024-01-08T12:00:00Z", EndTime: "2024-01-08T13:00:00Z"},
+		{ID: "offsite", Title: "Offsite", StartTime: "2024-01-10", EndTime: "2024-01-11", AllDay: true},
+		{
+			ID: "standup", Title: "Standup", StartTime: "2024-01-08T09:00:00Z", EndTime: "2024-01-08T09:15:00Z",
+			Recurrence: []string{"RRULE:FREQ=DAILY;COUNT=5"},
+		},
+	}}
+
+	tests := []struct {
+		name  string
+		event Event
+		want  []string
+	}{
+		{
+			name:  "free time",
+			event: Event{StartTime: "2024-01-08T14:00:00Z", EndTime: "2024-01-08T15:00:00Z"},
+		},
+		{
+			name:  "touching events don't overlap",
+			event: Event{StartTime: "2024-01-08T11:00:00Z", EndTime: "2024-01-08T12:00:00Z"},
+		},
+		{
+			name:  "overlaps one event",
+			event: Event{StartTime: "2024-01-08T10:30:00Z", EndTime: "2024-01-08T11:30:00Z"},
+			want:  []string{"review"},
+		},
+		{
+			name:  "covers two events",
+			event: Event{StartTime: "2024-01-08T09:30:00Z", EndTime: "2024-01-08T12:30:00Z"},
+			want:  []string{"review", "lunch"},
+		},
+		{
+			name:  "occurrence of a series",
+			event: Event{StartTime: "2024-01-09T09:00:00Z", EndTime: "2024-01-09T09:30:00Z"},
+			want:  []string{recurrenceInstanceID("standup", time.Date(2024, 1, 9, 9, 0, 0, 0, time.UTC))},
+		},
+		{
+			name:  "all-day event",
+			event: Event{StartTime: "2024-01-10T15:00:00Z", EndTime: "2024-01-10T16:00:00Z"},
+			want:  []string{"offsite"},
+		},
+		{
+			name:  "the event itself",
+			event: Event{ID: "review", StartTime: "2024-01-08T10:15:00Z", EndTime: "2024-01-08T11:15:00Z"},
+		},
+		{
+			name: "occurrences of the series being moved",
+			event: Event{
+				ID: recurrenceInstanceID("standup", time.Date(2024, 1, 9, 9, 0, 0, 0, time.UTC)), RecurringEventID: "standup", Scope: ScopeSeries,
+				StartTime: "2024-01-09T09:05:00Z", EndTime: "2024-01-09T09:20:00Z",
+			},
+		},
+		{
+			name: "new recurring event",
+			event: Event{
+				StartTime: "2024-01-01T12:30:00Z", EndTime: "2024-01-01T13:30:00Z",
+				Recurrence: []string{"RRULE:FREQ=WEEKLY"},
+			},
+			want: []string{"lunch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflicts, err := findConflicts(calendar, tt.event, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, conflict := range conflicts {
+				got = append(got, conflict.Event.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findConflicts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("calendar error", func(t *testing.T) {
+		failing := &fakeCalendar{err: errors.New("offline")}
+		event := Event{StartTime: "2024-01-08T14:00:00Z", EndTime: "2024-01-08T15:00:00Z"}
+		if _, err := findConflicts(failing, event, time.UTC); err == nil {
+			t.Error("findConflicts() succeeded, want the error of the calendar")
+		}
+	})
+}
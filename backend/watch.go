@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	watchJobInterval = time.Hour
+	// Channels are replaced when they expire within this time
+	watchRenewBefore = 24 * time.Hour
+	// Graph subscriptions on events last at most 4230 minutes
+	graphSubscriptionDuration = 70 * time.Hour
+)
+
+// Public address of the backend, empty when notifications are disabled
+var webhookURL string
+
+// WatchChannel is a Google watch channel or Graph subscription telling us
+// about changes to one calendar
+type WatchChannel struct {
+	gorm.Model
+	UserID     uint `gorm:"index;not null"`
+	AccountID  string
+	Provider   string
+	CalendarID string
+	// Google channel id or Graph subscription id
+	ChannelID string `gorm:"index"`
+	// Google's id of the watched calendar, needed to stop the channel
+	ResourceID string
+	// Sent back with every notification, proving it comes from the provider
+	Secret     string
+	Expiration time.Time
+}
+
+func webhookAddress(name string) (string, error) {
+	provider, ok := providers[name]
+	if !ok || provider.Webhook == nil {
+		return "", fmt.Errorf("provider %s has no webhook", name)
+	}
+	return webhookURL + provider.webhookPath(), nil
+}
+
+// StartWatchJob keeps a channel open for every calendar users selected
+func StartWatchJob(address string) {
+	webhookURL = address
+	go func() {
+		for {
+			renewWatches()
+			time.Sleep(watchJobInterval)
+		}
+	}()
+}
+
+type watchedAccount struct {
+	userID      uint
+	accountID   string
+	provider    string
+	calendar    WatchCalendar
+	calendarIDs []string
+}
+
+func watchedAccounts() []watchedAccount {
+	var arr []watchedAccount
+	add := func(userID uint, accountID, provider string, service Calendar) {
+		watcher, ok := service.(WatchCalendar)
+		if !ok {
+			return
+		}
+		calendarIDs := enabledCalendarIDs(getCalendarSettings(userID), accountID)
+		if len(calendarIDs) == 0 {
+			// The default calendar
+			calendarIDs = []string{""}
+		}
+		arr = append(arr, watchedAccount{
+			userID:      userID,
+			accountID:   accountID,
+			provider:    provider,
+			calendar:    watcher,
+			calendarIDs: calendarIDs,
+		})
+	}
+
+	var users []User
+	db.Where("provider IN (?)", oauthProviders()).Find(&users)
+	for i := range users {
+		service := newUserCalendar(&users[i])
+		if service == nil {
+			continue
+		}
+		add(users[i].ID, "", users[i].Provider, service)
+	}
+
+	var accounts []LinkedAccount
+	db.Find(&accounts)
+	for _, account := range accounts {
+		service, err := newAccountCalendar(account)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		add(account.UserID, strconv.FormatUint(uint64(account.ID), 10), account.Provider, service)
+	}
+	return arr
+}
+
+// renewWatches opens channels for newly selected calendars, replaces
+// channels about to expire and closes the ones no longer needed
+func renewWatches() {
+	var channels []WatchChannel
+	if err := db.Find(&channels).Error; err != nil {
+		log.Println(err.Error())
+		return
+	}
+	open := map[string][]WatchChannel{}
+	for _, channel := range channels {
+		key := fmt.Sprint(channel.UserID, "/", channel.AccountID)
+		open[key] = append(open[key], channel)
+	}
+
+	for _, account := range watchedAccounts() {
+		key := fmt.Sprint(account.userID, "/", account.accountID)
+		wanted := map[string]bool{}
+		for _, id := range account.calendarIDs {
+			wanted[id] = true
+		}
+
+		for _, channel := range open[key] {
+			if !wanted[channel.CalendarID] || channel.Provider != account.provider {
+				stopWatch(account.calendar, channel)
+				continue
+			}
+			delete(wanted, channel.CalendarID)
+			if time.Until(channel.Expiration) < watchRenewBefore {
+				// Notifications can arrive on both until the old one is gone
+				if err := startWatch(account, channel.CalendarID); err != nil {
+					log.Println(err.Error())
+					continue
+				}
+				stopWatch(account.calendar, channel)
+			}
+		}
+		for calendarID := range wanted {
+			if err := startWatch(account, calendarID); err != nil {
+				log.Println(err.Error())
+			}
+		}
+		delete(open, key)
+	}
+
+	// Accounts that couldn't be connected keep their channels until they
+	// expire, in case they come back. Removed accounts stopped theirs.
+	for _, channels := range open {
+		for _, channel := range channels {
+			if time.Now().Before(channel.Expiration) && accountExists(channel.UserID, channel.AccountID) {
+				continue
+			}
+			db.Unscoped().Delete(&channel)
+		}
+	}
+}
+
+func accountExists(userID uint, accountID string) bool {
+	if accountID == "" {
+		return !db.First(&User{}, userID).RecordNotFound()
+	}
+	return !db.Where("user_id = ? AND id = ?", userID, accountID).First(&LinkedAccount{}).RecordNotFound()
+}
+
+// stopAccountWatches closes the channels of an account before it is removed
+func stopAccountWatches(userID uint, accountID string, service Calendar) {
+	watcher, ok := service.(WatchCalendar)
+	if !ok {
+		return
+	}
+	var channels []WatchChannel
+	if err := db.Where("user_id = ? AND account_id = ?", userID, accountID).Find(&channels).Error; err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, channel := range channels {
+		stopWatch(watcher, channel)
+	}
+}
+
+func startWatch(account watchedAccount, calendarID string) error {
+	secret, err := newEventUID()
+	if err != nil {
+		return err
+	}
+	channel := &WatchChannel{
+		UserID:     account.userID,
+		AccountID:  account.accountID,
+		Provider:   account.provider,
+		CalendarID: calendarID,
+		Secret:     secret,
+	}
+	address, err := webhookAddress(account.provider)
+	if err != nil {
+		return err
+	}
+	if err := account.calendar.Watch(channel, address); err != nil {
+		return err
+	}
+	return db.Create(channel).Error
+}
+
+func stopWatch(service WatchCalendar, channel WatchChannel) {
+	if err := service.StopWatch(&channel); err != nil {
+		log.Println(err.Error())
+	}
+	db.Unscoped().Delete(&channel)
+}
+
+// cachedCalendars returns the event caches a service reads from
+func cachedCalendars(service Calendar) []*CachedCalendar {
+	switch s := service.(type) {
+	case *CachedCalendar:
+		return []*CachedCalendar{s}
+	case *CompositeCalendar:
+		var arr []*CachedCalendar
+		for _, account := range s.accounts {
+			if cached, ok := account.calendar.(*CachedCalendar); ok {
+				arr = append(arr, cached)
+			}
+		}
+		return arr
+	}
+	return nil
+}
+
+// refreshEvents is called when a provider reports changes. The cache is
+// synced in the background, and sessions of the user read it again.
+func refreshEvents(userID uint, accountID string) {
+	var stale []*CachedCalendar
+	cacheLock.Lock()
+	for token, service := range calendarCache {
+		for _, cached := range cachedCalendars(service) {
+			if cached.userID != userID {
+				continue
+			}
+			if cached.accountID == accountID {
+				stale = append(stale, cached)
+			}
+			// The assistant was given the old events
+			delete(conversationsCache, token)
+		}
+	}
+	cacheLock.Unlock()
+	// A cache may be syncing, which mustn't hold up the other requests
+	for _, cached := range stale {
+		cached.invalidate()
+	}
+	go syncAccount(userID, accountID)
+}
+
+func syncAccount(userID uint, accountID string) {
+	var service Calendar
+	if accountID == "" {
+		user := &User{}
+		if err := db.First(user, userID).Error; err != nil {
+			log.Println(err.Error())
+			return
+		}
+		service = newUserCalendar(user)
+	} else {
+		account := LinkedAccount{}
+		if err := db.Where("user_id = ? AND id = ?", userID, accountID).First(&account).Error; err != nil {
+			log.Println(err.Error())
+			return
+		}
+		var err error
+		if service, err = newAccountCalendar(account); err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+
+	cached, ok := withCache(service, userID, accountID).(*CachedCalendar)
+	if !ok {
+		return
+	}
+	cached.SelectCalendars(enabledCalendarIDs(getCalendarSettings(userID), accountID))
+	if err := cached.Sync(); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func findChannel(provider, channelID, secret string) (*WatchChannel, error) {
+	channel := &WatchChannel{}
+	if err := db.Where("provider = ? AND channel_id = ?", provider, channelID).First(channel).Error; err != nil {
+		return nil, fmt.Errorf("unknown channel %s", channelID)
+	}
+	if channel.Secret != secret {
+		return nil, fmt.Errorf("invalid token for channel %s", channelID)
+	}
+	return channel, nil
+}
+
+func GoogleWebhook(c *gin.Context) error {
+	channel, err := findChannel(Google, c.GetHeader("X-Goog-Channel-ID"), c.GetHeader("X-Goog-Channel-Token"))
+	if err != nil {
+		return err
+	}
+	// The first message only confirms that the channel was opened
+	if c.GetHeader("X-Goog-Resource-State") != "sync" {
+		refreshEvents(channel.UserID, channel.AccountID)
+	}
+	c.Status(http.StatusOK)
+	return nil
+}
+
+func MicrosoftWebhook(c *gin.Context) error {
+	// Graph checks the address when a subscription is created
+	if token := c.Query("validationToken"); token != "" {
+		c.String(http.StatusOK, token)
+		return nil
+	}
+
+	var notifications struct {
+		Value []struct {
+			SubscriptionID string `json:"subscriptionId"`
+			ClientState    string `json:"clientState"`
+		} `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&notifications); err != nil {
+		return err
+	}
+
+	refreshed := map[string]bool{}
+	for _, notification := range notifications.Value {
+		channel, err := findChannel(Microsoft, notification.SubscriptionID, notification.ClientState)
+		if err != nil {
+			// Other notifications of the batch are still valid
+			log.Println(err.Error())
+			continue
+		}
+		// Graph sends one notification per changed event
+		key := fmt.Sprint(channel.UserID, "/", channel.AccountID)
+		if !refreshed[key] {
+			refreshed[key] = true
+			refreshEvents(channel.UserID, channel.AccountID)
+		}
+	}
+	c.Status(http.StatusAccepted)
+	return nil
+}
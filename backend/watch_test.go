@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// fakeDriver is a database whose tables hold the rows given to it, which
+// records the queries. Every query of a table returns all of its rows.
+type fakeDriver struct {
+	mu      sync.Mutex
+	queries []string
+	tables  map[string][]map[string]driver.Value
+}
+
+type fakeConn struct{ driver *fakeDriver }
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+type fakeRows struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{d}, nil }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.queries = append(c.driver.queries, query)
+	return &fakeStmt{c, query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (s *fakeStmt) Close() error                               { return nil }
+func (s *fakeStmt) NumInput() int                              { return -1 }
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(1), nil }
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.conn.driver.mu.Lock()
+	defer s.conn.driver.mu.Unlock()
+	for table, rows := range s.conn.driver.tables {
+		if !strings.Contains(s.query, `FROM "`+table+`"`) || len(rows) == 0 {
+			continue
+		}
+		var columns []string
+		for column := range rows[0] {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		return &fakeRows{columns, rows}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, column := range r.columns {
+		dest[i] = r.rows[0][column]
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var (
+	fakeDatabase     = &fakeDriver{}
+	registerFakeOnce sync.Once
+)
+
+// useFakeDatabase points db at a database holding the given tables
+func useFakeDatabase(t *testing.T, tables map[string][]map[string]driver.Value) *fakeDriver {
+	registerFakeOnce.Do(func() { sql.Register("fake", fakeDatabase) })
+	conn, err := sql.Open("fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	if db, err = gorm.Open("postgres", conn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db = previous })
+
+	fakeDatabase.mu.Lock()
+	fakeDatabase.queries = nil
+	fakeDatabase.tables = tables
+	fakeDatabase.mu.Unlock()
+	return fakeDatabase
+}
+
+func serveWebhook(handler HTTPHandlerFunction, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/webhook", HandleError(handler))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMicrosoftWebhook(t *testing.T) {
+	database := useFakeDatabase(t, nil)
+
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		want     int
+		wantBody string
+		lookups  int
+	}{
+		{
+			name:     "validation",
+			url:      "/webhook?validationToken=Validation%3A+Testing",
+			want:     http.StatusOK,
+			wantBody: "Validation: Testing",
+		},
+		{
+			name: "empty batch",
+			body: `{"value":[]}`,
+			want: http.StatusAccepted,
+		},
+		{
+			name:    "unknown subscriptions are skipped",
+			body:    `{"value":[{"subscriptionId":"gone","clientState":"a"},{"subscriptionId":"other","clientState":"b"}]}`,
+			want:    http.StatusAccepted,
+			lookups: 2,
+		},
+		{
+			name: "invalid body",
+			body: `{"value":`,
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database.mu.Lock()
+			database.queries = nil
+			database.mu.Unlock()
+
+			url := tt.url
+			if url == "" {
+				url = "/webhook"
+			}
+			req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := serveWebhook(MicrosoftWebhook, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if len(database.queries) != tt.lookups {
+				t.Errorf("%d queries, want %d: %v", len(database.queries), tt.lookups, database.queries)
+			}
+		})
+	}
+}
+
+func TestGoogleWebhookUnknownChannel(t *testing.T) {
+	useFakeDatabase(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set("X-Goog-Channel-ID", "gone")
+	req.Header.Set("X-Goog-Channel-Token", "secret")
+	req.Header.Set("X-Goog-Resource-State", "exists")
+	if w := serveWebhook(GoogleWebhook, req); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -175,25 +175,43 @@ document.addEventListener("DOMContentLoaded", () => {
         const cancelButton = document.getElementById('cancel-action');
         const closeButton = document.getElementById('close-confirmation-button');
 
-        // Format the dates
-        const startDate = new Date(details.startTime).toLocaleString();
-        const endDate = new Date(details.endTime).toLocaleString();
-
-        // Populate details
-        detailsContainer.innerHTML = `
-            <div class="confirmation-item">
-                <strong>Title:</strong> 
-                <span>${details.title}</span>
-            </div>
-            <div class="confirmation-item">
-                <strong>Start:</strong> 
-                <span>${startDate}</span>
-            </div>
-            <div class="confirmation-item">
-                <strong>End:</strong> 
-                <span>${endDate}</span>
-            </div>
-        `;
+        // Details come from invites and the assistant, so they are only
+        // ever set as text
+        detailsContainer.innerHTML = "";
+        const addDetail = (label, lines) => {
+            const item = document.createElement("div");
+            item.className = "confirmation-item";
+            const strong = document.createElement("strong");
+            strong.textContent = `${label}: `;
+            const span = document.createElement("span");
+            span.style.whiteSpace = "pre-line";
+            span.textContent = lines;
+            item.append(strong, span);
+            detailsContainer.appendChild(item);
+        };
+        addDetail("Title", details.title);
+        // Tasks have no start and end
+        if (details.startTime) {
+            addDetail("Start", new Date(details.startTime).toLocaleString());
+            addDetail("End", new Date(details.endTime).toLocaleString());
+        }
+        if (details.due) {
+            addDetail("Due", new Date(details.due).toLocaleDateString());
+        }
+        if (details.location) {
+            addDetail("Location", details.location);
+        }
+        if (details.attendees?.length) {
+            addDetail("Attendees", details.attendees.map(attendee => attendee.name || attendee.email).join(", "));
+        }
+        if (details.blocks?.length) {
+            addDetail("Blocks", details.blocks.map(block =>
+                `${block.title}: ${new Date(block.startTime).toLocaleString()} - ${new Date(block.endTime).toLocaleTimeString()}`
+            ).join("\n"));
+        }
+        if (details.conflicts?.length) {
+            addDetail("Overlaps", details.conflicts.join(", "));
+        }
 
         // Show modal
         modal.style.display = 'block';
@@ -243,14 +261,23 @@ document.addEventListener("DOMContentLoaded", () => {
                 message = jsonMessage.message;
             }
 
+            // The server found problems with the proposed times
+            if (jsonMessage.errors?.length) {
+                message += "\n\n" + jsonMessage.errors
+                    .map(error => `${error.field} ${error.message}`)
+                    .join("\n");
+                jsonMessage.action = "info";
+            }
+
             if (jsonMessage.action === "add_event") {
                 const details = jsonMessage.details;
                 
-                showConfirmationModal(details, () => {
+                showConfirmationModal({ ...details, conflicts: jsonMessage.conflicts }, () => {
                     // Create calendar event
                     const eventInfo = {
                         startStr: details.startTime,
-                        endStr: details.endTime
+                        endStr: details.endTime,
+                        allDay: details.allDay === true
                     };
                     const id = getRandomHex32();
                     fetch("/api/calendar-create", {
@@ -258,19 +285,158 @@ document.addEventListener("DOMContentLoaded", () => {
                         headers: {
                             "Content-Type": "application/json"
                         },
-                        body: getGoogleEvent(eventInfo, details.title, id)
+                        body: getGoogleEvent(eventInfo, details.title, id, {
+                            // The user saw the conflicts before confirming
+                            allowOverlap: true,
+                            recurrence: details.recurrence,
+                            location: details.location,
+                            description: details.description,
+                            attendees: details.attendees,
+                            onlineMeeting: details.onlineMeeting
+                        })
                     });
                     
                     calendar.addEvent({
                         title: details.title,
                         start: details.startTime,
                         end: details.endTime,
-                        allDay: false,
+                        allDay: details.allDay === true,
                         id: id
                     });
                 });
             }
 
+            if (jsonMessage.action === "reschedule") {
+                const details = jsonMessage.details;
+                const originalStart = new Date(details.originalStart).getTime();
+                const event = calendar.getEvents().find(
+                    event => event.title === details.title && event.start.getTime() === originalStart
+                );
+
+                if (event) {
+                    showConfirmationModal({
+                        title: details.title,
+                        startTime: details.newStart,
+                        endTime: details.newEnd,
+                        conflicts: jsonMessage.conflicts
+                    }, () => {
+                        fetch("/api/calendar-update", {
+                            method: "POST",
+                            headers: {
+                                "Content-Type": "application/json"
+                            },
+                            body: getGoogleEvent({
+                                startStr: details.newStart,
+                                endStr: details.newEnd
+                            }, "", event.id, {
+                                allowOverlap: true,
+                                recurringEventId: event.extendedProps.recurringEventId,
+                                originalStartTime: event.extendedProps.originalStartTime,
+                                calendarId: event.extendedProps.calendarId,
+                                accountId: event.extendedProps.accountId,
+                                scope: details.scope
+                            })
+                        });
+
+                        event.setDates(details.newStart, details.newEnd);
+                    });
+                }
+            }
+
+            if (jsonMessage.action === "add_task") {
+                const details = jsonMessage.details;
+                showConfirmationModal({ title: details.title, due: details.due }, () => {
+                    postJSON("/api/task-create", {
+                        title: details.title,
+                        due: details.due,
+                        notes: details.notes
+                    }).then(loadTasks).catch(error => alert("Error adding task: " + error.message));
+                });
+            }
+
+            if (jsonMessage.action === "complete_task") {
+                const details = jsonMessage.details;
+                showConfirmationModal({ title: "Complete " + details.title }, () => {
+                    postJSON("/api/task-update", {
+                        id: details.taskId,
+                        listId: details.listId,
+                        status: "completed"
+                    }).then(loadTasks).catch(error => alert("Error completing task: " + error.message));
+                });
+            }
+
+            if (jsonMessage.action === "plan_tasks" && jsonMessage.plan) {
+                const plan = jsonMessage.plan;
+                if (plan.unplaced.length) {
+                    message += "\n\nNo free time before the deadline for: " +
+                        plan.unplaced.map(task => task.title).join(", ");
+                }
+                if (plan.blocks.length) {
+                    showConfirmationModal({ title: "Plan your tasks", blocks: plan.blocks }, async () => {
+                        try {
+                            const response = await fetch("/api/plan-apply", {
+                                method: "POST",
+                                headers: {
+                                    "Content-Type": "application/json"
+                                },
+                                body: JSON.stringify({ blocks: plan.blocks })
+                            });
+                            if (!response.ok) {
+                                const data = await response.json();
+                                throw new Error(data.error);
+                            }
+                            plan.blocks.forEach(block => calendar.addEvent({
+                                title: block.title,
+                                start: block.startTime,
+                                end: block.endTime
+                            }));
+                        } catch (error) {
+                            alert("Error planning tasks: " + error.message);
+                        }
+                    });
+                }
+            }
+
+            if (jsonMessage.action === "update_event") {
+                const details = jsonMessage.details;
+                const originalStart = new Date(details.originalStart).getTime();
+                const event = calendar.getEvents().find(
+                    event => event.title === details.title && event.start.getTime() === originalStart
+                );
+
+                if (event) {
+                    showConfirmationModal({
+                        title: details.title,
+                        startTime: event.startStr,
+                        endTime: event.endStr,
+                        location: details.location,
+                        attendees: details.attendees
+                    }, () => {
+                        fetch("/api/calendar-update", {
+                            method: "POST",
+                            headers: {
+                                "Content-Type": "application/json"
+                            },
+                            body: JSON.stringify({
+                                id: event.id,
+                                location: details.location,
+                                description: details.description,
+                                attendees: details.attendees,
+                                onlineMeeting: details.onlineMeeting,
+                                recurringEventId: event.extendedProps.recurringEventId,
+                                originalStartTime: event.extendedProps.originalStartTime,
+                                calendarId: event.extendedProps.calendarId,
+                                accountId: event.extendedProps.accountId,
+                                scope: details.scope
+                            })
+                        });
+
+                        event.setExtendedProp('location', details.location);
+                        event.setExtendedProp('attendees', details.attendees);
+                    });
+                }
+            }
+
         } catch (e) {
             // Not JSON, use message as-is
             console.log(e);
@@ -322,11 +488,22 @@ document.addEventListener("DOMContentLoaded", () => {
     const closeSettingsButton = document.getElementById("close-settings-button");
     const manageSubscriptionButton = document.getElementById("manage-subscription");
     const cancelSubscriptionButton = document.getElementById("cancel-subscription");
+    const saveCalendarsButton = document.getElementById("save-calendars");
+    const saveRemindersButton = document.getElementById("save-reminders");
+    const enablePushButton = document.getElementById("enable-push");
 
     // Function to open settings modal
     openSettingsButton.addEventListener("click", () => {
         settingsModal.style.display = "block";
         loadSubscriptionDetails();
+        loadCalendarSettings();
+        loadAccounts();
+        loadReminders();
+        loadPreferences();
+        loadTasks();
+        loadPolls();
+        loadBookingPages();
+        loadPolicies();
     });
 
     // Function to close settings modal
@@ -364,6 +541,636 @@ document.addEventListener("DOMContentLoaded", () => {
         }
     }
 
+    // Load the calendars of the account with the choices of the user
+    async function loadCalendarSettings() {
+        const calendarSettings = document.getElementById("calendar-settings");
+        try {
+            const response = await fetch("/api/calendars");
+            if (!response.ok) {
+                throw new Error("Failed to load calendars");
+            }
+            const data = await response.json();
+
+            calendarSettings.innerHTML = "";
+            data.items.forEach(item => {
+                const setting = document.createElement("div");
+                setting.className = "calendar-setting flex items-center justify-between";
+                setting.dataset.id = item.id;
+                setting.dataset.account = item.accountId || "";
+                setting.innerHTML = `
+                    <span></span>
+                    <div class="flex gap-3 text-sm">
+                        <label><input type="checkbox" class="calendar-enabled" ${item.enabled ? 'checked' : ''}> Show</label>
+                        <label><input type="checkbox" class="calendar-ai" ${item.aiContext ? 'checked' : ''}> Assistant</label>
+                    </div>
+                `;
+                // Names of shared calendars are chosen by other people
+                setting.querySelector("span").textContent = `${item.name}${item.readOnly ? ' (read only)' : ''}`;
+                calendarSettings.appendChild(setting);
+            });
+            // Accounts with a single calendar have nothing to choose
+            saveCalendarsButton.style.display = data.items.length > 1 ? "" : "none";
+        } catch (error) {
+            calendarSettings.innerHTML = `
+                <p class="error">Error loading calendars. Please try again later.</p>
+            `;
+        }
+    }
+
+    // Load the calendar accounts linked to the user
+    async function loadAccounts() {
+        const linkedAccounts = document.getElementById("linked-accounts");
+        try {
+            const response = await fetch("/api/accounts");
+            if (!response.ok) {
+                throw new Error("Failed to load accounts");
+            }
+            const data = await response.json();
+
+            linkedAccounts.innerHTML = "";
+            data.items.forEach(item => {
+                const account = document.createElement("div");
+                account.className = "flex items-center justify-between";
+                account.innerHTML = `
+                    <span></span>
+                    ${item.id ? `<button class="remove-account text-red-400 hover:text-red-300 text-sm" data-id="${item.id}">Remove</button>` : ''}
+                `;
+                account.querySelector("span").textContent = `${item.email} (${item.provider.toLowerCase()})`;
+                linkedAccounts.appendChild(account);
+            });
+            linkedAccounts.querySelectorAll(".remove-account").forEach(button => {
+                button.addEventListener("click", async () => {
+                    const response = await fetch("/api/account-remove", {
+                        method: "POST",
+                        headers: {
+                            "Content-Type": "application/json"
+                        },
+                        body: JSON.stringify({ id: button.dataset.id })
+                    });
+                    if (response.ok) {
+                        window.location.reload();
+                    } else {
+                        alert("Error removing account");
+                    }
+                });
+            });
+        } catch (error) {
+            linkedAccounts.innerHTML = `
+                <p class="error">Error loading accounts. Please try again later.</p>
+            `;
+        }
+    }
+
+    saveCalendarsButton.addEventListener("click", async () => {
+        const calendars = Array.from(document.querySelectorAll(".calendar-setting")).map(row => ({
+            id: row.dataset.id,
+            accountId: row.dataset.account,
+            enabled: row.querySelector(".calendar-enabled").checked,
+            aiContext: row.querySelector(".calendar-ai").checked
+        }));
+        try {
+            const response = await fetch("/api/calendars", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({ calendars: calendars })
+            });
+            if (!response.ok) {
+                throw new Error("Failed to save calendars");
+            }
+            window.location.reload();
+        } catch (error) {
+            alert("Error saving calendars: " + error.message);
+        }
+    });
+
+    // Load when and how the user is reminded of events
+    async function loadReminders() {
+        try {
+            const response = await fetch("/api/reminders");
+            if (!response.ok) {
+                throw new Error("Failed to load reminders");
+            }
+            const data = await response.json();
+            document.getElementById("reminder-offsets").value = data.offsets.join(", ");
+            document.getElementById("reminder-email").checked = data.email;
+            document.getElementById("reminder-webhook").value = data.webhookUrl;
+            enablePushButton.classList.toggle("hidden", !data.push || !("serviceWorker" in navigator));
+        } catch (error) {
+            console.error("Error loading reminders:", error);
+        }
+    }
+
+    const weekdayNames = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
+
+    function renderWeekdays(container, days) {
+        container.innerHTML = weekdayNames.map((name, day) => `
+            <label class="flex items-center gap-1">
+                <input type="checkbox" data-day="${day}" ${days.includes(day) ? "checked" : ""}> ${name}
+            </label>
+        `).join("");
+    }
+
+    function checkedWeekdays(container) {
+        return Array.from(container.querySelectorAll("[data-day]:checked"))
+            .map(input => parseInt(input.dataset.day, 10));
+    }
+
+    async function loadPreferences() {
+        try {
+            const response = await fetch("/api/preferences");
+            if (!response.ok) {
+                throw new Error("Failed to load working hours");
+            }
+            const data = await response.json();
+            document.getElementById("preference-timezone").value = data.timeZone ||
+                Intl.DateTimeFormat().resolvedOptions().timeZone;
+            document.getElementById("preference-work-start").value = data.workStart;
+            document.getElementById("preference-work-end").value = data.workEnd;
+            renderWeekdays(document.getElementById("preference-work-days"), data.workDays);
+            renderWeekdays(document.getElementById("preference-no-meeting-days"), data.noMeetingDays);
+            document.getElementById("preference-lunch-start").value = data.lunchStart;
+            document.getElementById("preference-lunch-end").value = data.lunchEnd;
+            document.getElementById("preference-meeting-lengths").value = data.meetingLengths.join(", ");
+        } catch (error) {
+            console.error("Error loading working hours:", error);
+        }
+    }
+
+    document.getElementById("save-preferences").addEventListener("click", async () => {
+        const meetingLengths = document.getElementById("preference-meeting-lengths").value
+            .split(",")
+            .map(value => parseInt(value.trim(), 10))
+            .filter(value => !isNaN(value));
+        try {
+            const response = await fetch("/api/preferences", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({
+                    timeZone: document.getElementById("preference-timezone").value.trim(),
+                    workStart: document.getElementById("preference-work-start").value,
+                    workEnd: document.getElementById("preference-work-end").value,
+                    workDays: checkedWeekdays(document.getElementById("preference-work-days")),
+                    noMeetingDays: checkedWeekdays(document.getElementById("preference-no-meeting-days")),
+                    lunchStart: document.getElementById("preference-lunch-start").value,
+                    lunchEnd: document.getElementById("preference-lunch-end").value,
+                    meetingLengths: meetingLengths
+                })
+            });
+            if (!response.ok) {
+                const data = await response.json();
+                throw new Error(data.error);
+            }
+            settingsModal.style.display = "none";
+        } catch (error) {
+            alert("Error saving working hours: " + error.message);
+        }
+    });
+
+    async function postJSON(url, task) {
+        const response = await fetch(url, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json"
+            },
+            body: JSON.stringify(task)
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            throw new Error(data.error);
+        }
+        return data;
+    }
+
+    async function loadTasks() {
+        const container = document.getElementById("task-list");
+        try {
+            const response = await fetch("/api/tasks");
+            if (!response.ok) {
+                throw new Error("Failed to load tasks");
+            }
+            const data = await response.json();
+            container.innerHTML = "";
+            if (data.tasks.length === 0) {
+                container.textContent = "No open tasks";
+            }
+            data.tasks.forEach(task => {
+                const row = document.createElement("div");
+                row.className = "flex items-center gap-2";
+                row.innerHTML = `
+                    <input type="checkbox" class="task-done">
+                    <span class="flex-1"></span>
+                    <span class="text-sm text-gray-500">${task.due || ""}</span>
+                    <button class="task-remove text-gray-500 hover:text-red-500">&times;</button>
+                `;
+                row.querySelector(".flex-1").textContent = task.title;
+                row.querySelector(".task-done").addEventListener("change", async () => {
+                    try {
+                        await postJSON("/api/task-update", { id: task.id, listId: task.listId, status: "completed" });
+                        loadTasks();
+                    } catch (error) {
+                        alert("Error completing task: " + error.message);
+                    }
+                });
+                row.querySelector(".task-remove").addEventListener("click", async () => {
+                    try {
+                        await postJSON("/api/task-remove", { id: task.id, listId: task.listId });
+                        loadTasks();
+                    } catch (error) {
+                        alert("Error removing task: " + error.message);
+                    }
+                });
+                container.appendChild(row);
+            });
+        } catch (error) {
+            console.error("Error loading tasks:", error);
+        }
+    }
+
+    document.getElementById("add-task").addEventListener("click", async () => {
+        const title = document.getElementById("task-title");
+        const due = document.getElementById("task-due");
+        try {
+            await postJSON("/api/task-create", { title: title.value.trim(), due: due.value });
+            title.value = "";
+            due.value = "";
+            loadTasks();
+        } catch (error) {
+            alert("Error adding task: " + error.message);
+        }
+    });
+
+    async function loadPolls() {
+        const container = document.getElementById("poll-list");
+        try {
+            const response = await fetch("/api/polls");
+            if (!response.ok) {
+                throw new Error("Failed to load polls");
+            }
+            const data = await response.json();
+            container.innerHTML = "";
+            data.polls.forEach(poll => {
+                const item = document.createElement("div");
+                item.className = "p-3 border border-gray-700 rounded-lg space-y-2";
+                item.innerHTML = `
+                    <div class="flex items-center gap-2">
+                        <span class="flex-1 font-medium"></span>
+                        <span class="text-sm text-gray-500">${poll.status}</span>
+                        <button class="poll-remove text-gray-500 hover:text-red-500">&times;</button>
+                    </div>
+                    <input type="text" readonly class="w-full bg-background-dark border border-gray-700 rounded px-2 py-1 text-sm"
+                        value="${location.origin}${poll.link}">
+                    <div class="poll-slots space-y-1 text-sm"></div>
+                `;
+                item.querySelector(".flex-1").textContent = poll.title;
+                const slots = item.querySelector(".poll-slots");
+                poll.slots.forEach(slot => {
+                    const row = document.createElement("div");
+                    row.className = "flex items-center gap-2";
+                    row.innerHTML = `
+                        <span class="flex-1">${new Date(slot.startTime).toLocaleString()}</span>
+                        <span title="">${slot.votes.length} votes</span>
+                    `;
+                    row.querySelector("[title]").title = slot.votes.join("\n");
+                    if (poll.status !== "scheduled") {
+                        const button = document.createElement("button");
+                        button.className = "px-2 bg-primary hover:bg-primary-dark rounded";
+                        button.textContent = "Schedule";
+                        button.addEventListener("click", () => schedulePoll(poll.id, slot.id));
+                        row.appendChild(button);
+                    } else if (slot.id === poll.chosenSlotId) {
+                        row.classList.add("text-primary");
+                    }
+                    slots.appendChild(row);
+                });
+                item.querySelector(".poll-remove").addEventListener("click", async () => {
+                    try {
+                        await postJSON("/api/poll-remove", { id: poll.id });
+                        loadPolls();
+                    } catch (error) {
+                        alert("Error removing poll: " + error.message);
+                    }
+                });
+                container.appendChild(item);
+            });
+        } catch (error) {
+            console.error("Error loading polls:", error);
+        }
+    }
+
+    async function schedulePoll(id, slotId, allowOverlap = false) {
+        const response = await fetch("/api/poll-schedule", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json"
+            },
+            body: JSON.stringify({ id, slotId, allowOverlap })
+        });
+        const data = await response.json();
+        if (response.status === 409) {
+            if (confirm(`${data.error}. Schedule anyway?`)) {
+                return schedulePoll(id, slotId, true);
+            }
+            return;
+        }
+        if (!response.ok) {
+            alert("Error scheduling poll: " + data.error);
+            return;
+        }
+        loadPolls();
+    }
+
+    document.getElementById("create-poll").addEventListener("click", async () => {
+        const title = document.getElementById("poll-title");
+        try {
+            await postJSON("/api/poll-create", {
+                title: title.value.trim(),
+                minutes: parseInt(document.getElementById("poll-minutes").value, 10) || 0,
+                autoSchedule: document.getElementById("poll-auto-schedule").checked
+            });
+            title.value = "";
+            loadPolls();
+        } catch (error) {
+            alert("Error creating poll: " + error.message);
+        }
+    });
+
+    async function loadBookingPages() {
+        const container = document.getElementById("booking-page-list");
+        try {
+            const response = await fetch("/api/booking-pages");
+            if (!response.ok) {
+                throw new Error("Failed to load booking pages");
+            }
+            const data = await response.json();
+            container.innerHTML = "";
+            data.pages.forEach(({ page, bookings }) => {
+                const item = document.createElement("div");
+                item.className = "p-3 border border-gray-700 rounded-lg space-y-2";
+                item.innerHTML = `
+                    <div class="flex items-center gap-2">
+                        <span class="flex-1 font-medium"></span>
+                        <label class="flex items-center gap-1 text-sm text-gray-500">
+                            <input type="checkbox" class="booking-page-active"> active
+                        </label>
+                        <button class="booking-page-remove text-gray-500 hover:text-red-500">&times;</button>
+                    </div>
+                    <input type="text" readonly class="w-full bg-background-dark border border-gray-700 rounded px-2 py-1 text-sm"
+                        value="${location.origin}${page.link}">
+                    <div class="booking-page-bookings space-y-1 text-sm"></div>
+                `;
+                item.querySelector(".flex-1").textContent = `${page.title} (${page.minutes} min)`;
+                const active = item.querySelector(".booking-page-active");
+                active.checked = page.active;
+                active.addEventListener("change", async () => {
+                    try {
+                        await postJSON("/api/booking-page-save", { ...page, active: active.checked });
+                    } catch (error) {
+                        active.checked = !active.checked;
+                        alert("Error saving booking page: " + error.message);
+                    }
+                });
+                const list = item.querySelector(".booking-page-bookings");
+                bookings.forEach(booking => {
+                    const row = document.createElement("div");
+                    row.textContent = `${new Date(booking.startTime).toLocaleString()} - ${booking.name} <${booking.email}>`;
+                    list.appendChild(row);
+                });
+                item.querySelector(".booking-page-remove").addEventListener("click", async () => {
+                    try {
+                        await postJSON("/api/booking-page-remove", { id: page.id });
+                        loadBookingPages();
+                    } catch (error) {
+                        alert("Error removing booking page: " + error.message);
+                    }
+                });
+                container.appendChild(item);
+            });
+        } catch (error) {
+            console.error("Error loading booking pages:", error);
+        }
+    }
+
+    document.getElementById("create-booking-page").addEventListener("click", async () => {
+        const title = document.getElementById("booking-page-title");
+        const slug = document.getElementById("booking-page-slug");
+        const number = id => parseInt(document.getElementById(id).value, 10) || 0;
+        try {
+            await postJSON("/api/booking-page-save", {
+                title: title.value.trim(),
+                slug: slug.value.trim(),
+                minutes: number("booking-page-minutes"),
+                bufferBefore: number("booking-page-buffer-before"),
+                bufferAfter: number("booking-page-buffer-after"),
+                dailyLimit: number("booking-page-daily-limit"),
+                noticeMinutes: number("booking-page-notice") * 60,
+                horizonDays: number("booking-page-horizon"),
+                onlineMeeting: document.getElementById("booking-page-online").checked,
+                active: true
+            });
+            title.value = "";
+            slug.value = "";
+            loadBookingPages();
+        } catch (error) {
+            alert("Error saving booking page: " + error.message);
+        }
+    });
+
+    // Rules for focus time and buffers, edited in place until saved
+    let policyRules = [];
+
+    async function loadPolicies() {
+        try {
+            const response = await fetch("/api/policies");
+            if (!response.ok) {
+                throw new Error("Failed to load rules");
+            }
+            const data = await response.json();
+            policyRules = data.rules;
+            renderPolicies();
+        } catch (error) {
+            console.error("Error loading rules:", error);
+        }
+    }
+
+    function renderPolicies() {
+        const container = document.getElementById("policy-rules");
+        container.innerHTML = "";
+        policyRules.forEach((rule, index) => {
+            const row = document.createElement("div");
+            row.className = "bg-background-dark border border-gray-700 rounded-lg p-3 space-y-2";
+            const minutes = `<input type="number" min="1" max="480" value="${rule.minutes}" data-field="minutes"
+                class="w-20 bg-surface-dark border border-gray-700 rounded px-2 py-1"> min`;
+            if (rule.kind === "focus") {
+                row.innerHTML = `
+                    <div class="flex items-center gap-2 flex-wrap">
+                        Focus time ${minutes} between
+                        <input type="time" value="${rule.windowStart}" data-field="windowStart"
+                            class="bg-surface-dark border border-gray-700 rounded px-2 py-1">
+                        and
+                        <input type="time" value="${rule.windowEnd}" data-field="windowEnd"
+                            class="bg-surface-dark border border-gray-700 rounded px-2 py-1">
+                    </div>
+                    <div class="flex items-center gap-3 flex-wrap">
+                        ${weekdayNames.map((name, day) => `
+                            <label class="flex items-center gap-1">
+                                <input type="checkbox" data-day="${day}" ${rule.days.includes(day) ? "checked" : ""}> ${name}
+                            </label>
+                        `).join("")}
+                    </div>
+                `;
+            } else {
+                row.innerHTML = `
+                    <div class="flex items-center gap-2 flex-wrap">Buffer ${minutes}</div>
+                    <div class="flex items-center gap-3 flex-wrap">
+                        <label class="flex items-center gap-1"><input type="checkbox" data-field="before" ${rule.before ? "checked" : ""}> Before</label>
+                        <label class="flex items-center gap-1"><input type="checkbox" data-field="after" ${rule.after ? "checked" : ""}> After</label>
+                        <label class="flex items-center gap-1"><input type="checkbox" data-field="externalOnly" ${rule.externalOnly ? "checked" : ""}> External meetings only</label>
+                        <label class="flex items-center gap-1"><input type="checkbox" data-field="inPersonOnly" ${rule.inPersonOnly ? "checked" : ""}> With a location only</label>
+                    </div>
+                `;
+            }
+            const remove = document.createElement("button");
+            remove.className = "text-red-400 hover:text-red-300";
+            remove.textContent = "Remove";
+            remove.addEventListener("click", () => {
+                policyRules.splice(index, 1);
+                renderPolicies();
+            });
+            row.appendChild(remove);
+
+            row.querySelectorAll("[data-field]").forEach(input => {
+                input.addEventListener("change", () => {
+                    const field = input.dataset.field;
+                    if (input.type === "checkbox") {
+                        rule[field] = input.checked;
+                    } else if (input.type === "number") {
+                        rule[field] = parseInt(input.value, 10) || 0;
+                    } else {
+                        rule[field] = input.value;
+                    }
+                });
+            });
+            row.querySelectorAll("[data-day]").forEach(input => {
+                input.addEventListener("change", () => {
+                    const day = parseInt(input.dataset.day, 10);
+                    rule.days = rule.days.filter(d => d !== day);
+                    if (input.checked) {
+                        rule.days.push(day);
+                    }
+                });
+            });
+            container.appendChild(row);
+        });
+    }
+
+    document.getElementById("add-focus-rule").addEventListener("click", () => {
+        policyRules.push({
+            kind: "focus",
+            minutes: 120,
+            windowStart: "08:00",
+            windowEnd: "12:00",
+            days: [1, 2, 3, 4, 5]
+        });
+        renderPolicies();
+    });
+
+    document.getElementById("add-buffer-rule").addEventListener("click", () => {
+        policyRules.push({
+            kind: "buffer",
+            minutes: 15,
+            after: true,
+            externalOnly: true
+        });
+        renderPolicies();
+    });
+
+    document.getElementById("save-policies").addEventListener("click", async () => {
+        try {
+            const response = await fetch("/api/policies", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({ rules: policyRules })
+            });
+            if (!response.ok) {
+                const data = await response.json();
+                throw new Error(data.error);
+            }
+            settingsModal.style.display = "none";
+        } catch (error) {
+            alert("Error saving rules: " + error.message);
+        }
+    });
+
+    saveRemindersButton.addEventListener("click", async () => {
+        const offsets = document.getElementById("reminder-offsets").value
+            .split(",")
+            .map(value => parseInt(value.trim(), 10))
+            .filter(value => !isNaN(value));
+        try {
+            const response = await fetch("/api/reminders", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify({
+                    offsets: offsets,
+                    email: document.getElementById("reminder-email").checked,
+                    webhookUrl: document.getElementById("reminder-webhook").value.trim()
+                })
+            });
+            if (!response.ok) {
+                const data = await response.json();
+                throw new Error(data.error);
+            }
+            settingsModal.style.display = "none";
+        } catch (error) {
+            alert("Error saving reminders: " + error.message);
+        }
+    });
+
+    // Subscribe this browser to push messages
+    enablePushButton.addEventListener("click", async () => {
+        try {
+            const permission = await Notification.requestPermission();
+            if (permission !== "granted") {
+                return;
+            }
+            const keyResponse = await fetch("/api/push-key");
+            const { publicKey } = await keyResponse.json();
+            const registration = await navigator.serviceWorker.register("/static/sw.js");
+            const subscription = await registration.pushManager.subscribe({
+                userVisibleOnly: true,
+                applicationServerKey: urlBase64ToUint8Array(publicKey)
+            });
+            const response = await fetch("/api/push-subscribe", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json"
+                },
+                body: JSON.stringify(subscription)
+            });
+            if (!response.ok) {
+                throw new Error("Failed to subscribe");
+            }
+            alert("Browser notifications are enabled.");
+        } catch (error) {
+            alert("Error enabling notifications: " + error.message);
+        }
+    });
+
+    function urlBase64ToUint8Array(value) {
+        const base64 = (value + "=".repeat((4 - value.length % 4) % 4))
+            .replace(/-/g, "+")
+            .replace(/_/g, "/");
+        return Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+    }
+
     // Manage subscription
     manageSubscriptionButton.addEventListener("click", async () => {
         try {
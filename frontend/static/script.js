@@ -4,16 +4,21 @@ function getRandomHex32() {
     return Array.from(array, byte => byte.toString(16).padStart(2, '0')).join('');
 }
 
-function getGoogleEvent(info, title, id) {
+function getGoogleEvent(info, title, id, extra = {}) {
     const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
-    const startTime = new Date(info.startStr).toISOString();
-    const endTime = new Date(info.endStr).toISOString();
+    const allDay = info.allDay === true;
+    // All-day events keep their dates, with an exclusive end date
+    const startTime = allDay ? info.startStr : new Date(info.startStr).toISOString();
+    const endTime = allDay ? info.endStr : new Date(info.endStr).toISOString();
 
     return JSON.stringify({
         title: title,
         startTime: startTime,
         endTime: endTime,
-        id: id
+        allDay: allDay,
+        timeZone: timeZone,
+        id: id,
+        ...extra
     });
 }
 
@@ -23,7 +28,7 @@ function findEvent(title, start, end) {
     );
 }
 
-function showConfirmationModal(title, message, details, onConfirm) {
+function showConfirmationModal(title, message, details, onConfirm, onCancel) {
     const modal = document.getElementById('confirmation-modal');
     const detailsContainer = document.getElementById('confirmation-details');
     const confirmButton = document.getElementById('confirm-action');
@@ -36,11 +41,13 @@ function showConfirmationModal(title, message, details, onConfirm) {
     detailsContainer.innerHTML = `
         <div class="bg-background-dark rounded-lg p-4 space-y-3">
             <div class="text-gray-300">
-                <span class="font-medium text-gray-200">${message}</span>
+                <span class="font-medium text-gray-200"></span>
             </div>
-            ${details}
         </div>
     `;
+    const box = detailsContainer.firstElementChild;
+    box.querySelector('span').textContent = message;
+    box.appendChild(details);
 
     // Show modal with animation
     modal.classList.remove('hidden');
@@ -62,6 +69,9 @@ function showConfirmationModal(title, message, details, onConfirm) {
         setTimeout(() => {
             modal.classList.add('hidden');
             cleanup();
+            if (onCancel) {
+                onCancel();
+            }
         }, 200);
     };
 
@@ -87,6 +97,78 @@ function showConfirmationModal(title, message, details, onConfirm) {
     window.addEventListener('click', handleOutsideClick);
 }
 
+// detailRows lays out [label, value] pairs. Values are text, as they come
+// from invites and the assistant, or nodes built by the caller.
+function detailRows(rows) {
+    const container = document.createElement('div');
+    container.className = 'space-y-2';
+    rows.forEach(([label, value]) => {
+        const row = document.createElement('div');
+        row.className = 'flex items-center justify-between text-gray-300';
+        const name = document.createElement('span');
+        name.className = 'font-medium';
+        name.textContent = `${label}:`;
+        row.appendChild(name);
+        if (value instanceof Node) {
+            row.appendChild(value);
+        } else {
+            const text = document.createElement('span');
+            text.textContent = value;
+            row.appendChild(text);
+        }
+        container.appendChild(row);
+    });
+    return container;
+}
+
+// safeURL returns the address when it is a web page, never a javascript: or
+// other URL that would run in our page
+function safeURL(address) {
+    try {
+        const url = new URL(address);
+        return url.protocol === 'http:' || url.protocol === 'https:' ? url.href : null;
+    } catch {
+        return null;
+    }
+}
+
+// Saves an event, asking first when it overlaps other events. Resolves to
+// false when the user keeps the calendar as it was.
+async function writeEvent(url, body) {
+    const response = await fetch(url, {
+        method: "POST",
+        body: body
+    });
+    if (response.status === 409) {
+        const data = await response.json();
+        const conflicts = document.createElement('ul');
+        conflicts.className = 'list-disc list-inside text-gray-300';
+        data.conflicts.forEach(conflict => {
+            const item = document.createElement('li');
+            item.textContent = conflict.message;
+            conflicts.appendChild(item);
+        });
+        return new Promise(resolve => {
+            showConfirmationModal(
+                'Overlapping Events',
+                'This overlaps other events. Save it anyway?',
+                conflicts,
+                () => {
+                    const event = JSON.parse(body);
+                    event.allowOverlap = true;
+                    resolve(writeEvent(url, JSON.stringify(event)));
+                },
+                () => resolve(false)
+            );
+        });
+    }
+    if (!response.ok) {
+        const data = await response.json().catch(() => ({}));
+        throw new Error(data.error || response.statusText);
+    }
+    return true;
+}
+
 document.addEventListener('DOMContentLoaded', function() {
     var calendarEl = document.getElementById('calendar');
     const eventModal = document.getElementById('event-modal');
@@ -136,7 +218,7 @@ document.addEventListener('DOMContentLoaded', function() {
         },
         // Calendar styling options
         height: 'auto',
-        allDaySlot: false,
+        allDaySlot: true,
         expandRows: true,
         slotDuration: '00:30:00',
         slotLabelInterval: '01:00',
@@ -199,30 +281,67 @@ document.addEventListener('DOMContentLoaded', function() {
             eventTitleInput.focus();
         },
         
+        eventDrop: function(info) {
+            updateEvent(info);
+        },
+
+        eventResize: function(info) {
+            updateEvent(info);
+        },
+
         eventClick: function(info) {
-            const details = `
-                <div class="space-y-2">
-                    <div class="flex items-center justify-between text-gray-300">
-                        <span class="font-medium">Event:</span>
-                        <span>${info.event.title}</span>
-                    </div>
-                    <div class="flex items-center justify-between text-gray-300">
-                        <span class="font-medium">Time:</span>
-                        <span>${new Date(info.event.start).toLocaleString()} - ${new Date(info.event.end).toLocaleString()}</span>
-                    </div>
-                </div>
-            `;
+            const recurringEventId = info.event.extendedProps.recurringEventId;
+            const rows = [
+                ['Event', info.event.title],
+                ['Time', `${new Date(info.event.start).toLocaleString()} - ${new Date(info.event.end).toLocaleString()}`]
+            ];
+            if (info.event.extendedProps.location) {
+                rows.push(['Location', info.event.extendedProps.location]);
+            }
+            const meetingUrl = safeURL(info.event.extendedProps.meetingUrl);
+            if (meetingUrl) {
+                const link = document.createElement('a');
+                link.href = meetingUrl;
+                link.target = '_blank';
+                link.rel = 'noopener noreferrer';
+                link.className = 'underline';
+                link.textContent = 'Join';
+                rows.push(['Meeting', link]);
+            }
+            const details = detailRows(rows);
+            if (recurringEventId) {
+                const label = document.createElement('label');
+                label.className = 'flex items-center gap-2 text-gray-300';
+                label.innerHTML = `
+                    <input type="checkbox" id="delete-series">
+                    <span>Delete all occurrences</span>
+                `;
+                details.appendChild(label);
+            }
 
             showConfirmationModal(
                 'Delete Event',
                 'Are you sure you want to delete this event?',
                 details,
                 () => {
+                    const wholeSeries = recurringEventId && document.getElementById('delete-series').checked;
                     fetch("/api/calendar-remove", {
                         method: "POST",
-                        body: getGoogleEvent(info.event, "", info.event.id),
+                        body: getGoogleEvent(info.event, "", info.event.id, {
+                            recurringEventId: recurringEventId,
+                            originalStartTime: info.event.extendedProps.originalStartTime,
+                            calendarId: info.event.extendedProps.calendarId,
+                            accountId: info.event.extendedProps.accountId,
+                            scope: wholeSeries ? "series" : "this"
+                        }),
                     });
-                    info.event.remove();
+                    if (wholeSeries) {
+                        calendar.getEvents()
+                            .filter(event => event.extendedProps.recurringEventId === recurringEventId)
+                            .forEach(event => event.remove());
+                    } else {
+                        info.event.remove();
+                    }
                     showToast('Event has been deleted.');
                 }
             );
@@ -234,18 +353,10 @@ document.addEventListener('DOMContentLoaded', function() {
         e.preventDefault();
         const title = eventTitleInput.value.trim();
         if (title && selectedEventInfo) {
-            const details = `
-                <div class="space-y-2">
-                    <div class="flex items-center justify-between text-gray-300">
-                        <span class="font-medium">Title:</span>
-                        <span>${title}</span>
-                    </div>
-                    <div class="flex items-center justify-between text-gray-300">
-                        <span class="font-medium">Time:</span>
-                        <span>${new Date(selectedEventInfo.startStr).toLocaleString()} - ${new Date(selectedEventInfo.endStr).toLocaleString()}</span>
-                    </div>
-                </div>
-            `;
+            const details = detailRows([
+                ['Title', title],
+                ['Time', `${new Date(selectedEventInfo.startStr).toLocaleString()} - ${new Date(selectedEventInfo.endStr).toLocaleString()}`]
+            ]);
 
             showConfirmationModal(
                 'Create Event',
@@ -253,21 +364,40 @@ document.addEventListener('DOMContentLoaded', function() {
                 details,
                 () => {
                     const id = getRandomHex32();
-                    calendar.addEvent({
+                    const target = document.getElementById('event-calendar').selectedOptions[0];
+                    const calendarId = target ? target.value : '';
+                    const accountId = target ? target.dataset.account : '';
+                    const added = calendar.addEvent({
                         title: title,
                         start: selectedEventInfo.startStr,
                         end: selectedEventInfo.endStr,
                         allDay: selectedEventInfo.allDay,
-                        id: id
+                        id: id,
+                        extendedProps: {
+                            calendarId: calendarId,
+                            accountId: accountId
+                        }
                     });
 
-                    fetch("/api/calendar-create", {
-                        method: "POST",
-                        body: getGoogleEvent(selectedEventInfo, title, id),
+                    const body = getGoogleEvent(selectedEventInfo, title, id, {
+                        calendarId: calendarId,
+                        accountId: accountId
                     });
-
                     closeEventModal();
-                    showToast('Event has been created.');
+
+                    writeEvent("/api/calendar-create", body)
+                        .then(saved => {
+                            if (saved) {
+                                showToast('Event has been created.');
+                            } else {
+                                added.remove();
+                            }
+                        })
+                        .catch(error => {
+                            console.error('Error creating event:', error);
+                            added.remove();
+                            showToast(error.message, 'error');
+                        });
                 }
             );
         } else {
@@ -275,6 +405,29 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
+    function updateEvent(info) {
+        const event = info.event;
+        writeEvent("/api/calendar-update", getGoogleEvent(event, "", event.id, {
+            recurringEventId: event.extendedProps.recurringEventId,
+            originalStartTime: event.extendedProps.originalStartTime,
+            calendarId: event.extendedProps.calendarId,
+            accountId: event.extendedProps.accountId,
+            scope: "this"
+        }))
+            .then(saved => {
+                if (saved) {
+                    showToast('Event has been moved.');
+                } else {
+                    info.revert();
+                }
+            })
+            .catch(error => {
+                console.error('Error updating event:', error);
+                info.revert();
+                showToast('Failed to move event.', 'error');
+            });
+    }
+
     // Custom toast function
     function showToast(message, type = 'success') {
         const toast = document.createElement('div');
@@ -299,6 +452,44 @@ document.addEventListener('DOMContentLoaded', function() {
         }, 2000);
     }
 
+    // Use the browser's zone as home zone until the user picks one
+    fetch("/api/timezone")
+        .then(response => response.json())
+        .then(data => {
+            if (!data.timeZone) {
+                fetch("/api/timezone", {
+                    method: "POST",
+                    headers: {
+                        "Content-Type": "application/json"
+                    },
+                    body: JSON.stringify({
+                        timeZone: Intl.DateTimeFormat().resolvedOptions().timeZone
+                    })
+                });
+            }
+        })
+        .catch(error => console.error('Error loading time zone:', error));
+
+    // Offer the writable calendars of all accounts as targets for new events
+    fetch("/api/calendars")
+        .then(response => response.json())
+        .then(data => {
+            const writable = (data.items || []).filter(item => item.enabled && !item.readOnly);
+            if (writable.length < 2) {
+                return;
+            }
+            const select = document.getElementById('event-calendar');
+            // Names of shared calendars are chosen by other people
+            select.innerHTML = '';
+            writable.forEach(item => {
+                const option = new Option(item.name, item.id, false, item.primary && !item.accountId);
+                option.dataset.account = item.accountId || '';
+                select.appendChild(option);
+            });
+            document.getElementById('event-calendar-container').classList.remove('hidden');
+        })
+        .catch(error => console.error('Error loading calendars:', error));
+
     // Load initial events
     fetch("/api/calendar-load", {
         method: "GET",
@@ -310,8 +501,18 @@ document.addEventListener('DOMContentLoaded', function() {
                     title: item.title,
                     start: item.startTime,
                     end: item.endTime,
-                    allDay: false,
-                    id: item.id
+                    allDay: item.allDay === true,
+                    id: item.id,
+                    extendedProps: {
+                        recurringEventId: item.recurringEventId,
+                        originalStartTime: item.originalStartTime,
+                        location: item.location,
+                        description: item.description,
+                        attendees: item.attendees,
+                        meetingUrl: item.meetingUrl,
+                        calendarId: item.calendarId,
+                        accountId: item.accountId
+                    }
                 });
             });
         })